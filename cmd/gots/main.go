@@ -10,6 +10,8 @@ import (
 	"github.com/confluentinc/confluent-kafka-go/kafka"
 	"github.com/go-kit/kit/metrics/expvar"
 	"github.com/murphybytes/gots/internal/config"
+	"github.com/murphybytes/gots/internal/service/storage"
+	"github.com/murphybytes/gots/internal/service/subscriber"
 	"github.com/murphybytes/gots/server"
 )
 
@@ -31,6 +33,84 @@ func main() {
 		},
 	}
 
+	evictionPolicy, err := storage.ParseEvictionPolicy(config.Storage.EvictionPolicy)
+	if err != nil {
+		fmt.Printf("Invalid configuration: %s", err)
+		os.Exit(1)
+	}
+
+	overloadPolicy, err := storage.ParseOverloadPolicy(config.Storage.OverloadPolicy)
+	if err != nil {
+		fmt.Printf("Invalid configuration: %s", err)
+		os.Exit(1)
+	}
+
+	duplicates, err := storage.ParseDuplicates(config.Storage.Duplicates)
+	if err != nil {
+		fmt.Printf("Invalid configuration: %s", err)
+		os.Exit(1)
+	}
+
+	walSync, err := storage.ParseSyncPolicy(config.WAL.Sync)
+	if err != nil {
+		fmt.Printf("Invalid configuration: %s", err)
+		os.Exit(1)
+	}
+
+	slowSubscribers, err := storage.ParseSlowSubscriberPolicy(config.Subscriptions.SlowPolicy)
+	if err != nil {
+		fmt.Printf("Invalid configuration: %s", err)
+		os.Exit(1)
+	}
+
+	// partitions are rewound far enough to rebuild the longest retention window
+	var retention []storage.RetentionPolicy
+	rewind := config.Storage.MaxAge
+	for _, p := range config.Retention.Policies {
+		keys, err := storage.ParseKeyMatcher(p.Keys)
+		if err != nil {
+			fmt.Printf("Invalid configuration: %s", err)
+			os.Exit(1)
+		}
+		retention = append(retention, storage.RetentionPolicy{
+			Keys:   keys,
+			MaxAge: p.MaxAge,
+		})
+		if p.MaxAge > rewind {
+			rewind = p.MaxAge
+		}
+	}
+
+	var seriesLimits []storage.SeriesLimit
+	for _, l := range config.Cardinality.Limits {
+		keys, err := storage.ParseKeyMatcher(l.Keys)
+		if err != nil {
+			fmt.Printf("Invalid configuration: %s", err)
+			os.Exit(1)
+		}
+		seriesLimits = append(seriesLimits, storage.SeriesLimit{
+			Keys:            keys,
+			MaxSeries:       l.MaxSeries,
+			MaxNewPerSecond: l.MaxNewPerSecond,
+		})
+	}
+
+	decoders := make(map[string]subscriber.Decoder)
+	for topic, spec := range config.Kafka.Decoders {
+		if decoders[topic], err = subscriber.ParseDecoder(spec); err != nil {
+			fmt.Printf("Invalid configuration: decoder for topic %s: %s", topic, err)
+			os.Exit(1)
+		}
+	}
+
+	timestamps := make(map[string]subscriber.Timestamps)
+	for topic, spec := range config.Kafka.Timestamps {
+		if timestamps[topic], err = subscriber.ParseTimestamps(spec); err != nil {
+			fmt.Printf("Invalid configuration: timestamps for topic %s: %s", topic, err)
+			os.Exit(1)
+		}
+	}
+
 	listener, err := net.Listen("tcp", config.Server.MetricsAddress)
 	if err != nil {
 		fmt.Printf("Unable to create metrics endpoint: %s", err)
@@ -41,10 +121,51 @@ func main() {
 		http.Serve(listener, nil)
 	}()
 
+	// without brokers gots only receives elements through its Write endpoints
+	var sources []server.Source
+	if len(config.Kafka.BrokerAddress) > 0 {
+		sources = append(sources, subscriber.New(
+			kafkaConfig,
+			subscriber.Decoders(decoders),
+			subscriber.DecodeFailures(expvar.NewCounter("gots.decode.failure.counter")),
+			subscriber.TimestampSources(timestamps),
+			subscriber.MissingTimestamps(expvar.NewCounter("gots.missing.timestamp.counter")),
+			subscriber.Rewind(rewind),
+			subscriber.MaxReadyLag(config.Kafka.MaxReadyLag),
+		))
+	}
+
 	err = server.Run(
-		kafkaConfig,
+		server.Sources(sources...),
 		server.ListenAddress(config.Server.Address),
 		server.MessageCounter(expvar.NewCounter("gots.message.counter")),
+		server.MemoryBudget(config.Storage.MaxBytes),
+		server.MaxElementsPerKey(config.Storage.MaxElementsPerKey),
+		server.Eviction(evictionPolicy),
+		server.ElementMaxAge(config.Storage.MaxAge),
+		server.RetentionPolicies(retention...),
+		server.EvictionCounter(expvar.NewCounter("gots.eviction.counter")),
+		server.Overload(overloadPolicy, config.Storage.OverloadTimeout),
+		// expvar ignores the worker label, so these report the drops of every worker and the depth of the last worker
+		// sampled
+		server.QueueDepth(expvar.NewGauge("gots.queue.depth.gauge")),
+		server.DropCounter(expvar.NewCounter("gots.drop.counter")),
+		server.Duplicates(duplicates),
+		server.MaxLateness(config.Storage.MaxLateness),
+		server.SeriesLimits(config.Cardinality.MaxSeries, config.Cardinality.MaxNewSeriesPerSecond, seriesLimits...),
+		server.RejectCounter(expvar.NewCounter("gots.reject.counter")),
+		server.WriteAheadLog(storage.WALOptions{
+			Dir:          config.WAL.Dir,
+			Sync:         walSync,
+			SyncInterval: config.WAL.SyncInterval,
+			SegmentSize:  config.WAL.SegmentSize,
+		}),
+		server.Snapshots(storage.SnapshotOptions{
+			Path:     config.Snapshot.Path,
+			Interval: config.Snapshot.Interval,
+		}),
+		server.SubscriptionBuffer(config.Subscriptions.BufferSize),
+		server.SlowSubscribers(slowSubscribers),
 	)
 	if err != nil {
 		fmt.Printf("Serve exited with error: %s", err)
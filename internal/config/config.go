@@ -2,6 +2,7 @@
 package config
 
 import (
+	"strconv"
 	"strings"
 	"time"
 
@@ -21,8 +22,20 @@ type kafka struct {
 	GroupID string `env:"GOTS_GROUP_ID"`
 	// SessionTimeout length of time to wait for session to timeout.
 	SessionTimeout time.Duration `env:"GETS_SESSION_TIMEOUT,default=6000ms"`
+	// Decoders semicolon delimited list of TOPIC=DECODER pairs, for example trades=json:key=sym,fields=px|size. Topics
+	// without a decoder are stored as received.
+	Decoders topicSpecs `env:"GOTS_DECODERS"`
+	// Timestamps semicolon delimited list of TOPIC=SOURCE pairs, for example quotes=header:name=exchange-time,format=ms.
+	// Sources are payload, kafka, header and ingest. Topics without a source use the time found by their decoder.
+	Timestamps topicSpecs `env:"GOTS_TIMESTAMPS"`
+	// MaxReadyLag is the number of messages each assigned partition may be behind while the server reports that it
+	// is ready. Until then search results are marked incomplete.
+	MaxReadyLag int64 `env:"GOTS_MAX_READY_LAG,default=1000"`
 }
 
+// topicSpecs maps topic names to specifications.
+type topicSpecs map[string]string
+
 func (k *kafka) TimeoutMS() int {
 	return int(k.SessionTimeout.Nanoseconds() / 1000000)
 }
@@ -36,6 +49,88 @@ type storage struct {
 	// ChannelBufferSize is the size of the channel used by each worker.  Bigger numbers may increase throughput.
 	// at a cost of higher latency
 	ChannelBufferSize int `env:"GOTS_CHANNEL_BUFFER_SIZE,default=1000"`
+	// MaxBytes approximate limit on memory used by time series elements. Zero means no limit.
+	MaxBytes int64 `env:"GOTS_MAX_BYTES,default=0"`
+	// MaxElementsPerKey limit on the number of elements kept for each key. Zero means no limit.
+	MaxElementsPerKey int `env:"GOTS_MAX_ELEMENTS_PER_KEY,default=0"`
+	// EvictionPolicy is either oldest or largest. Oldest evicts the oldest elements across all keys, largest evicts the
+	// oldest elements of the largest series.
+	EvictionPolicy string `env:"GOTS_EVICTION_POLICY,default=oldest"`
+	// OverloadPolicy is one of block, timeout, drop-newest or drop-oldest and decides what happens to incoming
+	// elements when a worker's queue is full.
+	OverloadPolicy string `env:"GOTS_OVERLOAD_POLICY,default=block"`
+	// OverloadTimeout is how long the timeout policy waits for room in a queue before dropping an element.
+	OverloadTimeout time.Duration `env:"GOTS_OVERLOAD_TIMEOUT,default=1s"`
+	// Duplicates is one of keep, last, first or reject and decides what happens to an element with the same
+	// timestamp as an element already stored for its key.
+	Duplicates string `env:"GOTS_DUPLICATES,default=keep"`
+	// MaxLateness rejects elements older than the newest element of their key by more than this. Zero means no limit.
+	MaxLateness time.Duration `env:"GOTS_MAX_LATENESS,default=0s"`
+}
+
+// Cardinality settings that limit the number of series to protect against producers that put unique values in keys.
+type cardinality struct {
+	// MaxSeries is the largest number of series held. Zero means no limit.
+	MaxSeries int `env:"GOTS_MAX_SERIES,default=0"`
+	// MaxNewSeriesPerSecond is the rate at which series may be created. Zero means no limit.
+	MaxNewSeriesPerSecond float64 `env:"GOTS_MAX_NEW_SERIES_PER_SECOND,default=0"`
+	// Limits comma delimited list of KEYS=MAX_SERIES/MAX_NEW_PER_SECOND, for example prefix:trade.=10000/50. Either
+	// number may be zero for no limit. The first matching limit is applied along with the limits above.
+	Limits seriesLimits `env:"GOTS_SERIES_LIMITS"`
+}
+
+// SeriesLimit limits the number of series, and the rate at which they are created, for keys matching Keys. Keys is a
+// match type, exact, prefix or glob, followed by a colon and a pattern.
+type SeriesLimit struct {
+	Keys            string
+	MaxSeries       int
+	MaxNewPerSecond float64
+}
+
+type seriesLimits []SeriesLimit
+
+// RetentionPolicy sets the maximum age of elements for keys matching Keys. Keys is a match type, exact, prefix or
+// glob, followed by a colon and a pattern.
+type RetentionPolicy struct {
+	Keys   string
+	MaxAge time.Duration
+}
+
+type retentionPolicies []RetentionPolicy
+
+// Retention settings that override the storage MaxAge for some keys.
+type retention struct {
+	// Policies comma delimited list of KEYS=MAX_AGE pairs, for example prefix:book.=5m,glob:index.*=24h. The first
+	// matching policy is used.
+	Policies retentionPolicies `env:"GOTS_RETENTION_POLICIES"`
+}
+
+// WAL settings for the write ahead log used to recover elements after a restart.
+type wal struct {
+	// Dir is the directory the log is written to. The log is disabled if Dir is empty.
+	Dir string `env:"GOTS_WAL_DIR"`
+	// Sync is one of always, interval or never and controls how often the log is synced to disk.
+	Sync string `env:"GOTS_WAL_SYNC,default=interval"`
+	// SyncInterval is the time between syncs when Sync is interval.
+	SyncInterval time.Duration `env:"GOTS_WAL_SYNC_INTERVAL,default=1s"`
+	// SegmentSize is the size in bytes of log files.
+	SegmentSize int64 `env:"GOTS_WAL_SEGMENT_SIZE,default=67108864"`
+}
+
+// Snapshot settings for point in time copies of storage used to warm start the server.
+type snapshot struct {
+	// Path of the snapshot file. Snapshots are disabled if Path is empty.
+	Path string `env:"GOTS_SNAPSHOT_PATH"`
+	// Interval between snapshots. Zero means snapshots are only taken on request.
+	Interval time.Duration `env:"GOTS_SNAPSHOT_INTERVAL,default=0s"`
+}
+
+// Subscriptions settings for clients streaming elements from the Subscribe endpoint.
+type subscriptions struct {
+	// BufferSize is the number of elements buffered for each client.
+	BufferSize int `env:"GOTS_SUBSCRIPTION_BUFFER_SIZE,default=1024"`
+	// SlowPolicy is either drop or disconnect and decides what happens to clients that fall behind.
+	SlowPolicy string `env:"GOTS_SLOW_SUBSCRIBER_POLICY,default=drop"`
 }
 
 type server struct {
@@ -46,10 +141,15 @@ type server struct {
 }
 
 type values struct {
-	ServiceName string `env:"GOTS_SERVICE_NAME,default=gots"`
-	Kafka       kafka
-	Storage     storage
-	Server      server
+	ServiceName   string `env:"GOTS_SERVICE_NAME,default=gots"`
+	Kafka         kafka
+	Storage       storage
+	Retention     retention
+	Cardinality   cardinality
+	WAL           wal
+	Snapshot      snapshot
+	Subscriptions subscriptions
+	Server        server
 }
 
 // New reads environment variables for the application and returns a structure containing these values.
@@ -70,3 +170,52 @@ func (t *list) Decode(v string) error {
 func (t *list) String() string {
 	return strings.Join(*t, ",")
 }
+
+func (r *retentionPolicies) Decode(v string) error {
+	for _, item := range strings.Split(v, ",") {
+		i := strings.LastIndex(item, "=")
+		if i < 0 {
+			return errors.Errorf("retention policy '%s' is not of the form KEYS=MAX_AGE", item)
+		}
+		age, err := time.ParseDuration(item[i+1:])
+		if err != nil {
+			return errors.Wrapf(err, "retention policy '%s'", item)
+		}
+		*r = append(*r, RetentionPolicy{Keys: item[:i], MaxAge: age})
+	}
+	return nil
+}
+
+func (d *topicSpecs) Decode(v string) error {
+	if *d == nil {
+		*d = make(topicSpecs)
+	}
+	for _, item := range strings.Split(v, ";") {
+		i := strings.Index(item, "=")
+		if i < 0 {
+			return errors.Errorf("'%s' is not of the form TOPIC=SPEC", item)
+		}
+		(*d)[item[:i]] = item[i+1:]
+	}
+	return nil
+}
+
+func (l *seriesLimits) Decode(v string) error {
+	for _, item := range strings.Split(v, ",") {
+		i := strings.LastIndex(item, "=")
+		j := strings.LastIndex(item, "/")
+		if i < 0 || j < i {
+			return errors.Errorf("series limit '%s' is not of the form KEYS=MAX_SERIES/MAX_NEW_PER_SECOND", item)
+		}
+		maxSeries, err := strconv.Atoi(item[i+1 : j])
+		if err != nil {
+			return errors.Wrapf(err, "series limit '%s'", item)
+		}
+		rate, err := strconv.ParseFloat(item[j+1:], 64)
+		if err != nil {
+			return errors.Wrapf(err, "series limit '%s'", item)
+		}
+		*l = append(*l, SeriesLimit{Keys: item[:i], MaxSeries: maxSeries, MaxNewPerSecond: rate})
+	}
+	return nil
+}
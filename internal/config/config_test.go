@@ -12,16 +12,56 @@ import (
 func TestConfig(t *testing.T) {
 	os.Setenv("GOTS_BROKER_ADDRESS", "192.168.1.1:9093")
 	os.Setenv("GOTS_TOPICS", "topic1,topic2")
+	os.Setenv("GOTS_DECODERS", "trades=json:key=sym,fields=px|size;quotes=protobuf")
+	os.Setenv("GOTS_TIMESTAMPS", "quotes=header:name=exchange-time,format=ms,fallback=kafka")
 	os.Setenv("GOTS_MAX_ELEMENT_AGE", "20s")
 	os.Setenv("GOTS_WORKER_COUNT", "300")
 	os.Setenv("GOTS_CHANNEL_BUFFER_SIZE", "123")
+	os.Setenv("GOTS_MAX_BYTES", "1073741824")
+	os.Setenv("GOTS_EVICTION_POLICY", "largest")
+	os.Setenv("GOTS_OVERLOAD_POLICY", "drop-oldest")
+	os.Setenv("GOTS_DUPLICATES", "last")
+	os.Setenv("GOTS_RETENTION_POLICIES", "prefix:book.=5m,glob:index.*=24h")
+	os.Setenv("GOTS_MAX_SERIES", "100000")
+	os.Setenv("GOTS_SERIES_LIMITS", "prefix:trade.=10000/50,glob:*-*=0/0.5")
+	os.Setenv("GOTS_WAL_DIR", "/var/lib/gots")
+	os.Setenv("GOTS_SNAPSHOT_PATH", "/var/lib/gots/snapshot")
+	os.Setenv("GOTS_SNAPSHOT_INTERVAL", "10m")
 
 	v, e := New()
 	require.Nil(t, e)
 
 	assert.Equal(t, list{"192.168.1.1:9093"}, v.Kafka.BrokerAddress)
 	assert.Equal(t, list{"topic1", "topic2"}, v.Kafka.Topics)
+	assert.Equal(t, topicSpecs{"trades": "json:key=sym,fields=px|size", "quotes": "protobuf"}, v.Kafka.Decoders)
+	assert.Equal(t, topicSpecs{"quotes": "header:name=exchange-time,format=ms,fallback=kafka"}, v.Kafka.Timestamps)
+	assert.Equal(t, int64(1000), v.Kafka.MaxReadyLag)
 	assert.Equal(t, 20*time.Second, v.Storage.MaxAge)
 	assert.Equal(t, 300, v.Storage.WorkerCount)
 	assert.Equal(t, 123, v.Storage.ChannelBufferSize)
+	assert.Equal(t, int64(1073741824), v.Storage.MaxBytes)
+	assert.Equal(t, 0, v.Storage.MaxElementsPerKey)
+	assert.Equal(t, "largest", v.Storage.EvictionPolicy)
+	assert.Equal(t, "drop-oldest", v.Storage.OverloadPolicy)
+	assert.Equal(t, time.Second, v.Storage.OverloadTimeout)
+	assert.Equal(t, "last", v.Storage.Duplicates)
+	assert.Equal(t, time.Duration(0), v.Storage.MaxLateness)
+	assert.Equal(t, retentionPolicies{
+		{Keys: "prefix:book.", MaxAge: 5 * time.Minute},
+		{Keys: "glob:index.*", MaxAge: 24 * time.Hour},
+	}, v.Retention.Policies)
+	assert.Equal(t, 100000, v.Cardinality.MaxSeries)
+	assert.Equal(t, float64(0), v.Cardinality.MaxNewSeriesPerSecond)
+	assert.Equal(t, seriesLimits{
+		{Keys: "prefix:trade.", MaxSeries: 10000, MaxNewPerSecond: 50},
+		{Keys: "glob:*-*", MaxSeries: 0, MaxNewPerSecond: 0.5},
+	}, v.Cardinality.Limits)
+	assert.Equal(t, "/var/lib/gots", v.WAL.Dir)
+	assert.Equal(t, "interval", v.WAL.Sync)
+	assert.Equal(t, time.Second, v.WAL.SyncInterval)
+	assert.Equal(t, "/var/lib/gots/snapshot", v.Snapshot.Path)
+	assert.Equal(t, 10*time.Minute, v.Snapshot.Interval)
+	assert.Equal(t, 1024, v.Subscriptions.BufferSize)
+	assert.Equal(t, "drop", v.Subscriptions.SlowPolicy)
 }
+
@@ -70,6 +70,176 @@ func(mw *loggingMiddleware) Login(ctx context.Context, req *api.LoginRequest)(re
 	return resp, err
 }
 
+func (mw *loggingMiddleware) Last(ctx context.Context, req *api.LastRequest) (resp *api.SearchResponse, err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log(
+			"method", "Last",
+			"key", req.Key,
+			"duration", time.Since(begin),
+			"err", err,
+		)
+	}(time.Now())
+	resp, err = mw.next.Last(ctx, req)
+	return resp, err
+}
+
+func (mw *loggingMiddleware) MultiSearch(ctx context.Context, req *api.MultiSearchRequest) (resp *api.MultiSearchResponse, err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log(
+			"method", "MultiSearch",
+			"keys", len(req.Keys),
+			"duration", time.Since(begin),
+			"err", err,
+		)
+	}(time.Now())
+	resp, err = mw.next.MultiSearch(ctx, req)
+	return resp, err
+}
+
+func (mw *loggingMiddleware) MultiSearchStream(req *api.MultiSearchRequest, stream api.TimeseriesService_MultiSearchStreamServer) (err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log(
+			"method", "MultiSearchStream",
+			"keys", len(req.Keys),
+			"duration", time.Since(begin),
+			"err", err,
+		)
+	}(time.Now())
+	return mw.next.MultiSearchStream(req, stream)
+}
+
+func (mw *loggingMiddleware) Aggregate(ctx context.Context, req *api.AggregateRequest) (resp *api.AggregateResponse, err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log(
+			"method", "Aggregate",
+			"duration", time.Since(begin),
+			"err", err,
+		)
+	}(time.Now())
+	resp, err = mw.next.Aggregate(ctx, req)
+	return resp, err
+}
+
+func (mw *loggingMiddleware) Candles(ctx context.Context, req *api.CandleRequest) (resp *api.CandleResponse, err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log(
+			"method", "Candles",
+			"duration", time.Since(begin),
+			"err", err,
+		)
+	}(time.Now())
+	resp, err = mw.next.Candles(ctx, req)
+	return resp, err
+}
+
+func (mw *loggingMiddleware) StreamCandles(req *api.CandleRequest, stream api.TimeseriesService_StreamCandlesServer) (err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log(
+			"method", "StreamCandles",
+			"duration", time.Since(begin),
+			"err", err,
+		)
+	}(time.Now())
+	return mw.next.StreamCandles(req, stream)
+}
+
+func (mw *loggingMiddleware) Subscribe(req *api.SubscribeRequest, stream api.TimeseriesService_SubscribeServer) (err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log(
+			"method", "Subscribe",
+			"duration", time.Since(begin),
+			"err", err,
+		)
+	}(time.Now())
+	return mw.next.Subscribe(req, stream)
+}
+
+func (mw *loggingMiddleware) Write(ctx context.Context, req *api.WriteRequest) (resp *api.WriteResponse, err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log(
+			"method", "Write",
+			"duration", time.Since(begin),
+			"err", err,
+		)
+	}(time.Now())
+	resp, err = mw.next.Write(ctx, req)
+	return resp, err
+}
+
+func (mw *loggingMiddleware) WriteStream(stream api.TimeseriesService_WriteStreamServer) (err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log(
+			"method", "WriteStream",
+			"duration", time.Since(begin),
+			"err", err,
+		)
+	}(time.Now())
+	return mw.next.WriteStream(stream)
+}
+
+func (mw *loggingMiddleware) DeleteSeries(ctx context.Context, req *api.DeleteSeriesRequest) (resp *api.DeleteResponse, err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log(
+			"method", "DeleteSeries",
+			"key", req.Key,
+			"duration", time.Since(begin),
+			"err", err,
+		)
+	}(time.Now())
+	resp, err = mw.next.DeleteSeries(ctx, req)
+	return resp, err
+}
+
+func (mw *loggingMiddleware) DeleteRange(ctx context.Context, req *api.DeleteRangeRequest) (resp *api.DeleteResponse, err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log(
+			"method", "DeleteRange",
+			"key", req.Key,
+			"oldest", req.Oldest,
+			"newest", req.Newest,
+			"duration", time.Since(begin),
+			"err", err,
+		)
+	}(time.Now())
+	resp, err = mw.next.DeleteRange(ctx, req)
+	return resp, err
+}
+
+func (mw *loggingMiddleware) ListKeys(ctx context.Context, req *api.ListKeysRequest) (resp *api.ListKeysResponse, err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log(
+			"method", "ListKeys",
+			"duration", time.Since(begin),
+			"err", err,
+		)
+	}(time.Now())
+	resp, err = mw.next.ListKeys(ctx, req)
+	return resp, err
+}
+
+func (mw *loggingMiddleware) Snapshot(ctx context.Context, req *api.SnapshotRequest) (resp *api.SnapshotResponse, err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log(
+			"method", "Snapshot",
+			"duration", time.Since(begin),
+			"err", err,
+		)
+	}(time.Now())
+	resp, err = mw.next.Snapshot(ctx, req)
+	return resp, err
+}
+
+func (mw *loggingMiddleware) Cardinality(ctx context.Context, req *api.CardinalityRequest) (resp *api.CardinalityResponse, err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log(
+			"method", "Cardinality",
+			"duration", time.Since(begin),
+			"err", err,
+		)
+	}(time.Now())
+	resp, err = mw.next.Cardinality(ctx, req)
+	return resp, err
+}
 
 type authMiddleware struct {
 	next TimeseriesService
@@ -101,3 +271,101 @@ func (mw *authMiddleware) Search(ctx context.Context, req *api.SearchRequest) (*
 func(mw *authMiddleware) Login(ctx context.Context, req *api.LoginRequest)(*api.LoginResponse, error) {
 	return mw.next.Login(ctx, req)
 }
+
+func (mw *authMiddleware) Last(ctx context.Context, req *api.LastRequest) (*api.SearchResponse, error) {
+	if !Authenticated(ctx) {
+		return nil, status.Error(codes.Unauthenticated, "unauthorized")
+	}
+	return mw.next.Last(ctx, req)
+}
+
+func (mw *authMiddleware) MultiSearch(ctx context.Context, req *api.MultiSearchRequest) (*api.MultiSearchResponse, error) {
+	if !Authenticated(ctx) {
+		return nil, status.Error(codes.Unauthenticated, "unauthorized")
+	}
+	return mw.next.MultiSearch(ctx, req)
+}
+
+func (mw *authMiddleware) MultiSearchStream(req *api.MultiSearchRequest, stream api.TimeseriesService_MultiSearchStreamServer) error {
+	if !Authenticated(stream.Context()) {
+		return status.Error(codes.Unauthenticated, "unauthorized")
+	}
+	return mw.next.MultiSearchStream(req, stream)
+}
+
+func (mw *authMiddleware) Aggregate(ctx context.Context, req *api.AggregateRequest) (*api.AggregateResponse, error) {
+	if !Authenticated(ctx) {
+		return nil, status.Error(codes.Unauthenticated, "unauthorized")
+	}
+	return mw.next.Aggregate(ctx, req)
+}
+
+func (mw *authMiddleware) Candles(ctx context.Context, req *api.CandleRequest) (*api.CandleResponse, error) {
+	if !Authenticated(ctx) {
+		return nil, status.Error(codes.Unauthenticated, "unauthorized")
+	}
+	return mw.next.Candles(ctx, req)
+}
+
+func (mw *authMiddleware) StreamCandles(req *api.CandleRequest, stream api.TimeseriesService_StreamCandlesServer) error {
+	if !Authenticated(stream.Context()) {
+		return status.Error(codes.Unauthenticated, "unauthorized")
+	}
+	return mw.next.StreamCandles(req, stream)
+}
+
+func (mw *authMiddleware) Subscribe(req *api.SubscribeRequest, stream api.TimeseriesService_SubscribeServer) error {
+	if !Authenticated(stream.Context()) {
+		return status.Error(codes.Unauthenticated, "unauthorized")
+	}
+	return mw.next.Subscribe(req, stream)
+}
+
+func (mw *authMiddleware) Write(ctx context.Context, req *api.WriteRequest) (*api.WriteResponse, error) {
+	if !Authenticated(ctx) {
+		return nil, status.Error(codes.Unauthenticated, "unauthorized")
+	}
+	return mw.next.Write(ctx, req)
+}
+
+func (mw *authMiddleware) WriteStream(stream api.TimeseriesService_WriteStreamServer) error {
+	if !Authenticated(stream.Context()) {
+		return status.Error(codes.Unauthenticated, "unauthorized")
+	}
+	return mw.next.WriteStream(stream)
+}
+
+func (mw *authMiddleware) DeleteSeries(ctx context.Context, req *api.DeleteSeriesRequest) (*api.DeleteResponse, error) {
+	if !Authenticated(ctx) {
+		return nil, status.Error(codes.Unauthenticated, "unauthorized")
+	}
+	return mw.next.DeleteSeries(ctx, req)
+}
+
+func (mw *authMiddleware) DeleteRange(ctx context.Context, req *api.DeleteRangeRequest) (*api.DeleteResponse, error) {
+	if !Authenticated(ctx) {
+		return nil, status.Error(codes.Unauthenticated, "unauthorized")
+	}
+	return mw.next.DeleteRange(ctx, req)
+}
+
+func (mw *authMiddleware) ListKeys(ctx context.Context, req *api.ListKeysRequest) (*api.ListKeysResponse, error) {
+	if !Authenticated(ctx) {
+		return nil, status.Error(codes.Unauthenticated, "unauthorized")
+	}
+	return mw.next.ListKeys(ctx, req)
+}
+
+func (mw *authMiddleware) Snapshot(ctx context.Context, req *api.SnapshotRequest) (*api.SnapshotResponse, error) {
+	if !Authenticated(ctx) {
+		return nil, status.Error(codes.Unauthenticated, "unauthorized")
+	}
+	return mw.next.Snapshot(ctx, req)
+}
+
+func (mw *authMiddleware) Cardinality(ctx context.Context, req *api.CardinalityRequest) (*api.CardinalityResponse, error) {
+	if !Authenticated(ctx) {
+		return nil, status.Error(codes.Unauthenticated, "unauthorized")
+	}
+	return mw.next.Cardinality(ctx, req)
+}
@@ -2,6 +2,10 @@ package service
 
 import (
 	"context"
+	"encoding/base64"
+	"io"
+	"path"
+	"time"
 
 	"github.com/go-kit/kit/log"
 	"github.com/murphybytes/gots/api"
@@ -14,19 +18,43 @@ import (
 type TimeseriesService interface {
 	Search(context.Context, *api.SearchRequest) (*api.SearchResponse, error)
 	Login(context.Context, *api.LoginRequest) (*api.LoginResponse, error)
+	Last(context.Context, *api.LastRequest) (*api.SearchResponse, error)
+	MultiSearch(context.Context, *api.MultiSearchRequest) (*api.MultiSearchResponse, error)
+	MultiSearchStream(*api.MultiSearchRequest, api.TimeseriesService_MultiSearchStreamServer) error
+	Aggregate(context.Context, *api.AggregateRequest) (*api.AggregateResponse, error)
+	Candles(context.Context, *api.CandleRequest) (*api.CandleResponse, error)
+	StreamCandles(*api.CandleRequest, api.TimeseriesService_StreamCandlesServer) error
+	Subscribe(*api.SubscribeRequest, api.TimeseriesService_SubscribeServer) error
+	Write(context.Context, *api.WriteRequest) (*api.WriteResponse, error)
+	WriteStream(api.TimeseriesService_WriteStreamServer) error
+	DeleteSeries(context.Context, *api.DeleteSeriesRequest) (*api.DeleteResponse, error)
+	DeleteRange(context.Context, *api.DeleteRangeRequest) (*api.DeleteResponse, error)
+	ListKeys(context.Context, *api.ListKeysRequest) (*api.ListKeysResponse, error)
+	Snapshot(context.Context, *api.SnapshotRequest) (*api.SnapshotResponse, error)
+	Cardinality(context.Context, *api.CardinalityRequest) (*api.CardinalityResponse, error)
 }
 
 type svc struct {
-	searcher     storage.Searcher
+	storage      storage.Manager
 	loginHandler LoginHandler
+	ready        ReadyHandler
 }
 
-func New(logger log.Logger, searcher storage.Searcher, hLogin LoginHandler) TimeseriesService {
+// ReadyHandler returns false while the ingestion sources are still replaying elements into storage.
+type ReadyHandler func() bool
+
+// New returns the service for mgr. When hAuth is set every endpoint but Login rejects requests that were not
+// authenticated by the grpc interceptor.
+func New(logger log.Logger, mgr storage.Manager, hAuth AuthHandler, hLogin LoginHandler, hReady ReadyHandler) TimeseriesService {
 	var s TimeseriesService
 	{
 		s = &svc{
-			searcher:     searcher,
+			storage:      mgr,
 			loginHandler: hLogin,
+			ready:        hReady,
+		}
+		if hAuth != nil {
+			s = &authMiddleware{next: s}
 		}
 		s = newLoggingMiddleware(logger)(s)
 	}
@@ -35,12 +63,147 @@ func New(logger log.Logger, searcher storage.Searcher, hLogin LoginHandler) Time
 
 // Search for time series elements by key and timestamp range
 func (s *svc) Search(ctx context.Context, req *api.SearchRequest) (*api.SearchResponse, error) {
+	elts, err := s.storage.Search(ctx, req.Key, req.Oldest, req.Newest)
+	return s.markIncomplete(searchResponse(req.Key, elts, err))
+}
+
+// Last returns the newest elements of a series or, if AsOf is set, the newest element at or before AsOf.
+func (s *svc) Last(ctx context.Context, req *api.LastRequest) (*api.SearchResponse, error) {
+	if req.AsOf == 0 {
+		count := int(req.Count)
+		if count == 0 {
+			count = 1
+		}
+		elts, err := s.storage.Last(ctx, req.Key, count)
+		return s.markIncomplete(searchResponse(req.Key, elts, err))
+	}
+	if req.Count > 1 {
+		return searchResponse(req.Key, nil, &storage.ErrorInvalidSearch{})
+	}
+	elt, err := s.storage.LastBefore(ctx, req.Key, req.AsOf)
+	return s.markIncomplete(searchResponse(req.Key, []api.Element{elt}, err))
+}
+
+// MultiSearch searches several keys with one storage job per worker.
+func (s *svc) MultiSearch(ctx context.Context, req *api.MultiSearchRequest) (*api.MultiSearchResponse, error) {
+	results, err := s.multiSearch(ctx, req)
+	if _, ok := err.(storage.InvalidSearch); ok {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if err != nil {
+		return nil, storageError(err)
+	}
+	resp := &api.MultiSearchResponse{Results: make([]*api.SearchResponse, len(results))}
+	for i, r := range results {
+		if resp.Results[i], err = s.markIncomplete(keyResponse(r)); err != nil {
+			return nil, err
+		}
+	}
+	return resp, nil
+}
+
+// multiSearch searches the keys of a request or, if it has label matchers, the series selected by its labels.
+func (s *svc) multiSearch(ctx context.Context, req *api.MultiSearchRequest) ([]storage.KeyResult, error) {
+	if len(req.Labels) == 0 {
+		return s.storage.MultiSearch(ctx, req.Keys, req.Oldest, req.Newest)
+	}
+	if len(req.Keys) > 0 {
+		return nil, status.Error(codes.InvalidArgument, "only one of keys and labels may be set")
+	}
+	matchers, err := labelMatchers(req.Labels)
+	if err != nil {
+		return nil, err
+	}
+	return s.storage.SearchLabels(ctx, matchers, req.Oldest, req.Newest)
+}
+
+// labelMatchers converts matchers from a request, returning an InvalidArgument error for a bad regular expression.
+func labelMatchers(in []*api.LabelMatcher) ([]storage.LabelMatcher, error) {
+	var matchers []storage.LabelMatcher
+	for _, m := range in {
+		if m == nil {
+			continue
+		}
+		matcher, err := storage.NewLabelMatcher(storage.LabelMatchType(m.Type), m.Name, m.Value)
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		matchers = append(matchers, matcher)
+	}
+	return matchers, nil
+}
+
+// MultiSearchStream sends the results for the keys held by each worker as soon as the worker has searched them.
+// Results for series selected by labels are sent in key order once every worker has searched them.
+func (s *svc) MultiSearchStream(req *api.MultiSearchRequest, stream api.TimeseriesService_MultiSearchStreamServer) error {
+	send := func(results []storage.KeyResult) error {
+		for _, r := range results {
+			resp, err := s.markIncomplete(keyResponse(r))
+			if err != nil {
+				return err
+			}
+			if err = stream.Send(resp); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	var err error
+	if len(req.Labels) == 0 {
+		err = s.storage.MultiSearchStream(stream.Context(), req.Keys, req.Oldest, req.Newest, send)
+	} else {
+		var results []storage.KeyResult
+		if results, err = s.multiSearch(stream.Context(), req); err == nil {
+			err = send(results)
+		}
+	}
+	if _, ok := err.(storage.InvalidSearch); ok {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	return storageError(err)
+}
+
+// storageError converts the errors that any storage operation can return into gRPC status errors. Other errors are
+// returned unchanged.
+func storageError(err error) error {
+	switch err {
+	case context.Canceled:
+		return status.Error(codes.Canceled, err.Error())
+	case context.DeadlineExceeded:
+		return status.Error(codes.DeadlineExceeded, err.Error())
+	case storage.ErrClosed:
+		return status.Error(codes.Unavailable, err.Error())
+	case storage.ErrOverloaded:
+		return status.Error(codes.ResourceExhausted, err.Error())
+	}
+	return err
+}
+
+// keyResponse converts the result of a multiple key search to a response.
+func keyResponse(r storage.KeyResult) (*api.SearchResponse, error) {
+	resp, err := searchResponse(r.Key, r.Elements, r.Err)
+	if err != nil {
+		return nil, err
+	}
+	resp.Results.Labels = r.Labels
+	return resp, nil
+}
+
+// markIncomplete flags a search response while the ingestion sources are replaying, as it may be missing elements.
+func (s *svc) markIncomplete(resp *api.SearchResponse, err error) (*api.SearchResponse, error) {
+	if resp != nil && s.ready != nil && !s.ready() {
+		resp.Incomplete = true
+	}
+	return resp, err
+}
+
+// searchResponse converts the outcome of a search of key to a response.
+func searchResponse(key string, elts []api.Element, err error) (*api.SearchResponse, error) {
 	var resp api.SearchResponse
 	resp.Results = &api.Series{
-		Key: req.Key,
+		Key: key,
 	}
 
-	elts, err := s.searcher.Search(req.Key, req.Oldest, req.Newest)
 	switch err.(type) {
 	case storage.KeyNotFound:
 		resp.Status = api.SearchResponse_NOT_FOUND
@@ -50,10 +213,11 @@ func (s *svc) Search(ctx context.Context, req *api.SearchRequest) (*api.SearchRe
 		return &resp, nil
 	case nil:
 	default:
-		return nil, err
+		return nil, storageError(err)
 	}
-	for _, elt := range elts {
-		resp.Results.Elements = append(resp.Results.Elements, &elt)
+	resp.Results.Elements = make([]*api.Element, len(elts))
+	for i := range elts {
+		resp.Results.Elements[i] = &elts[i]
 	}
 
 	return &resp, nil
@@ -69,3 +233,411 @@ func (s *svc) Login(ctx context.Context, req *api.LoginRequest) (*api.LoginRespo
 	}
 	return &api.LoginResponse{token}, nil
 }
+
+// Aggregate summarises a series into buckets of equal width.
+func (s *svc) Aggregate(ctx context.Context, req *api.AggregateRequest) (*api.AggregateResponse, error) {
+	// the api enumerations have the same values as their storage counterparts
+	functions := make([]storage.Aggregation, len(req.Functions))
+	for i, fn := range req.Functions {
+		functions[i] = storage.Aggregation(fn)
+	}
+	result, err := s.storage.Aggregate(ctx, storage.AggregateRequest{
+		Key:       req.Key,
+		First:     req.Oldest,
+		Last:      req.Newest,
+		Width:     time.Duration(req.BucketWidth),
+		Functions: functions,
+		Encoding:  storage.ValueEncoding(req.Encoding),
+	})
+	switch err.(type) {
+	case storage.KeyNotFound:
+		return nil, status.Error(codes.NotFound, err.Error())
+	case storage.InvalidSearch:
+		return nil, status.Error(codes.InvalidArgument, "a time range, bucket width and at least one function are required")
+	case nil:
+	default:
+		return nil, storageError(err)
+	}
+
+	resp := &api.AggregateResponse{Skipped: int64(result.Skipped)}
+	for _, b := range result.Buckets {
+		resp.Rows = append(resp.Rows, &api.AggregateRow{Start: b.Start, Values: b.Values})
+	}
+	return resp, nil
+}
+
+// candleCloseDelay allows for trades that reach storage shortly after the end of their bar.
+const candleCloseDelay = time.Second
+
+func candleRequest(req *api.CandleRequest) storage.CandleRequest {
+	return storage.CandleRequest{
+		Key:      req.Key,
+		First:    req.Oldest,
+		Last:     req.Newest,
+		Interval: time.Duration(req.Interval),
+		Decoding: storage.TickDecoding{
+			Layout: storage.TickLayout(req.Layout),
+			Price:  storage.ValueEncoding(req.PriceEncoding),
+			Volume: storage.ValueEncoding(req.VolumeEncoding),
+		},
+	}
+}
+
+func candle(c storage.Candle) *api.Candle {
+	return &api.Candle{
+		Start:  c.Start,
+		Open:   c.Open,
+		High:   c.High,
+		Low:    c.Low,
+		Close:  c.Close,
+		Volume: c.Volume,
+		Count:  int64(c.Count),
+	}
+}
+
+// Candles returns open, high, low, close and volume bars for a series.
+func (s *svc) Candles(ctx context.Context, req *api.CandleRequest) (*api.CandleResponse, error) {
+	candles, err := s.storage.Candles(ctx, candleRequest(req))
+	switch err.(type) {
+	case storage.KeyNotFound:
+		return nil, status.Error(codes.NotFound, err.Error())
+	case storage.InvalidSearch:
+		return nil, status.Error(codes.InvalidArgument, "a time range and interval are required")
+	case nil:
+	default:
+		return nil, storageError(err)
+	}
+	var resp api.CandleResponse
+	for _, c := range candles {
+		resp.Candles = append(resp.Candles, candle(c))
+	}
+	return &resp, nil
+}
+
+// StreamCandles sends bars for trades already stored and then each bar as it closes. A bar closes candleCloseDelay
+// after its end, trades for a bar that has closed are ignored.
+func (s *svc) StreamCandles(req *api.CandleRequest, stream api.TimeseriesService_StreamCandlesServer) error {
+	creq := candleRequest(req)
+	if creq.Interval <= 0 {
+		return status.Error(codes.InvalidArgument, "an interval is required")
+	}
+	sub, err := s.storage.Subscribe(stream.Context(), storage.SubscribeRequest{
+		Keys:     []storage.KeyMatcher{{Type: storage.MatchExact, Pattern: req.Key}},
+		Backfill: true,
+		Oldest:   req.Oldest,
+	})
+	if err != nil {
+		return storageError(err)
+	}
+	defer sub.Close()
+
+	b := storage.NewCandleBuilder(creq.Interval, creq.Decoding)
+	for _, u := range sub.Backfill() {
+		b.Add(u.Element)
+	}
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+	for {
+		for _, c := range b.Close(time.Now().Add(-candleCloseDelay).UnixNano()) {
+			if err := stream.Send(candle(c)); err != nil {
+				return err
+			}
+		}
+
+		wait := time.Hour
+		if next, ok := b.Next(); ok {
+			wait = time.Until(time.Unix(0, next).Add(candleCloseDelay))
+		}
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(wait)
+
+		select {
+		case <-stream.Context().Done():
+			return stream.Context().Err()
+		case u, ok := <-sub.Updates():
+			if !ok {
+				if sub.Err() == storage.ErrSlowSubscriber {
+					return status.Error(codes.ResourceExhausted, sub.Err().Error())
+				}
+				return nil
+			}
+			if u.Element.Timestamp >= int64(req.Oldest) {
+				b.Add(u.Element)
+			}
+		case <-timer.C:
+		}
+	}
+}
+
+// subscribeBatchSize is the largest number of backfill elements sent in one message.
+const subscribeBatchSize = 1024
+
+// Subscribe streams elements written to the requested keys. Backfill is sent first, one series at a time, followed
+// by each new element as it is written.
+func (s *svc) Subscribe(req *api.SubscribeRequest, stream api.TimeseriesService_SubscribeServer) error {
+	var keys []storage.KeyMatcher
+	for _, key := range req.Keys {
+		keys = append(keys, storage.KeyMatcher{Type: storage.MatchExact, Pattern: key})
+	}
+	if req.Prefix != "" {
+		keys = append(keys, storage.KeyMatcher{Type: storage.MatchPrefix, Pattern: req.Prefix})
+	}
+	sub, err := s.storage.Subscribe(stream.Context(), storage.SubscribeRequest{
+		Keys:     keys,
+		Backfill: req.Backfill,
+		Oldest:   req.Oldest,
+	})
+	if _, ok := err.(storage.InvalidSearch); ok {
+		return status.Error(codes.InvalidArgument, "a key or prefix is required")
+	}
+	if err != nil {
+		return storageError(err)
+	}
+	defer sub.Close()
+
+	backfill := sub.Backfill()
+	for len(backfill) > 0 {
+		series := &api.Series{Key: backfill[0].Key}
+		for len(backfill) > 0 && backfill[0].Key == series.Key && len(series.Elements) < subscribeBatchSize {
+			elt := backfill[0].Element
+			series.Elements = append(series.Elements, &elt)
+			backfill = backfill[1:]
+		}
+		if err := stream.Send(series); err != nil {
+			return err
+		}
+	}
+
+	for {
+		select {
+		case <-stream.Context().Done():
+			return stream.Context().Err()
+		case u, ok := <-sub.Updates():
+			if !ok {
+				if sub.Err() == storage.ErrSlowSubscriber {
+					return status.Error(codes.ResourceExhausted, sub.Err().Error())
+				}
+				return nil
+			}
+			if err := stream.Send(&api.Series{Key: u.Key, Elements: []*api.Element{&u.Element}}); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// Write adds elements to storage. Every element is queued before waiting for storage to admit them.
+func (s *svc) Write(ctx context.Context, req *api.WriteRequest) (*api.WriteResponse, error) {
+	var resp api.WriteResponse
+	var pending []storage.Admission
+	for _, series := range req.Series {
+		var err error
+		if pending, err = s.write(ctx, series, &resp, pending); err != nil {
+			return nil, err
+		}
+	}
+	if err := admitted(ctx, pending, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// maxPendingWrites is the number of elements WriteStream queues before waiting for storage to admit them.
+const maxPendingWrites = 10000
+
+// WriteStream adds each series received to storage until the client closes the stream.
+func (s *svc) WriteStream(stream api.TimeseriesService_WriteStreamServer) error {
+	var resp api.WriteResponse
+	var pending []storage.Admission
+	for {
+		series, err := stream.Recv()
+		if err == io.EOF {
+			if err = admitted(stream.Context(), pending, &resp); err != nil {
+				return err
+			}
+			return stream.SendAndClose(&resp)
+		}
+		if err != nil {
+			return err
+		}
+		if pending, err = s.write(stream.Context(), series, &resp, pending); err != nil {
+			return err
+		}
+		if len(pending) >= maxPendingWrites {
+			if err = admitted(stream.Context(), pending, &resp); err != nil {
+				return err
+			}
+			pending = pending[:0]
+		}
+	}
+}
+
+// write queues the elements of a series, appending their admissions to pending and counting invalid elements as
+// rejected in resp. Labels sent with the series replace the labels it holds.
+func (s *svc) write(
+	ctx context.Context,
+	series *api.Series,
+	resp *api.WriteResponse,
+	pending []storage.Admission,
+) ([]storage.Admission, error) {
+	if series == nil {
+		return pending, nil
+	}
+	labels := storage.Labels(series.Labels)
+	for _, elt := range series.Elements {
+		if series.Key == "" || elt == nil || elt.Timestamp <= 0 {
+			resp.Rejected++
+			continue
+		}
+		a, err := s.storage.WriteAdmitted(ctx, series.Key, labels, time.Unix(0, elt.Timestamp), elt.Data)
+		if err != nil {
+			return pending, storageError(err)
+		}
+		pending = append(pending, a)
+	}
+	return pending, nil
+}
+
+// admitted waits for storage to admit or reject the queued elements, counting them as accepted or rejected in resp.
+func admitted(ctx context.Context, pending []storage.Admission, resp *api.WriteResponse) error {
+	for _, a := range pending {
+		switch err := a.Wait(ctx); err {
+		case nil:
+			resp.Accepted++
+		case storage.ErrRejected:
+			resp.Rejected++
+		default:
+			return storageError(err)
+		}
+	}
+	return nil
+}
+
+// DeleteSeries removes every element of a key.
+func (s *svc) DeleteSeries(ctx context.Context, req *api.DeleteSeriesRequest) (*api.DeleteResponse, error) {
+	return deleteResponse(s.storage.DeleteSeries(ctx, req.Key))
+}
+
+// DeleteRange removes the elements of a key between two times.
+func (s *svc) DeleteRange(ctx context.Context, req *api.DeleteRangeRequest) (*api.DeleteResponse, error) {
+	return deleteResponse(s.storage.DeleteRange(ctx, req.Key, req.Oldest, req.Newest))
+}
+
+func deleteResponse(deleted int, err error) (*api.DeleteResponse, error) {
+	switch err.(type) {
+	case storage.KeyNotFound:
+		return nil, status.Error(codes.NotFound, err.Error())
+	case storage.InvalidSearch:
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	case nil:
+	default:
+		return nil, storageError(err)
+	}
+	return &api.DeleteResponse{Deleted: int64(deleted)}, nil
+}
+
+const (
+	defaultListKeysPageSize = 1000
+	maxListKeysPageSize     = 10000
+)
+
+// ListKeys returns a page of keys with a summary of each series. The page token is the last key of the previous page.
+func (s *svc) ListKeys(ctx context.Context, req *api.ListKeysRequest) (*api.ListKeysResponse, error) {
+	matcher := storage.KeyMatcher{Type: storage.MatchPrefix, Pattern: req.Prefix}
+	if req.Glob != "" {
+		if req.Prefix != "" {
+			return nil, status.Error(codes.InvalidArgument, "only one of prefix and glob may be set")
+		}
+		if _, err := path.Match(req.Glob, ""); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		matcher = storage.KeyMatcher{Type: storage.MatchGlob, Pattern: req.Glob}
+	}
+	pageSize := int(req.PageSize)
+	if pageSize <= 0 {
+		pageSize = defaultListKeysPageSize
+	}
+	if pageSize > maxListKeysPageSize {
+		pageSize = maxListKeysPageSize
+	}
+	after, err := base64.RawURLEncoding.DecodeString(req.PageToken)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, "invalid page token")
+	}
+	labels, err := labelMatchers(req.Labels)
+	if err != nil {
+		return nil, err
+	}
+
+	keys, more, err := s.storage.ListKeys(ctx, matcher, labels, string(after), pageSize)
+	if err != nil {
+		return nil, storageError(err)
+	}
+	var resp api.ListKeysResponse
+	for _, key := range keys {
+		resp.Keys = append(resp.Keys, &api.KeyInfo{
+			Key:    key.Key,
+			Count:  int64(key.Count),
+			Oldest: key.Oldest,
+			Newest: key.Newest,
+			Labels: key.Labels,
+		})
+	}
+	if more {
+		resp.NextPageToken = base64.RawURLEncoding.EncodeToString([]byte(keys[len(keys)-1].Key))
+	}
+	return &resp, nil
+}
+
+// Snapshot writes the contents of storage to disk.
+func (s *svc) Snapshot(ctx context.Context, req *api.SnapshotRequest) (*api.SnapshotResponse, error) {
+	info, err := s.storage.Snapshot(ctx)
+	if err == storage.ErrSnapshotDisabled {
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+	if err != nil {
+		return nil, storageError(err)
+	}
+	resp := &api.SnapshotResponse{
+		Path:     info.Path,
+		Created:  info.Created.UnixNano(),
+		Series:   int64(info.Series),
+		Elements: int64(info.Elements),
+	}
+	for _, o := range info.Offsets {
+		resp.Offsets = append(resp.Offsets, &api.SourceOffset{
+			Topic:     o.Topic,
+			Partition: o.Partition,
+			Offset:    o.Offset,
+		})
+	}
+	return resp, nil
+}
+
+const defaultCardinalityLimit = 10
+
+// Cardinality reports the key prefixes with the most rejected writes and series.
+func (s *svc) Cardinality(ctx context.Context, req *api.CardinalityRequest) (*api.CardinalityResponse, error) {
+	limit := int(req.Limit)
+	if limit <= 0 {
+		limit = defaultCardinalityLimit
+	}
+	report, err := s.storage.Cardinality(ctx, limit)
+	if err != nil {
+		return nil, storageError(err)
+	}
+	resp := &api.CardinalityResponse{Series: int64(report.Series)}
+	for _, o := range report.Offenders {
+		resp.Offenders = append(resp.Offenders, &api.Offender{
+			Prefix:   o.Prefix,
+			Series:   int64(o.Series),
+			Rejected: o.Rejected,
+		})
+	}
+	return resp, nil
+}
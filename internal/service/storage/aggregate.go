@@ -0,0 +1,203 @@
+package storage
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/murphybytes/gots/api"
+)
+
+// ValueEncoding describes how a number is stored in Element.Data. Both encodings are eight bytes, big endian, which is
+// also the layout that Gorilla compression recognises.
+type ValueEncoding int
+
+const (
+	// EncodingFloat64 is an IEEE 754 double.
+	EncodingFloat64 ValueEncoding = iota
+	// EncodingInt64 is a two's complement integer.
+	EncodingInt64
+)
+
+// ParseValueEncoding converts the name of an encoding, "float64" or "int64", into a ValueEncoding.
+func ParseValueEncoding(name string) (ValueEncoding, error) {
+	switch name {
+	case "float64":
+		return EncodingFloat64, nil
+	case "int64":
+		return EncodingInt64, nil
+	}
+	return EncodingFloat64, fmt.Errorf("unknown value encoding '%s'", name)
+}
+
+// value decodes the number held in data. It returns false if data is not eight bytes long.
+func (e ValueEncoding) value(data []byte) (float64, bool) {
+	if len(data) != 8 {
+		return 0, false
+	}
+	bits := binary.BigEndian.Uint64(data)
+	if e == EncodingInt64 {
+		return float64(int64(bits)), true
+	}
+	return math.Float64frombits(bits), true
+}
+
+// Aggregation is a function applied to the values in a bucket.
+type Aggregation int
+
+const (
+	AggregateMin Aggregation = iota
+	AggregateMax
+	AggregateSum
+	AggregateCount
+	// AggregateAvg is the mean of the values.
+	AggregateAvg
+	// AggregateFirst is the value of the oldest element.
+	AggregateFirst
+	// AggregateLast is the value of the newest element.
+	AggregateLast
+)
+
+// Aggregator summarises series without returning every element.
+type Aggregator interface {
+	Aggregate(ctx context.Context, req AggregateRequest) (AggregateResult, error)
+}
+
+// AggregateRequest divides the elements of Key with timestamps in [First, Last) into buckets of Width and applies
+// each of Functions to the values in every bucket. Buckets start at multiples of Width since the unix epoch.
+type AggregateRequest struct {
+	Key       string
+	First     uint64
+	Last      uint64
+	Width     time.Duration
+	Functions []Aggregation
+	Encoding  ValueEncoding
+}
+
+// Bucket holds the result of each requested function, in order, for the elements with timestamps in
+// [Start, Start + Width).
+type Bucket struct {
+	Start  int64
+	Values []float64
+}
+
+// AggregateResult has a bucket for each interval holding at least one element, in time order. Skipped counts the
+// elements that were ignored because their data could not be decoded.
+type AggregateResult struct {
+	Buckets []Bucket
+	Skipped int
+}
+
+// Aggregate computes buckets on the worker that owns the key so that elements are not copied.
+func (s *storage) Aggregate(ctx context.Context, req AggregateRequest) (AggregateResult, error) {
+	if req.First > req.Last || req.Width <= 0 || len(req.Functions) == 0 {
+		return AggregateResult{}, &ErrorInvalidSearch{}
+	}
+	for _, fn := range req.Functions {
+		if fn < AggregateMin || fn > AggregateLast {
+			return AggregateResult{}, &ErrorInvalidSearch{}
+		}
+	}
+
+	type response struct {
+		result AggregateResult
+		found  bool
+	}
+	responseChan := make(chan response, 1)
+	partition := s.calculateWorkerPartition(req.Key)
+	err := s.do(ctx, partition, func(w *worker) {
+		ser, ok := w.data[req.Key]
+		if !ok {
+			responseChan <- response{}
+			return
+		}
+		responseChan <- response{result: aggregate(ser, req), found: true}
+	})
+	if err != nil {
+		return AggregateResult{}, err
+	}
+	r := <-responseChan
+	if !r.found {
+		return AggregateResult{}, &ErrorNotFound{Key: req.Key}
+	}
+	return r.result, nil
+}
+
+// bucketState accumulates the values of a bucket.
+type bucketState struct {
+	start         int64
+	count         int
+	min, max, sum float64
+	first, last   float64
+}
+
+func (b *bucketState) add(v float64) {
+	if b.count == 0 {
+		b.min, b.max, b.first = v, v, v
+	}
+	b.min = math.Min(b.min, v)
+	b.max = math.Max(b.max, v)
+	b.sum += v
+	b.last = v
+	b.count++
+}
+
+func (b *bucketState) bucket(functions []Aggregation) Bucket {
+	values := make([]float64, len(functions))
+	for i, fn := range functions {
+		switch fn {
+		case AggregateMin:
+			values[i] = b.min
+		case AggregateMax:
+			values[i] = b.max
+		case AggregateSum:
+			values[i] = b.sum
+		case AggregateCount:
+			values[i] = float64(b.count)
+		case AggregateAvg:
+			values[i] = b.sum / float64(b.count)
+		case AggregateFirst:
+			values[i] = b.first
+		case AggregateLast:
+			values[i] = b.last
+		}
+	}
+	return Bucket{Start: b.start, Values: values}
+}
+
+// bucketStart returns the start of the bucket of width holding ts.
+func bucketStart(ts, width int64) int64 {
+	start := ts - ts%width
+	if ts < 0 && start != ts {
+		start -= width
+	}
+	return start
+}
+
+func aggregate(ser *series, req AggregateRequest) AggregateResult {
+	var (
+		result AggregateResult
+		state  bucketState
+		width  = int64(req.Width)
+	)
+	ser.each(int64(req.First), int64(req.Last), func(elt api.Element) {
+		v, ok := req.Encoding.value(elt.Data)
+		if !ok {
+			result.Skipped++
+			return
+		}
+		if start := bucketStart(elt.Timestamp, width); state.count == 0 || start != state.start {
+			if state.count > 0 {
+				result.Buckets = append(result.Buckets, state.bucket(req.Functions))
+			}
+			state = bucketState{start: start}
+		}
+		state.add(v)
+	})
+	if state.count > 0 {
+		result.Buckets = append(result.Buckets, state.bucket(req.Functions))
+	}
+	return result
+}
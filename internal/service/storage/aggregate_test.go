@@ -0,0 +1,85 @@
+package storage
+
+import (
+	"context"
+	"encoding/binary"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/metrics/discard"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAggregate(t *testing.T) {
+	stg, err := New(Options{
+		MaxAge:            time.Hour,
+		WorkerCount:       2,
+		ChannelBufferSize: DefaultChannelBufferSize,
+		MessageCounter:    discard.NewCounter(),
+		ChunkSize:         4,
+		Compression:       CompressionGorilla,
+	})
+	require.Nil(t, err)
+	defer stg.Close()
+
+	base := time.Now().Truncate(time.Minute)
+	values := []float64{3, 1, 4, 1, 5, 9, 2, 6}
+	for i, v := range values {
+		// two elements every 20 seconds gives six per minute
+		stg.Write(context.Background(), "A", base.Add(time.Duration(i/2)*20*time.Second), float64Data(v))
+	}
+	stg.Write(context.Background(), "A", base.Add(10*time.Second), []byte("bad"))
+
+	functions := []Aggregation{AggregateMin, AggregateMax, AggregateSum, AggregateCount, AggregateAvg, AggregateFirst, AggregateLast}
+	result, err := stg.Aggregate(context.Background(), AggregateRequest{
+		Key:       "A",
+		First:     uint64(base.UnixNano()),
+		Last:      uint64(base.Add(time.Hour).UnixNano()),
+		Width:     time.Minute,
+		Functions: functions,
+	})
+	require.Nil(t, err)
+	assert.Equal(t, 1, result.Skipped)
+	assert.Equal(t, []Bucket{
+		{Start: base.UnixNano(), Values: []float64{1, 9, 23, 6, 23.0 / 6, 3, 9}},
+		{Start: base.Add(time.Minute).UnixNano(), Values: []float64{2, 6, 8, 2, 4, 2, 6}},
+	}, result.Buckets)
+
+	// the range limits the elements in a bucket
+	result, err = stg.Aggregate(context.Background(), AggregateRequest{
+		Key:       "A",
+		First:     uint64(base.Add(20 * time.Second).UnixNano()),
+		Last:      uint64(base.Add(40 * time.Second).UnixNano()),
+		Width:     time.Minute,
+		Functions: []Aggregation{AggregateCount},
+	})
+	require.Nil(t, err)
+	assert.Equal(t, []Bucket{{Start: base.UnixNano(), Values: []float64{2}}}, result.Buckets)
+
+	_, err = stg.Aggregate(context.Background(), AggregateRequest{Key: "B", Last: 1, Width: time.Minute, Functions: functions})
+	assert.IsType(t, &ErrorNotFound{}, err)
+	_, err = stg.Aggregate(context.Background(), AggregateRequest{Key: "A", Last: 1, Functions: functions})
+	assert.IsType(t, &ErrorInvalidSearch{}, err)
+	_, err = stg.Aggregate(context.Background(), AggregateRequest{Key: "A", Last: 1, Width: time.Minute})
+	assert.IsType(t, &ErrorInvalidSearch{}, err)
+}
+
+func TestValueEncoding(t *testing.T) {
+	data := make([]byte, 8)
+	binary.BigEndian.PutUint64(data, uint64(-42&math.MaxUint64))
+	v, ok := EncodingInt64.value(data)
+	assert.True(t, ok)
+	assert.Equal(t, float64(-42), v)
+
+	v, ok = EncodingFloat64.value(float64Data(1.5))
+	assert.True(t, ok)
+	assert.Equal(t, 1.5, v)
+
+	_, ok = EncodingFloat64.value([]byte{1})
+	assert.False(t, ok)
+
+	assert.Equal(t, int64(-60), bucketStart(-1, 60))
+	assert.Equal(t, int64(0), bucketStart(59, 60))
+}
@@ -0,0 +1,179 @@
+package storage
+
+import (
+	"context"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/murphybytes/gots/api"
+)
+
+// TickLayout describes where price and volume are found in Element.Data.
+type TickLayout int
+
+const (
+	// LayoutPrice is an eight byte price. Each element adds one to the volume of its bar.
+	LayoutPrice TickLayout = iota
+	// LayoutPriceVolume is an eight byte price followed by an eight byte volume.
+	LayoutPriceVolume
+)
+
+// TickDecoding reads the price and volume of a trade from Element.Data.
+type TickDecoding struct {
+	Layout TickLayout
+	Price  ValueEncoding
+	Volume ValueEncoding
+}
+
+// decode returns the price and volume held in data. It returns false if data does not match the layout.
+func (d TickDecoding) decode(data []byte) (price, volume float64, ok bool) {
+	switch d.Layout {
+	case LayoutPrice:
+		price, ok = d.Price.value(data)
+		return price, 1, ok
+	case LayoutPriceVolume:
+		if len(data) != 16 {
+			return 0, 0, false
+		}
+		price, _ = d.Price.value(data[:8])
+		volume, _ = d.Volume.value(data[8:])
+		return price, volume, true
+	}
+	return 0, 0, false
+}
+
+// CandleRequest asks for open, high, low, close and volume bars of Interval for the elements of Key with timestamps
+// in [First, Last). Bars start at multiples of Interval since the unix epoch.
+type CandleRequest struct {
+	Key      string
+	First    uint64
+	Last     uint64
+	Interval time.Duration
+	Decoding TickDecoding
+}
+
+// Candle is a bar summarising the trades with timestamps in [Start, Start + interval). Count is the number of
+// elements in the bar.
+type Candle struct {
+	Start  int64
+	Open   float64
+	High   float64
+	Low    float64
+	Close  float64
+	Volume float64
+	Count  int
+}
+
+// Candles returns a bar for each interval holding at least one element, in time order. Elements that do not match
+// the decoding are ignored.
+func (s *storage) Candles(ctx context.Context, req CandleRequest) ([]Candle, error) {
+	if req.First > req.Last || req.Interval <= 0 {
+		return nil, &ErrorInvalidSearch{}
+	}
+	responseChan := make(chan searchResult, 1)
+	partition := s.calculateWorkerPartition(req.Key)
+	err := s.do(ctx, partition, func(w *worker) {
+		ser, ok := w.data[req.Key]
+		if !ok {
+			responseChan <- searchResult{err: &ErrorNotFound{Key: req.Key}}
+			return
+		}
+		b := NewCandleBuilder(req.Interval, req.Decoding)
+		ser.each(int64(req.First), int64(req.Last), func(elt api.Element) {
+			b.Add(elt)
+		})
+		responseChan <- searchResult{candles: b.Close(math.MaxInt64)}
+	})
+	if err != nil {
+		return nil, err
+	}
+	result := <-responseChan
+	return result.candles, result.err
+}
+
+// CandleBuilder accumulates elements into bars. Bars stay open until Close is called with a time at or after their
+// end, after which elements belonging to them are rejected. It is not safe for concurrent use.
+type CandleBuilder struct {
+	interval int64
+	decoding TickDecoding
+	open     []candleState
+	// closed is the time before which every bar has been closed.
+	closed int64
+}
+
+// candleState is an open bar along with the timestamps of its first and last trades, which are needed to keep open
+// and close correct when elements arrive out of order.
+type candleState struct {
+	Candle
+	first int64
+	last  int64
+}
+
+// NewCandleBuilder creates a builder of bars of interval reading trades with decoding.
+func NewCandleBuilder(interval time.Duration, decoding TickDecoding) *CandleBuilder {
+	return &CandleBuilder{
+		interval: int64(interval),
+		decoding: decoding,
+		closed:   math.MinInt64,
+	}
+}
+
+// Add includes elt in its bar. It returns false if elt could not be decoded or its bar has already been closed.
+func (b *CandleBuilder) Add(elt api.Element) bool {
+	price, volume, ok := b.decoding.decode(elt.Data)
+	if !ok {
+		return false
+	}
+	start := bucketStart(elt.Timestamp, b.interval)
+	if start < b.closed {
+		return false
+	}
+	i := sort.Search(len(b.open), func(i int) bool {
+		return b.open[i].Start >= start
+	})
+	if i == len(b.open) || b.open[i].Start != start {
+		b.open = append(b.open, candleState{})
+		copy(b.open[i+1:], b.open[i:])
+		b.open[i] = candleState{
+			Candle: Candle{Start: start, Open: price, High: price, Low: price, Close: price},
+			first:  elt.Timestamp,
+			last:   elt.Timestamp,
+		}
+	}
+
+	c := &b.open[i]
+	c.High = math.Max(c.High, price)
+	c.Low = math.Min(c.Low, price)
+	c.Volume += volume
+	c.Count++
+	if elt.Timestamp < c.first {
+		c.first, c.Open = elt.Timestamp, price
+	}
+	if elt.Timestamp >= c.last {
+		c.last, c.Close = elt.Timestamp, price
+	}
+	return true
+}
+
+// Close returns the bars that end at or before now, in time order, and rejects later additions to them.
+func (b *CandleBuilder) Close(now int64) []Candle {
+	var result []Candle
+	n := 0
+	for ; n < len(b.open) && (now == math.MaxInt64 || b.open[n].Start+b.interval <= now); n++ {
+		result = append(result, b.open[n].Candle)
+	}
+	b.open = append(b.open[:0], b.open[n:]...)
+	if closed := bucketStart(now, b.interval); closed > b.closed {
+		b.closed = closed
+	}
+	return result
+}
+
+// Next returns the time at which the oldest open bar ends, or false if no bars are open.
+func (b *CandleBuilder) Next() (int64, bool) {
+	if len(b.open) == 0 {
+		return 0, false
+	}
+	return b.open[0].Start + b.interval, true
+}
@@ -0,0 +1,89 @@
+package storage
+
+import (
+	"context"
+	"encoding/binary"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/metrics/discard"
+	"github.com/murphybytes/gots/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func trade(price float64, volume int64) []byte {
+	data := make([]byte, 16)
+	binary.BigEndian.PutUint64(data, math.Float64bits(price))
+	binary.BigEndian.PutUint64(data[8:], uint64(volume))
+	return data
+}
+
+func TestCandles(t *testing.T) {
+	stg, err := New(Options{
+		MaxAge:            time.Hour,
+		WorkerCount:       2,
+		ChannelBufferSize: DefaultChannelBufferSize,
+		MessageCounter:    discard.NewCounter(),
+	})
+	require.Nil(t, err)
+	defer stg.Close()
+
+	base := time.Now().Truncate(time.Minute)
+	trades := []struct {
+		offset time.Duration
+		price  float64
+		volume int64
+	}{
+		{0, 10, 100},
+		{10 * time.Second, 12, 50},
+		{20 * time.Second, 9, 10},
+		{50 * time.Second, 11, 5},
+		{2 * time.Minute, 20, 1},
+	}
+	for _, tr := range trades {
+		stg.Write(context.Background(), "ACME", base.Add(tr.offset), trade(tr.price, tr.volume))
+	}
+	stg.Write(context.Background(), "ACME", base.Add(time.Second), []byte("bad"))
+
+	decoding := TickDecoding{Layout: LayoutPriceVolume, Price: EncodingFloat64, Volume: EncodingInt64}
+	candles, err := stg.Candles(context.Background(), CandleRequest{
+		Key:      "ACME",
+		First:    api.NoLowerBound,
+		Last:     api.NoUpperBound,
+		Interval: time.Minute,
+		Decoding: decoding,
+	})
+	require.Nil(t, err)
+	assert.Equal(t, []Candle{
+		{Start: base.UnixNano(), Open: 10, High: 12, Low: 9, Close: 11, Volume: 165, Count: 4},
+		{Start: base.Add(2 * time.Minute).UnixNano(), Open: 20, High: 20, Low: 20, Close: 20, Volume: 1, Count: 1},
+	}, candles)
+
+	_, err = stg.Candles(context.Background(), CandleRequest{Key: "NONE", Last: 1, Interval: time.Minute})
+	assert.IsType(t, &ErrorNotFound{}, err)
+	_, err = stg.Candles(context.Background(), CandleRequest{Key: "ACME", Last: 1})
+	assert.IsType(t, &ErrorInvalidSearch{}, err)
+}
+
+func TestCandleBuilder(t *testing.T) {
+	b := NewCandleBuilder(10, TickDecoding{Layout: LayoutPrice, Price: EncodingFloat64})
+	_, ok := b.Next()
+	assert.False(t, ok)
+
+	assert.True(t, b.Add(api.Element{Timestamp: 12, Data: float64Data(2)}))
+	// out of order elements keep open and close in time order
+	assert.True(t, b.Add(api.Element{Timestamp: 11, Data: float64Data(1)}))
+	assert.True(t, b.Add(api.Element{Timestamp: 25, Data: float64Data(5)}))
+	assert.False(t, b.Add(api.Element{Timestamp: 13, Data: []byte{1}}))
+	next, ok := b.Next()
+	assert.True(t, ok)
+	assert.Equal(t, int64(20), next)
+
+	assert.Nil(t, b.Close(19))
+	assert.Equal(t, []Candle{{Start: 10, Open: 1, High: 2, Low: 1, Close: 2, Volume: 2, Count: 2}}, b.Close(20))
+	// elements for closed bars are rejected
+	assert.False(t, b.Add(api.Element{Timestamp: 19, Data: float64Data(3)}))
+	assert.Equal(t, []Candle{{Start: 20, Open: 5, High: 5, Low: 5, Close: 5, Volume: 1, Count: 1}}, b.Close(30))
+}
@@ -0,0 +1,309 @@
+package storage
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// offenderSeparators end the key prefix that series are grouped by in a CardinalityReport.
+	offenderSeparators = ".|:/"
+	// maxOffenderPrefixes is the number of prefixes whose rejected writes are tracked.
+	maxOffenderPrefixes = 1024
+)
+
+// SeriesLimit caps the number of series held for the keys selected by Keys and the rate at which they are created.
+// Writes that would create a series beyond either limit are rejected.
+type SeriesLimit struct {
+	Keys KeyMatcher
+	// MaxSeries is the largest number of series the keys may hold. Zero means there is no limit.
+	MaxSeries int
+	// MaxNewPerSecond is the sustained rate at which the keys may create series, bursts of up to a second's worth are
+	// allowed. Zero means there is no limit.
+	MaxNewPerSecond float64
+}
+
+// Offender summarises the series of keys sharing a prefix.
+type Offender struct {
+	// Prefix is the start of the keys up to and including their first separator, one of . | : or /. Keys without
+	// a separator, such as bare UUIDs, are grouped under the empty prefix.
+	Prefix string
+	// Series is the number of series held.
+	Series int
+	// Rejected is the number of writes rejected by series limits. Once many prefixes have been rejected the counts
+	// are estimates that may be too high.
+	Rejected int64
+}
+
+// CardinalityReport describes the number of series in storage and the key prefixes that contribute most to it.
+type CardinalityReport struct {
+	Series int
+	// Offenders are ordered by the number of rejected writes and then by the number of series.
+	Offenders []Offender
+}
+
+// CardinalityReporter reports on the number of series held by storage.
+type CardinalityReporter interface {
+	// Cardinality returns the number of series and the n prefixes with the most rejected writes and series. If n is
+	// zero every prefix is returned.
+	Cardinality(ctx context.Context, n int) (CardinalityReport, error)
+}
+
+// seriesLimiter enforces the series limits. It is shared by every worker, but is only consulted when a write would
+// create a series. Workers check limits before creating series so a limit may be exceeded by at most one series for
+// each worker.
+type seriesLimiter struct {
+	sync.Mutex
+	enabled bool
+	global  limitState
+	limits  []SeriesLimit
+	states  []limitState
+	// rejected counts rejected writes by key prefix.
+	rejected map[string]int64
+}
+
+type limitState struct {
+	max    int
+	series int
+	bucket tokenBucket
+}
+
+// tokenBucket allows rate events each second with bursts of up to a second's worth. A zero rate has no limit.
+type tokenBucket struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	burst := b.rate
+	if burst < 1 {
+		burst = 1
+	}
+	if b.last.IsZero() {
+		b.tokens = burst
+	} else if b.tokens += now.Sub(b.last).Seconds() * b.rate; b.tokens > burst {
+		b.tokens = burst
+	}
+	b.last = now
+}
+
+// available refills the bucket and returns true if an event is allowed.
+func (b *tokenBucket) available(now time.Time) bool {
+	if b.rate <= 0 {
+		return true
+	}
+	b.refill(now)
+	return b.tokens >= 1
+}
+
+func (b *tokenBucket) take() {
+	if b.rate > 0 {
+		b.tokens--
+	}
+}
+
+// seriesVerdict is the outcome of asking the limiter for a new series.
+type seriesVerdict int
+
+const (
+	seriesAllowed seriesVerdict = iota
+	seriesLimited
+	seriesRateLimited
+)
+
+func newSeriesLimiter(maxSeries int, maxNewPerSecond float64, limits []SeriesLimit) *seriesLimiter {
+	l := &seriesLimiter{
+		enabled:  maxSeries > 0 || maxNewPerSecond > 0,
+		global:   limitState{max: maxSeries, bucket: tokenBucket{rate: maxNewPerSecond}},
+		limits:   limits,
+		states:   make([]limitState, len(limits)),
+		rejected: make(map[string]int64),
+	}
+	for i, limit := range limits {
+		l.states[i] = limitState{max: limit.MaxSeries, bucket: tokenBucket{rate: limit.MaxNewPerSecond}}
+		if limit.MaxSeries > 0 || limit.MaxNewPerSecond > 0 {
+			l.enabled = true
+		}
+	}
+	return l
+}
+
+// limitFor returns the state of the first limit matching key, or nil if there is none.
+func (l *seriesLimiter) limitFor(key string) *limitState {
+	for i, limit := range l.limits {
+		if limit.Keys.Match(key) {
+			return &l.states[i]
+		}
+	}
+	return nil
+}
+
+// allow decides whether a series may be created for key.
+func (l *seriesLimiter) allow(key string, now time.Time) seriesVerdict {
+	if l == nil || !l.enabled {
+		return seriesAllowed
+	}
+	l.Lock()
+	defer l.Unlock()
+	states := []*limitState{&l.global}
+	if state := l.limitFor(key); state != nil {
+		states = append(states, state)
+	}
+	verdict := seriesAllowed
+	for _, state := range states {
+		if state.max > 0 && state.series >= state.max {
+			verdict = seriesLimited
+			break
+		}
+		if !state.bucket.available(now) {
+			verdict = seriesRateLimited
+		}
+	}
+	if verdict != seriesAllowed {
+		l.reject(keyPrefix(key))
+		return verdict
+	}
+	for _, state := range states {
+		state.bucket.take()
+	}
+	return seriesAllowed
+}
+
+// reject counts a rejected write for prefix. Once maxOffenderPrefixes prefixes are tracked the prefix with the fewest
+// rejections is replaced and its count inherited, so frequently rejected prefixes are never missed although their
+// counts may be too high.
+func (l *seriesLimiter) reject(prefix string) {
+	if _, ok := l.rejected[prefix]; !ok && len(l.rejected) >= maxOffenderPrefixes {
+		var fewest string
+		var count int64 = -1
+		for p, n := range l.rejected {
+			if count < 0 || n < count {
+				fewest, count = p, n
+			}
+		}
+		delete(l.rejected, fewest)
+		l.rejected[prefix] = count
+	}
+	l.rejected[prefix]++
+}
+
+// add records that a series was created for key.
+func (l *seriesLimiter) add(key string) {
+	l.update(key, 1)
+}
+
+// release records that the series for key was removed.
+func (l *seriesLimiter) release(key string) {
+	l.update(key, -1)
+}
+
+func (l *seriesLimiter) update(key string, delta int) {
+	if l == nil || !l.enabled {
+		return
+	}
+	l.Lock()
+	defer l.Unlock()
+	l.global.series += delta
+	if state := l.limitFor(key); state != nil {
+		state.series += delta
+	}
+}
+
+// rejections returns a copy of the rejected write counts.
+func (l *seriesLimiter) rejections() map[string]int64 {
+	l.Lock()
+	defer l.Unlock()
+	result := make(map[string]int64, len(l.rejected))
+	for prefix, n := range l.rejected {
+		result[prefix] = n
+	}
+	return result
+}
+
+// keyPrefix returns the key up to and including its first separator, or an empty string if it has none.
+func keyPrefix(key string) string {
+	if i := strings.IndexAny(key, offenderSeparators); i >= 0 {
+		return key[:i+1]
+	}
+	return ""
+}
+
+// admitSeries decides whether a write may create a series for key, counting writes that are rejected.
+func (s *storage) admitSeries(key string) bool {
+	switch s.limiter.allow(key, time.Now()) {
+	case seriesLimited:
+		s.seriesLimitCounter.Add(1)
+		return false
+	case seriesRateLimited:
+		s.seriesRateCounter.Add(1)
+		return false
+	}
+	return true
+}
+
+// Cardinality asks every worker to count its series by prefix at the same time and merges the counts with the
+// rejected writes.
+func (s *storage) Cardinality(ctx context.Context, n int) (CardinalityReport, error) {
+	var report CardinalityReport
+	responses := make(chan map[string]int, len(s.work))
+	for i := range s.work {
+		err := s.submit(ctx, i, func(w *worker) {
+			counts := make(map[string]int)
+			for key := range w.data {
+				counts[keyPrefix(key)]++
+			}
+			responses <- counts
+		})
+		if err != nil {
+			return report, err
+		}
+	}
+
+	offenders := make(map[string]*Offender)
+	offender := func(prefix string) *Offender {
+		o, ok := offenders[prefix]
+		if !ok {
+			o = &Offender{Prefix: prefix}
+			offenders[prefix] = o
+		}
+		return o
+	}
+	for range s.work {
+		select {
+		case counts := <-responses:
+			for prefix, count := range counts {
+				offender(prefix).Series += count
+				report.Series += count
+			}
+		case <-s.close:
+			return report, ErrClosed
+		case <-ctx.Done():
+			return report, ctx.Err()
+		}
+	}
+	for prefix, rejected := range s.limiter.rejections() {
+		offender(prefix).Rejected = rejected
+	}
+
+	for _, o := range offenders {
+		report.Offenders = append(report.Offenders, *o)
+	}
+	sort.Slice(report.Offenders, func(i, j int) bool {
+		a, b := report.Offenders[i], report.Offenders[j]
+		if a.Rejected != b.Rejected {
+			return a.Rejected > b.Rejected
+		}
+		if a.Series != b.Series {
+			return a.Series > b.Series
+		}
+		return a.Prefix < b.Prefix
+	})
+	if n > 0 && len(report.Offenders) > n {
+		report.Offenders = report.Offenders[:n]
+	}
+	return report, nil
+}
@@ -0,0 +1,114 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMaxSeries(t *testing.T) {
+	rejects := newRejectCounter()
+	opts := testOptions(1)
+	opts.RejectCounter = rejects
+	opts.MaxSeries = 3
+	opts.SeriesLimits = []SeriesLimit{{Keys: KeyMatcher{Type: MatchPrefix, Pattern: "uuid."}, MaxSeries: 1}}
+	stg, err := New(opts)
+	require.Nil(t, err)
+	defer stg.Close()
+
+	now := time.Now()
+	for _, key := range []string{"uuid.1", "uuid.2", "a", "b", "c"} {
+		require.Nil(t, stg.Write(context.Background(), key, now, nil))
+	}
+	// existing series still accept writes
+	require.Nil(t, stg.Write(context.Background(), "a", now.Add(1), nil))
+	assert.Equal(t, []string{"a", "b", "uuid.1"}, stg.keys())
+	assert.Equal(t, int64(2), *rejects.counts["series_limit"])
+	assert.Equal(t, ErrRejected, writeAdmitted(t, stg, "d", now))
+
+	// deleting a series makes room for another
+	_, err = stg.DeleteSeries(context.Background(), "b")
+	require.Nil(t, err)
+	require.Nil(t, stg.Write(context.Background(), "c", now, nil))
+	assert.Equal(t, []string{"a", "c", "uuid.1"}, stg.keys())
+}
+
+func TestMaxNewSeriesPerSecond(t *testing.T) {
+	rejects := newRejectCounter()
+	opts := testOptions(1)
+	opts.RejectCounter = rejects
+	opts.MaxNewSeriesPerSecond = 2
+	stg, err := New(opts)
+	require.Nil(t, err)
+	defer stg.Close()
+
+	now := time.Now()
+	for i := 0; i < 5; i++ {
+		require.Nil(t, stg.Write(context.Background(), fmt.Sprintf("key.%d", i), now, nil))
+	}
+	require.Nil(t, stg.Write(context.Background(), "key.0", now.Add(1), nil))
+	assert.Equal(t, []string{"key.0", "key.1"}, stg.keys())
+	assert.Equal(t, int64(3), *rejects.counts["series_rate"])
+	assert.Equal(t, ErrRejected, writeAdmitted(t, stg, "key.5", now))
+	assert.Nil(t, writeAdmitted(t, stg, "key.1", now.Add(1)))
+}
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Now()
+	b := tokenBucket{rate: 0.5}
+	assert.True(t, b.available(now))
+	b.take()
+	assert.False(t, b.available(now.Add(time.Second)))
+	assert.True(t, b.available(now.Add(2*time.Second)))
+	b.take()
+	// tokens do not build up beyond a second's worth, or one
+	assert.True(t, b.available(now.Add(time.Hour)))
+	b.take()
+	assert.False(t, b.available(now.Add(time.Hour)))
+
+	unlimited := tokenBucket{}
+	assert.True(t, unlimited.available(now))
+}
+
+func TestCardinality(t *testing.T) {
+	rejects := newRejectCounter()
+	opts := testOptions(4)
+	opts.RejectCounter = rejects
+	opts.SeriesLimits = []SeriesLimit{{Keys: KeyMatcher{Type: MatchGlob, Pattern: "*-*"}, MaxSeries: 1}}
+	stg, err := New(opts)
+	require.Nil(t, err)
+	defer stg.Close()
+
+	now := time.Now()
+	for _, key := range []string{"trade.a", "trade.b", "trade.c", "book.a", "b2c1-4a5e", "9f3e-11aa", "77d0-ab13"} {
+		require.Nil(t, stg.Write(context.Background(), key, now, nil))
+	}
+
+	report, err := stg.Cardinality(context.Background(), 2)
+	require.Nil(t, err)
+	assert.Equal(t, 5, report.Series)
+	assert.Equal(t, []Offender{
+		{Prefix: "", Series: 1, Rejected: 2},
+		{Prefix: "trade.", Series: 3},
+	}, report.Offenders)
+
+	report, err = stg.Cardinality(context.Background(), 0)
+	require.Nil(t, err)
+	assert.Len(t, report.Offenders, 3)
+}
+
+func TestOffenderPrefixesBounded(t *testing.T) {
+	l := newSeriesLimiter(1, 0, nil)
+	for i := 0; i < maxOffenderPrefixes+10; i++ {
+		l.reject(fmt.Sprintf("%d.", i))
+	}
+	l.reject("hot.")
+	l.reject("hot.")
+	rejected := l.rejections()
+	assert.Len(t, rejected, maxOffenderPrefixes)
+	assert.True(t, rejected["hot."] >= 2)
+}
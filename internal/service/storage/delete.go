@@ -0,0 +1,86 @@
+package storage
+
+import (
+	"context"
+	"math"
+
+	"github.com/murphybytes/gots/api"
+)
+
+// Deleter removes elements from storage, for example to purge bad data. Deletes are recorded in the write ahead log
+// so that removed elements are not recovered after a restart.
+type Deleter interface {
+	// DeleteSeries removes every element of key and returns the number of elements removed.
+	DeleteSeries(ctx context.Context, key string) (int, error)
+	// DeleteRange removes the elements of key with timestamps in the range [first, last) and returns the number of
+	// elements removed. Times are unix time in nanoseconds.
+	DeleteRange(ctx context.Context, key string, first, last uint64) (int, error)
+}
+
+// DeleteSeries removes every element of key.
+func (s *storage) DeleteSeries(ctx context.Context, key string) (int, error) {
+	return s.delete(ctx, key, math.MinInt64, math.MaxInt64)
+}
+
+// DeleteRange removes the elements of key with timestamps in the range [first, last).
+func (s *storage) DeleteRange(ctx context.Context, key string, first, last uint64) (int, error) {
+	if first > last {
+		return 0, &ErrorInvalidSearch{}
+	}
+	return s.delete(ctx, key, int64(first), int64(last))
+}
+
+// delete waits for the worker to remove the elements. Once the worker has started the delete it runs to completion
+// even if ctx is done.
+func (s *storage) delete(ctx context.Context, key string, first, last int64) (int, error) {
+	responseChan := make(chan int, 1)
+	partition := s.calculateWorkerPartition(key)
+	err := s.do(ctx, partition, func(w *worker) {
+		ser, ok := w.data[key]
+		if !ok {
+			responseChan <- -1
+			return
+		}
+		// only the part of the range holding elements is logged so that the record expires with them
+		if oldest := ser.oldest(); oldest > first {
+			first = oldest
+		}
+		if newest := ser.newest(); newest < last-1 {
+			last = newest + 1
+		}
+		if w.log != nil && first < last {
+			s.logWALError(w.log.appendDelete(key, first, last))
+		}
+		var fn func(api.Element)
+		if s.opts.NotifyDeletes && s.opts.OnExpire != nil {
+			fn = func(elt api.Element) {
+				s.opts.OnExpire(key, elt, Deleted)
+			}
+		}
+		responseChan <- s.remove(w, key, first, last, fn)
+	})
+	if err != nil {
+		return 0, err
+	}
+	n := <-responseChan
+	if n < 0 {
+		return 0, &ErrorNotFound{Key: key}
+	}
+	return n, nil
+}
+
+// remove deletes the elements of key with timestamps in [first, last) from the worker, dropping the series if it is
+// left empty.
+func (s *storage) remove(w *worker, key string, first, last int64, fn func(api.Element)) int {
+	ser, ok := w.data[key]
+	if !ok {
+		return 0
+	}
+	before := ser.bytes
+	n := ser.removeRange(first, last, fn)
+	w.bytes -= before - ser.bytes
+	if ser.len() == 0 {
+		w.drop(key)
+	}
+	return n
+}
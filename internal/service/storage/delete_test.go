@@ -0,0 +1,127 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	mr "math/rand"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/murphybytes/gots/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSeriesRemoveRange(t *testing.T) {
+	var elts []api.Element
+	for i := 0; i < 1000; i++ {
+		elts = append(elts, api.Element{Timestamp: int64(100 + mr.Intn(500)), Data: benchmarkData})
+	}
+	bounds := [][2]int64{
+		{0, 50},
+		{0, 101},
+		{100, 600},
+		{250, 251},
+		{250, 250},
+		{300, 200},
+		{150, 450},
+		{599, 700},
+	}
+	for _, compression := range []Compression{CompressionNone, CompressionGorilla} {
+		for _, chunkSize := range []int{1, 3, 64, DefaultChunkSize} {
+			for _, b := range bounds {
+				t.Run(fmt.Sprintf("%d_%d_%d_%d", compression, chunkSize, b[0], b[1]), func(t *testing.T) {
+					s := newSeries(chunkSize, compression)
+					for _, elt := range elts {
+						insert(s, elt)
+					}
+					expected := []api.Element{}
+					var removed []api.Element
+					for _, elt := range s.elements() {
+						if elt.Timestamp < b[0] || elt.Timestamp >= b[1] {
+							expected = append(expected, elt)
+						}
+					}
+					n := s.removeRange(b[0], b[1], func(elt api.Element) {
+						removed = append(removed, elt)
+					})
+					assert.Equal(t, len(elts)-len(expected), n)
+					assert.Len(t, removed, n)
+					assert.Equal(t, len(expected), s.len())
+					assert.Equal(t, expected, s.elements())
+					assert.Equal(t, int64(len(expected))*elementSize(api.Element{Data: benchmarkData}), s.bytes)
+					for _, c := range s.chunks {
+						assert.True(t, c.len() > 0)
+					}
+				})
+			}
+		}
+	}
+}
+
+func TestDelete(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gots-wal")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	var deleted []api.Element
+	opts := testOptions(4, withWAL(dir))
+	opts.NotifyDeletes = true
+	opts.OnExpire = func(key string, elt api.Element, reason ExpiryReason) {
+		assert.Equal(t, Deleted, reason)
+		deleted = append(deleted, elt)
+	}
+	stg, err := New(opts)
+	require.Nil(t, err)
+
+	base := time.Now()
+	for i := 0; i < 10; i++ {
+		stg.Write(context.Background(), "A", base.Add(time.Duration(i)), nil)
+		stg.Write(context.Background(), "B", base.Add(time.Duration(i)), nil)
+	}
+	n, err := stg.DeleteRange(context.Background(), "A", uint64(base.Add(2).UnixNano()), uint64(base.Add(5).UnixNano()))
+	require.Nil(t, err)
+	assert.Equal(t, 3, n)
+	assert.Len(t, deleted, 3)
+	n, err = stg.DeleteSeries(context.Background(), "B")
+	require.Nil(t, err)
+	assert.Equal(t, 10, n)
+	_, err = stg.DeleteSeries(context.Background(), "B")
+	assert.IsType(t, &ErrorNotFound{}, err)
+	_, err = stg.DeleteRange(context.Background(), "A", 2, 1)
+	assert.IsType(t, &ErrorInvalidSearch{}, err)
+	// a deleted range can be written again
+	stg.Write(context.Background(), "A", base.Add(3), []byte("again"))
+	require.Nil(t, stg.Close())
+
+	// deletes are replayed from the write ahead log, including by a different number of workers
+	for _, workers := range []int{4, 3} {
+		stg, err = New(testOptions(workers, withWAL(dir)))
+		require.Nil(t, err)
+		elts, err := stg.Search(context.Background(), "A", api.NoLowerBound, api.NoUpperBound)
+		require.Nil(t, err)
+		var timestamps []int64
+		for _, elt := range elts {
+			timestamps = append(timestamps, elt.Timestamp-base.UnixNano())
+		}
+		assert.Equal(t, []int64{0, 1, 3, 5, 6, 7, 8, 9}, timestamps)
+		_, err = stg.Search(context.Background(), "B", api.NoLowerBound, api.NoUpperBound)
+		assert.IsType(t, &ErrorNotFound{}, err)
+		// writes after a change in worker count are not undone by earlier deletes
+		stg.Write(context.Background(), "B", base, nil)
+		_, err = stg.Search(context.Background(), "B", api.NoLowerBound, api.NoUpperBound)
+		require.Nil(t, err)
+		require.Nil(t, stg.Close())
+		stg, err = New(testOptions(workers, withWAL(dir)))
+		require.Nil(t, err)
+		elts, err = stg.Search(context.Background(), "B", api.NoLowerBound, api.NoUpperBound)
+		require.Nil(t, err)
+		assert.Len(t, elts, 1)
+		n, err := stg.DeleteSeries(context.Background(), "B")
+		require.Nil(t, err)
+		assert.Equal(t, 1, n)
+		require.Nil(t, stg.Close())
+	}
+}
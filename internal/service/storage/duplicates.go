@@ -0,0 +1,64 @@
+package storage
+
+import (
+	"fmt"
+
+	"github.com/murphybytes/gots/api"
+)
+
+// Duplicates decides what happens when an element is written with the same timestamp as an element already in its
+// series, for example when Kafka redelivers a message.
+type Duplicates int
+
+const (
+	// KeepDuplicates stores every element. Elements sharing a timestamp are kept in the order they arrived.
+	KeepDuplicates Duplicates = iota
+	// LastWriteWins replaces the stored element with the new one.
+	LastWriteWins
+	// FirstWriteWins keeps the stored element and silently discards the new one.
+	FirstWriteWins
+	// RejectDuplicates discards the new element and counts it as rejected.
+	RejectDuplicates
+)
+
+// ParseDuplicates converts the name of a policy, "keep", "last", "first" or "reject", into Duplicates.
+func ParseDuplicates(name string) (Duplicates, error) {
+	switch name {
+	case "keep":
+		return KeepDuplicates, nil
+	case "last":
+		return LastWriteWins, nil
+	case "first":
+		return FirstWriteWins, nil
+	case "reject":
+		return RejectDuplicates, nil
+	}
+	return KeepDuplicates, fmt.Errorf("unknown duplicate policy '%s'", name)
+}
+
+// admit reports whether elt may be written to the series for key. Elements older than the lateness window,
+// duplicates rejected by the series' policy and elements that would create a series beyond the series limits are
+// counted.
+func (s *storage) admit(w *worker, key string, elt api.Element) bool {
+	ser, ok := w.data[key]
+	if !ok {
+		return s.admitSeries(key)
+	}
+	if ser.len() == 0 {
+		return true
+	}
+	if s.opts.MaxLateness > 0 && elt.Timestamp < ser.newest()-int64(s.opts.MaxLateness) {
+		s.lateCounter.Add(1)
+		return false
+	}
+	if ser.duplicates != FirstWriteWins && ser.duplicates != RejectDuplicates {
+		return true
+	}
+	if _, found := ser.find(elt.Timestamp); found {
+		if ser.duplicates == RejectDuplicates {
+			s.duplicateCounter.Add(1)
+		}
+		return false
+	}
+	return true
+}
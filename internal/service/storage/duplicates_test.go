@@ -0,0 +1,219 @@
+package storage
+
+import (
+	"context"
+	"encoding/binary"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/metrics"
+	"github.com/go-kit/kit/metrics/discard"
+	"github.com/murphybytes/gots/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// labelCounter counts separately for each value of its last label.
+type labelCounter struct {
+	label  string
+	counts map[string]*int64
+}
+
+func (c labelCounter) With(labelValues ...string) metrics.Counter {
+	return labelCounter{label: labelValues[len(labelValues)-1], counts: c.counts}
+}
+
+func (c labelCounter) Add(delta float64) { atomic.AddInt64(c.counts[c.label], int64(delta)) }
+
+func newRejectCounter() labelCounter {
+	return labelCounter{counts: map[string]*int64{
+		"late":         new(int64),
+		"duplicate":    new(int64),
+		"series_limit": new(int64),
+		"series_rate":  new(int64),
+	}}
+}
+
+// writeAdmitted writes an element to key and waits for storage to admit or reject it.
+func writeAdmitted(t *testing.T, s *storage, key string, ts time.Time) error {
+	a, err := s.WriteAdmitted(context.Background(), key, nil, ts, nil)
+	require.Nil(t, err)
+	return a.Wait(context.Background())
+}
+
+func TestDuplicates(t *testing.T) {
+	writes := []api.Element{
+		{Timestamp: 10, Data: []byte("a")},
+		{Timestamp: 20, Data: []byte("b")},
+		{Timestamp: 10, Data: []byte("c")},
+		{Timestamp: 20, Data: []byte("d")},
+		{Timestamp: 15, Data: []byte("e")},
+	}
+	tt := []struct {
+		desc       string
+		duplicates Duplicates
+		expected   []string
+		rejected   int64
+	}{
+		{"keep", KeepDuplicates, []string{"a", "c", "e", "b", "d"}, 0},
+		{"last", LastWriteWins, []string{"c", "e", "d"}, 0},
+		{"first", FirstWriteWins, []string{"a", "e", "b"}, 0},
+		{"reject", RejectDuplicates, []string{"a", "e", "b"}, 2},
+	}
+	for _, tc := range tt {
+		t.Run(tc.desc, func(t *testing.T) {
+			rejects := newRejectCounter()
+			stg, err := New(Options{
+				MaxAge:            time.Duration(1<<63 - 1),
+				WorkerCount:       1,
+				ChannelBufferSize: DefaultChannelBufferSize,
+				MessageCounter:    discard.NewCounter(),
+				Duplicates:        tc.duplicates,
+				RejectCounter:     rejects,
+			})
+			require.Nil(t, err)
+			defer stg.Close()
+
+			for _, elt := range writes {
+				require.Nil(t, stg.Write(context.Background(), "A", time.Unix(0, elt.Timestamp), elt.Data))
+			}
+			elts, err := stg.Search(context.Background(), "A", api.NoLowerBound, api.NoUpperBound)
+			require.Nil(t, err)
+			var actual []string
+			for _, elt := range elts {
+				actual = append(actual, string(elt.Data))
+			}
+			assert.Equal(t, tc.expected, actual)
+			assert.Equal(t, tc.rejected, atomic.LoadInt64(rejects.counts["duplicate"]))
+
+			err = writeAdmitted(t, stg, "A", time.Unix(0, 10))
+			if tc.duplicates == FirstWriteWins || tc.duplicates == RejectDuplicates {
+				assert.Equal(t, ErrRejected, err)
+			} else {
+				assert.Nil(t, err)
+			}
+		})
+	}
+}
+
+func TestWriteAdmittedQueued(t *testing.T) {
+	stg, err := New(Options{
+		MaxAge:            time.Hour,
+		WorkerCount:       1,
+		ChannelBufferSize: DefaultChannelBufferSize,
+		MessageCounter:    discard.NewCounter(),
+		Duplicates:        RejectDuplicates,
+	})
+	require.Nil(t, err)
+	defer stg.Close()
+
+	// elements are queued while the worker is busy and admitted together once it is free
+	resume := stall(stg)
+	now := time.Now()
+	var pending []Admission
+	for _, ts := range []time.Time{now, now.Add(1), now, now.Add(2)} {
+		a, err := stg.WriteAdmitted(context.Background(), "A", nil, ts, nil)
+		require.Nil(t, err)
+		pending = append(pending, a)
+	}
+	resume()
+	var errs []error
+	for _, a := range pending {
+		errs = append(errs, a.Wait(context.Background()))
+	}
+	assert.Equal(t, []error{nil, nil, ErrRejected, nil}, errs)
+}
+
+func TestDuplicatePolicies(t *testing.T) {
+	stg, err := New(Options{
+		MaxAge:            time.Hour,
+		WorkerCount:       2,
+		ChannelBufferSize: DefaultChannelBufferSize,
+		MessageCounter:    discard.NewCounter(),
+		DuplicatePolicies: []DuplicatePolicy{
+			{Keys: KeyMatcher{Type: MatchPrefix, Pattern: "tick."}, Duplicates: LastWriteWins},
+		},
+	})
+	require.Nil(t, err)
+	defer stg.Close()
+
+	now := time.Now()
+	for _, key := range []string{"tick.a", "book.a"} {
+		stg.Write(context.Background(), key, now, []byte("first"))
+		stg.Write(context.Background(), key, now, []byte("second"))
+	}
+	elts, err := stg.Search(context.Background(), "tick.a", api.NoLowerBound, api.NoUpperBound)
+	require.Nil(t, err)
+	assert.Equal(t, []api.Element{{Timestamp: now.UnixNano(), Data: []byte("second")}}, elts)
+	elts, err = stg.Search(context.Background(), "book.a", api.NoLowerBound, api.NoUpperBound)
+	require.Nil(t, err)
+	assert.Len(t, elts, 2)
+}
+
+func TestLastWriteWinsCompressed(t *testing.T) {
+	s := newSeries(4, CompressionGorilla)
+	s.duplicates = LastWriteWins
+	value := func(v uint64) []byte {
+		b := make([]byte, 8)
+		binary.BigEndian.PutUint64(b, v)
+		return b
+	}
+	for i := 0; i < 12; i++ {
+		insert(s, api.Element{Timestamp: int64(i), Data: value(uint64(i))})
+	}
+	require.NotNil(t, s.chunks[0].sealed)
+
+	pos, found := s.find(2)
+	require.True(t, found)
+	s.replace(pos, api.Element{Timestamp: 2, Data: value(100)})
+	assert.NotNil(t, s.chunks[0].sealed)
+	assert.Equal(t, value(100), search(s, 2, 3)[0].Data)
+	assert.Equal(t, 12, s.len())
+
+	_, found = s.find(12)
+	assert.False(t, found)
+}
+
+func TestMaxLateness(t *testing.T) {
+	rejects := newRejectCounter()
+	stg, err := New(Options{
+		MaxAge:            time.Hour,
+		WorkerCount:       1,
+		ChannelBufferSize: DefaultChannelBufferSize,
+		MessageCounter:    discard.NewCounter(),
+		MaxLateness:       time.Second,
+		RejectCounter:     rejects,
+	})
+	require.Nil(t, err)
+	defer stg.Close()
+
+	now := time.Now()
+	for _, ts := range []time.Time{now, now.Add(-time.Second), now.Add(-2 * time.Second), now.Add(time.Minute)} {
+		stg.Write(context.Background(), "A", ts, nil)
+	}
+	elts, err := stg.Search(context.Background(), "A", api.NoLowerBound, api.NoUpperBound)
+	require.Nil(t, err)
+	assert.Len(t, elts, 3)
+	assert.Equal(t, int64(1), atomic.LoadInt64(rejects.counts["late"]))
+
+	// writers that wait for admission learn that the element was rejected
+	assert.Equal(t, ErrRejected, writeAdmitted(t, stg, "A", now.Add(-time.Hour)))
+	assert.Nil(t, writeAdmitted(t, stg, "A", now.Add(2*time.Minute)))
+	assert.Equal(t, int64(2), atomic.LoadInt64(rejects.counts["late"]))
+}
+
+func TestParseDuplicates(t *testing.T) {
+	for name, expected := range map[string]Duplicates{
+		"keep":   KeepDuplicates,
+		"last":   LastWriteWins,
+		"first":  FirstWriteWins,
+		"reject": RejectDuplicates,
+	} {
+		actual, err := ParseDuplicates(name)
+		require.Nil(t, err)
+		assert.Equal(t, expected, actual)
+	}
+	_, err := ParseDuplicates("all")
+	assert.NotNil(t, err)
+}
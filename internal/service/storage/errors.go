@@ -1,5 +1,16 @@
 package storage
 
+import (
+	"github.com/pkg/errors"
+)
+
+// ErrClosed is returned by operations on storage that has been closed.
+var ErrClosed = errors.New("storage is closed")
+
+// ErrRejected is returned by Admission.Wait when an element is late, a duplicate rejected by the policy of its series or
+// would create a series beyond the series limits.
+var ErrRejected = errors.New("element was rejected")
+
 type KeyNotFound interface {
 	NotFound()
 }
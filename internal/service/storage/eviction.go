@@ -0,0 +1,114 @@
+package storage
+
+import (
+	"fmt"
+
+	"github.com/murphybytes/gots/api"
+)
+
+// EvictionPolicy decides which elements are removed when a worker exceeds its share of Options.MaxBytes.
+type EvictionPolicy int
+
+const (
+	// EvictOldest removes the oldest elements regardless of the key they belong to.
+	EvictOldest EvictionPolicy = iota
+	// EvictLargest removes the oldest elements of the series using the most memory.
+	EvictLargest
+)
+
+// ParseEvictionPolicy converts the name of a policy, "oldest" or "largest", into an EvictionPolicy.
+func ParseEvictionPolicy(name string) (EvictionPolicy, error) {
+	switch name {
+	case "oldest":
+		return EvictOldest, nil
+	case "largest":
+		return EvictLargest, nil
+	}
+	return EvictOldest, fmt.Errorf("unknown eviction policy '%s'", name)
+}
+
+// budget returns the number of bytes each worker may use, zero means there is no limit. Keys are spread evenly
+// over workers so each one is given an equal share of MaxBytes, which is at least a byte so that a budget smaller
+// than the number of workers still limits memory.
+func (s *storage) budget() int64 {
+	if s.opts.MaxBytes <= 0 {
+		return 0
+	}
+	if budget := s.opts.MaxBytes / int64(s.opts.WorkerCount); budget > 0 {
+		return budget
+	}
+	return 1
+}
+
+// limit enforces MaxElementsPerKey on a series that has just been written to and then evicts elements until the
+// worker is back within its memory budget.
+func (s *storage) limit(w *worker, key string, ser *series) {
+	if s.opts.MaxElementsPerKey > 0 && ser.len() > s.opts.MaxElementsPerKey {
+		s.evict(w, key, ser, ser.len()-s.opts.MaxElementsPerKey)
+	}
+	budget := s.budget()
+	for budget > 0 && w.bytes > budget && len(w.data) > 0 {
+		key, ser, n := s.victim(w, w.bytes-budget)
+		s.evict(w, key, ser, n)
+	}
+}
+
+// victim picks the series to evict from and the number of elements to remove from it in order to free excess bytes.
+// Eviction stops early where the choice of victim could change so that the policy is followed across keys.
+func (s *storage) victim(w *worker, excess int64) (string, *series, int) {
+	var (
+		victimKey string
+		victim    *series
+		runnerUp  *series
+	)
+	// ties are broken by age so that the choice does not depend on map iteration order
+	worse := func(a, b *series) bool {
+		if s.opts.EvictionPolicy == EvictLargest && a.bytes != b.bytes {
+			return a.bytes > b.bytes
+		}
+		return a.oldest() < b.oldest()
+	}
+	for key, ser := range w.data {
+		switch {
+		case victim == nil || worse(ser, victim):
+			victimKey, victim, runnerUp = key, ser, victim
+		case runnerUp == nil || worse(ser, runnerUp):
+			runnerUp = ser
+		}
+	}
+
+	average := victim.bytes / int64(victim.len())
+	n := int((excess + average - 1) / average)
+	if runnerUp != nil {
+		var stop int
+		if s.opts.EvictionPolicy == EvictLargest {
+			stop = int((victim.bytes - runnerUp.bytes + average - 1) / average)
+		} else {
+			stop = victim.before(runnerUp.oldest())
+		}
+		if stop < n {
+			n = stop
+		}
+	}
+	if n < 1 {
+		n = 1
+	}
+	return victimKey, victim, n
+}
+
+// evict removes the n oldest elements of a series, passing them to OnExpire.
+func (s *storage) evict(w *worker, key string, ser *series, n int) {
+	var fn func(api.Element)
+	if s.opts.OnExpire != nil {
+		fn = func(elt api.Element) {
+			s.opts.OnExpire(key, elt, Evicted)
+		}
+	}
+	before, count := ser.bytes, ser.len()
+	ser.removeFront(n, fn)
+	w.bytes -= before - ser.bytes
+	s.opts.EvictionCounter.Add(float64(count - ser.len()))
+	if ser.len() == 0 {
+		w.drop(key)
+	}
+}
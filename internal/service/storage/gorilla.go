@@ -0,0 +1,209 @@
+package storage
+
+import (
+	"encoding/binary"
+	"math/bits"
+
+	"github.com/murphybytes/gots/api"
+)
+
+// Compression selects how full series chunks are encoded in memory.
+type Compression int
+
+const (
+	// CompressionNone keeps every element as is.
+	CompressionNone Compression = iota
+	// CompressionGorilla encodes timestamps as delta of deltas and 8 byte payloads by XOR against the previous
+	// payload, as described in the Facebook Gorilla paper. Chunks containing payloads that are not exactly 8 bytes,
+	// such as a float64 or int64 in big endian byte order, are left uncompressed.
+	CompressionGorilla
+)
+
+// gorillaValueSize is the only payload size that can be XOR encoded.
+const gorillaValueSize = 8
+
+// Delta of delta timestamps are written using the smallest of these bucket sizes that will hold the value. The
+// buckets are wider than those in the paper because timestamps are in nanoseconds rather than seconds.
+var gorillaTimestampBuckets = []struct {
+	control     uint64
+	controlBits int
+	valueBits   int
+}{
+	{control: 0x2, controlBits: 2, valueBits: 12},
+	{control: 0x6, controlBits: 3, valueBits: 20},
+	{control: 0xe, controlBits: 4, valueBits: 32},
+}
+
+// compressible returns true if every element in elts carries a payload that can be XOR encoded.
+func compressible(elts []api.Element) bool {
+	for i := range elts {
+		if len(elts[i].Data) != gorillaValueSize {
+			return false
+		}
+	}
+	return len(elts) > 0
+}
+
+// encodeGorilla compresses elts which must be time ordered and satisfy compressible.
+func encodeGorilla(elts []api.Element) []byte {
+	var w bitWriter
+	first := elts[0]
+	w.writeBits(uint64(first.Timestamp), 64)
+	w.writeBits(binary.BigEndian.Uint64(first.Data), 64)
+
+	var (
+		prevTimestamp = first.Timestamp
+		prevDelta     int64
+		prevValue     = binary.BigEndian.Uint64(first.Data)
+		prevLeading   = 64
+		prevTrailing  = 64
+	)
+	for _, elt := range elts[1:] {
+		delta := elt.Timestamp - prevTimestamp
+		writeDeltaOfDelta(&w, delta-prevDelta)
+		prevTimestamp, prevDelta = elt.Timestamp, delta
+
+		value := binary.BigEndian.Uint64(elt.Data)
+		xor := value ^ prevValue
+		prevValue = value
+		if xor == 0 {
+			w.writeBits(0, 1)
+			continue
+		}
+		leading, trailing := bits.LeadingZeros64(xor), bits.TrailingZeros64(xor)
+		if leading > 31 {
+			leading = 31
+		}
+		if leading >= prevLeading && trailing >= prevTrailing {
+			// The meaningful bits fit in the window used by the previous value.
+			w.writeBits(0x2, 2)
+			w.writeBits(xor>>uint(prevTrailing), 64-prevLeading-prevTrailing)
+			continue
+		}
+		significant := 64 - leading - trailing
+		w.writeBits(0x3, 2)
+		w.writeBits(uint64(leading), 5)
+		w.writeBits(uint64(significant-1), 6)
+		w.writeBits(xor>>uint(trailing), significant)
+		prevLeading, prevTrailing = leading, trailing
+	}
+	return w.buf
+}
+
+func writeDeltaOfDelta(w *bitWriter, dod int64) {
+	if dod == 0 {
+		w.writeBits(0, 1)
+		return
+	}
+	for _, b := range gorillaTimestampBuckets {
+		limit := int64(1) << uint(b.valueBits-1)
+		if dod >= -limit && dod < limit {
+			w.writeBits(b.control, b.controlBits)
+			w.writeBits(uint64(dod), b.valueBits)
+			return
+		}
+	}
+	w.writeBits(0xf, 4)
+	w.writeBits(uint64(dod), 64)
+}
+
+// decodeGorilla expands count elements encoded by encodeGorilla. Payloads share a single backing array.
+func decodeGorilla(buf []byte, count int) []api.Element {
+	r := bitReader{buf: buf}
+	elts := make([]api.Element, count)
+	data := make([]byte, count*gorillaValueSize)
+
+	timestamp := int64(r.readBits(64))
+	value := r.readBits(64)
+	var (
+		delta    int64
+		leading  int
+		trailing int
+	)
+	for i := 0; i < count; i++ {
+		if i > 0 {
+			delta += readDeltaOfDelta(&r)
+			timestamp += delta
+
+			if r.readBits(1) == 1 {
+				if r.readBits(1) == 1 {
+					leading = int(r.readBits(5))
+					trailing = 64 - leading - int(r.readBits(6)) - 1
+				}
+				value ^= r.readBits(64-leading-trailing) << uint(trailing)
+			}
+		}
+		elts[i].Timestamp = timestamp
+		elts[i].Data = data[i*gorillaValueSize : (i+1)*gorillaValueSize : (i+1)*gorillaValueSize]
+		binary.BigEndian.PutUint64(elts[i].Data, value)
+	}
+	return elts
+}
+
+func readDeltaOfDelta(r *bitReader) int64 {
+	if r.readBits(1) == 0 {
+		return 0
+	}
+	for _, b := range gorillaTimestampBuckets {
+		if r.readBits(1) == 0 {
+			return signExtend(r.readBits(b.valueBits), b.valueBits)
+		}
+	}
+	return int64(r.readBits(64))
+}
+
+// signExtend interprets the low n bits of v as a two's complement integer.
+func signExtend(v uint64, n int) int64 {
+	shift := uint(64 - n)
+	return int64(v<<shift) >> shift
+}
+
+// bitWriter appends values to a byte slice a bit at a time, most significant bit first.
+type bitWriter struct {
+	buf  []byte
+	free int
+}
+
+// writeBits writes the low n bits of v.
+func (w *bitWriter) writeBits(v uint64, n int) {
+	for n > 0 {
+		if w.free == 0 {
+			w.buf = append(w.buf, 0)
+			w.free = 8
+		}
+		take := n
+		if take > w.free {
+			take = w.free
+		}
+		n -= take
+		b := byte(v>>uint(n)) & (1<<uint(take) - 1)
+		w.buf[len(w.buf)-1] |= b << uint(w.free-take)
+		w.free -= take
+	}
+}
+
+// bitReader reads values written by bitWriter.
+type bitReader struct {
+	buf []byte
+	pos int
+}
+
+// readBits returns the next n bits. Reading past the end of the buffer yields zero bits.
+func (r *bitReader) readBits(n int) uint64 {
+	var v uint64
+	for n > 0 {
+		idx, offset := r.pos/8, r.pos%8
+		take := 8 - offset
+		if take > n {
+			take = n
+		}
+		var b byte
+		if idx < len(r.buf) {
+			b = r.buf[idx] >> uint(8-offset-take) & (1<<uint(take) - 1)
+		}
+		v = v<<uint(take) | uint64(b)
+		r.pos += take
+		n -= take
+	}
+	return v
+}
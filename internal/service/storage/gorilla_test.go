@@ -0,0 +1,163 @@
+package storage
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	mr "math/rand"
+	"testing"
+
+	"github.com/murphybytes/gots/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func float64Data(f float64) []byte {
+	data := make([]byte, 8)
+	binary.BigEndian.PutUint64(data, math.Float64bits(f))
+	return data
+}
+
+func ticks(count int, interval, jitter int64) []api.Element {
+	elts := make([]api.Element, count)
+	ts := int64(1500000000000000000)
+	price := 100.0
+	for i := range elts {
+		ts += interval
+		if jitter > 0 {
+			ts += mr.Int63n(jitter)
+		}
+		if mr.Intn(3) == 0 {
+			price += float64(mr.Intn(200)-100) / 100
+		}
+		elts[i] = api.Element{Timestamp: ts, Data: float64Data(price)}
+	}
+	return elts
+}
+
+func TestGorillaRoundTrip(t *testing.T) {
+	tt := []struct {
+		desc string
+		elts []api.Element
+	}{
+		{"single", ticks(1, 0, 0)},
+		{"regular", ticks(500, int64(1e9), 0)},
+		{"jitter", ticks(500, int64(1e6), int64(1e3))},
+		{"large_jitter", ticks(500, int64(1e9), int64(1e9))},
+		{"duplicate_timestamps", ticks(500, 0, 0)},
+		{"extreme", []api.Element{
+			{Timestamp: 0, Data: float64Data(math.Inf(1))},
+			{Timestamp: math.MaxInt64 / 2, Data: float64Data(math.NaN())},
+			{Timestamp: math.MaxInt64 / 2, Data: float64Data(0)},
+			{Timestamp: math.MaxInt64, Data: float64Data(-math.MaxFloat64)},
+		}},
+	}
+	for _, tc := range tt {
+		t.Run(tc.desc, func(t *testing.T) {
+			buf := encodeGorilla(tc.elts)
+			assert.Equal(t, tc.elts, decodeGorilla(buf, len(tc.elts)))
+		})
+	}
+}
+
+func TestGorillaCompressesTicks(t *testing.T) {
+	elts := ticks(DefaultChunkSize, int64(1e9), 0)
+	buf := encodeGorilla(elts)
+	assert.True(t, len(buf) < len(elts)*gorillaValueSize/2, fmt.Sprintf("compressed to %d bytes", len(buf)))
+}
+
+func TestCompressedSeries(t *testing.T) {
+	const chunkSize = 16
+	elts := ticks(1000, int64(1e6), int64(1e6))
+	mr.Shuffle(len(elts), func(i, j int) {
+		if mr.Intn(10) == 0 {
+			elts[i], elts[j] = elts[j], elts[i]
+		}
+	})
+	plain := newSeries(chunkSize, CompressionNone)
+	compressed := newSeries(chunkSize, CompressionGorilla)
+	for _, elt := range elts {
+		insert(plain, elt)
+		insert(compressed, elt)
+	}
+
+	var sealed int
+	for i, c := range compressed.chunks {
+		if c.sealed != nil {
+			sealed++
+			require.Nil(t, c.elts)
+			require.NotEqual(t, len(compressed.chunks)-1, i)
+		}
+	}
+	require.True(t, sealed > 0)
+	require.Equal(t, plain.elements(), compressed.elements())
+
+	first, last := plain.oldest(), plain.newest()
+	for i := 0; i < 100; i++ {
+		lower := first + mr.Int63n(last-first)
+		upper := lower + mr.Int63n(last-lower+1)
+		require.Equal(t, search(plain, lower, upper), search(compressed, lower, upper))
+	}
+
+	cutOff := first + (last-first)/2
+	var expiredPlain, expiredCompressed []api.Element
+	expire("key", plain, cutOff, func(_ string, elt api.Element, _ ExpiryReason) {
+		expiredPlain = append(expiredPlain, elt)
+	})
+	expire("key", compressed, cutOff, func(_ string, elt api.Element, _ ExpiryReason) {
+		expiredCompressed = append(expiredCompressed, elt)
+	})
+	assert.Equal(t, expiredPlain, expiredCompressed)
+	assert.Equal(t, plain.elements(), compressed.elements())
+}
+
+func TestIncompressibleSeries(t *testing.T) {
+	s := newSeries(4, CompressionGorilla)
+	for i := 0; i < 20; i++ {
+		insert(s, api.Element{Timestamp: int64(i), Data: []byte("not a float")})
+	}
+	for _, c := range s.chunks {
+		assert.Nil(t, c.sealed)
+	}
+	assert.Len(t, s.elements(), 20)
+}
+
+func BenchmarkCompressedSeriesInsert(b *testing.B) {
+	elts := ticks(benchmarkElements, int64(1e6), int64(1e3))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s := newSeries(DefaultChunkSize, CompressionGorilla)
+		for _, elt := range elts {
+			insert(s, elt)
+		}
+	}
+}
+
+func BenchmarkCompressedSeriesSearch(b *testing.B) {
+	s := newSeries(DefaultChunkSize, CompressionGorilla)
+	elts := ticks(benchmarkElements, int64(1e6), int64(1e3))
+	for _, elt := range elts {
+		insert(s, elt)
+	}
+	first := elts[len(elts)-1000].Timestamp
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		search(s, first, int64(api.NoUpperBound))
+	}
+}
+
+func BenchmarkCompressedSeriesSearchNarrow(b *testing.B) {
+	s := newSeries(DefaultChunkSize, CompressionGorilla)
+	elts := ticks(benchmarkElements, int64(1e6), int64(1e3))
+	for _, elt := range elts {
+		insert(s, elt)
+	}
+	first, last := elts[len(elts)/2].Timestamp, elts[len(elts)/2+10].Timestamp
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		search(s, first, last)
+	}
+}
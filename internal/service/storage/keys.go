@@ -0,0 +1,77 @@
+package storage
+
+import (
+	"context"
+	"sort"
+)
+
+// KeyInfo describes the series stored for a key. Oldest and newest are unix time in nanoseconds.
+type KeyInfo struct {
+	Key    string
+	Labels Labels
+	Count  int
+	Oldest int64
+	Newest int64
+}
+
+// KeyLister returns the keys held in storage.
+type KeyLister interface {
+	// ListKeys returns up to limit keys selected by keys, and by every one of labels, that sort after the key after,
+	// in ascending order. More is true if there are further keys to list. A limit of zero returns every key.
+	ListKeys(ctx context.Context, keys KeyMatcher, labels []LabelMatcher, after string, limit int) (result []KeyInfo, more bool, err error)
+}
+
+// ListKeys asks every worker for its matching keys at the same time and merges the results.
+func (s *storage) ListKeys(ctx context.Context, keys KeyMatcher, labels []LabelMatcher, after string, limit int) ([]KeyInfo, bool, error) {
+	responses := make(chan []KeyInfo, len(s.work))
+	for i := range s.work {
+		err := s.submit(ctx, i, func(w *worker) {
+			var result []KeyInfo
+			for _, key := range w.selectKeys(labels) {
+				ser := w.data[key]
+				if key <= after || ser.len() == 0 || !keys.Match(key) {
+					continue
+				}
+				result = append(result, KeyInfo{
+					Key:    key,
+					Labels: ser.labels.copy(),
+					Count:  ser.len(),
+					Oldest: ser.oldest(),
+					Newest: ser.newest(),
+				})
+			}
+			// only the first limit + 1 keys of each worker can appear in the page
+			sortKeyInfo(result)
+			if limit > 0 && len(result) > limit+1 {
+				result = result[:limit+1]
+			}
+			responses <- result
+		})
+		if err != nil {
+			return nil, false, err
+		}
+	}
+
+	var result []KeyInfo
+	for range s.work {
+		select {
+		case infos := <-responses:
+			result = append(result, infos...)
+		case <-s.close:
+			return nil, false, ErrClosed
+		case <-ctx.Done():
+			return nil, false, ctx.Err()
+		}
+	}
+	sortKeyInfo(result)
+	if limit > 0 && len(result) > limit {
+		return result[:limit], true, nil
+	}
+	return result, false, nil
+}
+
+func sortKeyInfo(keys []KeyInfo) {
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].Key < keys[j].Key
+	})
+}
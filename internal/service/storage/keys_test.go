@@ -0,0 +1,67 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/metrics/discard"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestListKeys(t *testing.T) {
+	stg, err := New(Options{
+		MaxAge:            time.Hour,
+		WorkerCount:       4,
+		ChannelBufferSize: DefaultChannelBufferSize,
+		MessageCounter:    discard.NewCounter(),
+	})
+	require.Nil(t, err)
+	defer stg.Close()
+
+	base := time.Now()
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("book.%02d", i)
+		for j := 0; j <= i; j++ {
+			stg.Write(context.Background(), key, base.Add(time.Duration(j)), nil)
+		}
+		stg.Write(context.Background(), fmt.Sprintf("trade.%02d", i), base, nil)
+	}
+
+	var pages [][]KeyInfo
+	after := ""
+	for {
+		page, more, err := stg.ListKeys(context.Background(), KeyMatcher{Type: MatchPrefix, Pattern: "book."}, nil, after, 4)
+		require.Nil(t, err)
+		pages = append(pages, page)
+		if !more {
+			break
+		}
+		after = page[len(page)-1].Key
+	}
+	require.Len(t, pages, 3)
+	assert.Len(t, pages[2], 2)
+	var i int
+	for _, page := range pages {
+		for _, info := range page {
+			assert.Equal(t, KeyInfo{
+				Key:    fmt.Sprintf("book.%02d", i),
+				Count:  i + 1,
+				Oldest: base.UnixNano(),
+				Newest: base.Add(time.Duration(i)).UnixNano(),
+			}, info)
+			i++
+		}
+	}
+	assert.Equal(t, 10, i)
+
+	keys, more, err := stg.ListKeys(context.Background(), KeyMatcher{Type: MatchGlob, Pattern: "trade.0[12]"}, nil, "", 0)
+	require.Nil(t, err)
+	assert.False(t, more)
+	require.Len(t, keys, 2)
+	assert.Equal(t, "trade.01", keys[0].Key)
+	assert.Equal(t, "trade.02", keys[1].Key)
+	assert.Len(t, stg.keys(), 20)
+}
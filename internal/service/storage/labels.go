@@ -0,0 +1,255 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+)
+
+// Labels are name value pairs that describe a series, for example exchange=nyse. They let series be selected by
+// dimension rather than by encoding every dimension in the key.
+type Labels map[string]string
+
+// equal returns true if both label sets hold the same pairs.
+func (l Labels) equal(other Labels) bool {
+	if len(l) != len(other) {
+		return false
+	}
+	for name, value := range l {
+		if v, ok := other[name]; !ok || v != value {
+			return false
+		}
+	}
+	return true
+}
+
+// copy returns a copy of the labels, or nil if there are none.
+func (l Labels) copy() Labels {
+	if len(l) == 0 {
+		return nil
+	}
+	c := make(Labels, len(l))
+	for name, value := range l {
+		c[name] = value
+	}
+	return c
+}
+
+// names returns the label names in ascending order.
+func (l Labels) names() []string {
+	names := make([]string, 0, len(l))
+	for name := range l {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// LabelMatchType describes how a LabelMatcher compares its value to the value of a label.
+type LabelMatchType int
+
+const (
+	// LabelEqual matches labels with the same value.
+	LabelEqual LabelMatchType = iota
+	// LabelNotEqual matches labels with a different value.
+	LabelNotEqual
+	// LabelRegex matches labels with a value matching a regular expression. The expression must match the whole
+	// value.
+	LabelRegex
+)
+
+// LabelMatcher selects series by the value of one of their labels. Series without the label are matched as if its
+// value were empty, so name!="" selects the series that have the label.
+type LabelMatcher struct {
+	Type  LabelMatchType
+	Name  string
+	Value string
+	re    *regexp.Regexp
+}
+
+// NewLabelMatcher returns a matcher, compiling the value of LabelRegex matchers.
+func NewLabelMatcher(t LabelMatchType, name, value string) (LabelMatcher, error) {
+	m := LabelMatcher{Type: t, Name: name, Value: value}
+	switch t {
+	case LabelEqual, LabelNotEqual:
+	case LabelRegex:
+		re, err := regexp.Compile("^(?:" + value + ")$")
+		if err != nil {
+			return m, err
+		}
+		m.re = re
+	default:
+		return m, fmt.Errorf("unknown label match type %d", t)
+	}
+	return m, nil
+}
+
+// Match returns true if the label value is selected by the matcher. Regex matchers must be created by
+// NewLabelMatcher.
+func (m LabelMatcher) Match(value string) bool {
+	switch m.Type {
+	case LabelEqual:
+		return value == m.Value
+	case LabelNotEqual:
+		return value != m.Value
+	case LabelRegex:
+		return m.re != nil && m.re.MatchString(value)
+	}
+	return false
+}
+
+// matchLabels returns true if labels are selected by every matcher.
+func matchLabels(matchers []LabelMatcher, labels Labels) bool {
+	for _, m := range matchers {
+		if !m.Match(labels[m.Name]) {
+			return false
+		}
+	}
+	return true
+}
+
+// LabelSearcher searches every series selected by a set of label matchers.
+type LabelSearcher interface {
+	// SearchLabels returns the elements between first and last of each series matched by every one of matchers,
+	// ordered by key. At least one matcher is required.
+	SearchLabels(ctx context.Context, matchers []LabelMatcher, first, last uint64) ([]KeyResult, error)
+}
+
+// labelIndex maps each label name and value to the keys of the series that carry it. Each worker indexes its own
+// series.
+type labelIndex map[string]map[string]map[string]struct{}
+
+func (x labelIndex) add(key string, labels Labels) {
+	for name, value := range labels {
+		values, ok := x[name]
+		if !ok {
+			values = make(map[string]map[string]struct{})
+			x[name] = values
+		}
+		keys, ok := values[value]
+		if !ok {
+			keys = make(map[string]struct{})
+			values[value] = keys
+		}
+		keys[key] = struct{}{}
+	}
+}
+
+func (x labelIndex) remove(key string, labels Labels) {
+	for name, value := range labels {
+		keys := x[name][value]
+		delete(keys, key)
+		if len(keys) == 0 {
+			delete(x[name], value)
+		}
+		if len(x[name]) == 0 {
+			delete(x, name)
+		}
+	}
+}
+
+// candidates returns the keys that may be matched by matchers, using the index for the first matcher that cannot
+// match a missing label. All is false if no such matcher exists and every series must be considered.
+func (x labelIndex) candidates(matchers []LabelMatcher) (keys map[string]struct{}, all bool) {
+	for _, m := range matchers {
+		if m.Match("") {
+			continue
+		}
+		if m.Type == LabelEqual {
+			return x[m.Name][m.Value], false
+		}
+		keys = make(map[string]struct{})
+		for value, valueKeys := range x[m.Name] {
+			if !m.Match(value) {
+				continue
+			}
+			for key := range valueKeys {
+				keys[key] = struct{}{}
+			}
+		}
+		return keys, false
+	}
+	return nil, true
+}
+
+// selectKeys returns the keys of the worker's series that are matched by every one of matchers.
+func (w *worker) selectKeys(matchers []LabelMatcher) []string {
+	var keys []string
+	candidates, all := w.index.candidates(matchers)
+	if all {
+		for key, ser := range w.data {
+			if matchLabels(matchers, ser.labels) {
+				keys = append(keys, key)
+			}
+		}
+		return keys
+	}
+	for key := range candidates {
+		if ser, ok := w.data[key]; ok && matchLabels(matchers, ser.labels) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// label replaces the labels of the series for key if they differ. Empty labels leave the series unchanged.
+func (w *worker) label(key string, labels Labels) {
+	ser, ok := w.data[key]
+	if !ok || len(labels) == 0 || ser.labels.equal(labels) {
+		return
+	}
+	w.index.remove(key, ser.labels)
+	ser.labels = labels
+	w.index.add(key, labels)
+}
+
+// drop removes the series for key from the worker, its labels from the index and its count from the limiter.
+func (w *worker) drop(key string) {
+	if ser, ok := w.data[key]; ok {
+		w.index.remove(key, ser.labels)
+		delete(w.data, key)
+		w.limiter.release(key)
+	}
+}
+
+// SearchLabels asks every worker for the series matching matchers at the same time and merges the results.
+func (s *storage) SearchLabels(ctx context.Context, matchers []LabelMatcher, first, last uint64) ([]KeyResult, error) {
+	if first > last || len(matchers) == 0 {
+		return nil, &ErrorInvalidSearch{}
+	}
+	responses := make(chan []KeyResult, len(s.work))
+	for i := range s.work {
+		err := s.submit(ctx, i, func(w *worker) {
+			var batch []KeyResult
+			for _, key := range w.selectKeys(matchers) {
+				ser := w.data[key]
+				batch = append(batch, KeyResult{
+					Key:      key,
+					Labels:   ser.labels.copy(),
+					Elements: search(ser, int64(first), int64(last)),
+				})
+			}
+			responses <- batch
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var results []KeyResult
+	for range s.work {
+		select {
+		case batch := <-responses:
+			results = append(results, batch...)
+		case <-s.close:
+			return nil, ErrClosed
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Key < results[j].Key
+	})
+	return results, nil
+}
@@ -0,0 +1,172 @@
+package storage
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/murphybytes/gots/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func mustLabelMatcher(t *testing.T, mt LabelMatchType, name, value string) LabelMatcher {
+	m, err := NewLabelMatcher(mt, name, value)
+	require.Nil(t, err)
+	return m
+}
+
+func TestLabelMatcher(t *testing.T) {
+	tt := []struct {
+		matcher LabelMatcher
+		value   string
+		match   bool
+	}{
+		{mustLabelMatcher(t, LabelEqual, "venue", "arca"), "arca", true},
+		{mustLabelMatcher(t, LabelEqual, "venue", "arca"), "", false},
+		{mustLabelMatcher(t, LabelNotEqual, "venue", "arca"), "bats", true},
+		{mustLabelMatcher(t, LabelNotEqual, "venue", ""), "", false},
+		{mustLabelMatcher(t, LabelRegex, "venue", "ar.*"), "arca", true},
+		{mustLabelMatcher(t, LabelRegex, "venue", "rc"), "arca", false},
+		{mustLabelMatcher(t, LabelRegex, "venue", "arca|bats"), "bats", true},
+	}
+	for _, tc := range tt {
+		assert.Equal(t, tc.match, tc.matcher.Match(tc.value), "%v %s", tc.matcher, tc.value)
+	}
+
+	_, err := NewLabelMatcher(LabelRegex, "venue", "(")
+	assert.NotNil(t, err)
+}
+
+func TestSearchLabels(t *testing.T) {
+	stg, err := New(testOptions(4))
+	require.Nil(t, err)
+	defer stg.Close()
+
+	now := time.Now()
+	series := map[string]Labels{
+		"ibm|nyse|arca":  {"symbol": "ibm", "exchange": "nyse", "venue": "arca"},
+		"ibm|nyse|bats":  {"symbol": "ibm", "exchange": "nyse", "venue": "bats"},
+		"aapl|nasdaq|x":  {"symbol": "aapl", "exchange": "nasdaq"},
+		"unlabelled.key": nil,
+	}
+	for key, labels := range series {
+		require.Nil(t, stg.WriteLabels(context.Background(), key, labels, now, []byte(key)))
+	}
+
+	keys := func(results []KeyResult) []string {
+		var keys []string
+		for _, r := range results {
+			keys = append(keys, r.Key)
+		}
+		return keys
+	}
+	tt := []struct {
+		matchers []LabelMatcher
+		expected []string
+	}{
+		{[]LabelMatcher{mustLabelMatcher(t, LabelEqual, "exchange", "nyse")}, []string{"ibm|nyse|arca", "ibm|nyse|bats"}},
+		{
+			[]LabelMatcher{
+				mustLabelMatcher(t, LabelEqual, "symbol", "ibm"),
+				mustLabelMatcher(t, LabelNotEqual, "venue", "arca"),
+			},
+			[]string{"ibm|nyse|bats"},
+		},
+		{[]LabelMatcher{mustLabelMatcher(t, LabelRegex, "exchange", "n.*")}, []string{"aapl|nasdaq|x", "ibm|nyse|arca", "ibm|nyse|bats"}},
+		{[]LabelMatcher{mustLabelMatcher(t, LabelEqual, "venue", "")}, []string{"aapl|nasdaq|x", "unlabelled.key"}},
+		{[]LabelMatcher{mustLabelMatcher(t, LabelNotEqual, "venue", "")}, []string{"ibm|nyse|arca", "ibm|nyse|bats"}},
+		{[]LabelMatcher{mustLabelMatcher(t, LabelEqual, "exchange", "lse")}, nil},
+	}
+	for _, tc := range tt {
+		results, err := stg.SearchLabels(context.Background(), tc.matchers, api.NoLowerBound, api.NoUpperBound)
+		require.Nil(t, err)
+		assert.Equal(t, tc.expected, keys(results), "%v", tc.matchers)
+	}
+
+	results, err := stg.SearchLabels(context.Background(), tt[1].matchers, api.NoLowerBound, api.NoUpperBound)
+	require.Nil(t, err)
+	require.Len(t, results, 1)
+	assert.Equal(t, series["ibm|nyse|bats"], results[0].Labels)
+	assert.Equal(t, []api.Element{{Timestamp: now.UnixNano(), Data: []byte("ibm|nyse|bats")}}, results[0].Elements)
+
+	_, err = stg.SearchLabels(context.Background(), nil, api.NoLowerBound, api.NoUpperBound)
+	assert.IsType(t, &ErrorInvalidSearch{}, err)
+
+	// labels are replaced by a later write and left alone by writes without labels
+	require.Nil(t, stg.WriteLabels(context.Background(), "ibm|nyse|arca", Labels{"symbol": "ibm", "exchange": "lse"}, now.Add(1), nil))
+	require.Nil(t, stg.Write(context.Background(), "ibm|nyse|arca", now.Add(2), nil))
+	results, err = stg.SearchLabels(context.Background(), []LabelMatcher{mustLabelMatcher(t, LabelEqual, "exchange", "lse")}, api.NoLowerBound, api.NoUpperBound)
+	require.Nil(t, err)
+	assert.Equal(t, []string{"ibm|nyse|arca"}, keys(results))
+	results, err = stg.SearchLabels(context.Background(), []LabelMatcher{mustLabelMatcher(t, LabelEqual, "venue", "arca")}, api.NoLowerBound, api.NoUpperBound)
+	require.Nil(t, err)
+	assert.Empty(t, results)
+
+	// deleted series are removed from the index
+	_, err = stg.DeleteSeries(context.Background(), "ibm|nyse|bats")
+	require.Nil(t, err)
+	results, err = stg.SearchLabels(context.Background(), []LabelMatcher{mustLabelMatcher(t, LabelEqual, "symbol", "ibm")}, api.NoLowerBound, api.NoUpperBound)
+	require.Nil(t, err)
+	assert.Equal(t, []string{"ibm|nyse|arca"}, keys(results))
+}
+
+func TestListKeysLabels(t *testing.T) {
+	stg, err := New(testOptions(4))
+	require.Nil(t, err)
+	defer stg.Close()
+
+	now := time.Now()
+	stg.WriteLabels(context.Background(), "book.ibm", Labels{"symbol": "ibm"}, now, nil)
+	stg.WriteLabels(context.Background(), "trade.ibm", Labels{"symbol": "ibm"}, now, nil)
+	stg.WriteLabels(context.Background(), "trade.aapl", Labels{"symbol": "aapl"}, now, nil)
+
+	keys, more, err := stg.ListKeys(
+		context.Background(),
+		KeyMatcher{Type: MatchPrefix, Pattern: "trade."},
+		[]LabelMatcher{mustLabelMatcher(t, LabelEqual, "symbol", "ibm")},
+		"",
+		0,
+	)
+	require.Nil(t, err)
+	assert.False(t, more)
+	assert.Equal(t, []KeyInfo{{
+		Key:    "trade.ibm",
+		Labels: Labels{"symbol": "ibm"},
+		Count:  1,
+		Oldest: now.UnixNano(),
+		Newest: now.UnixNano(),
+	}}, keys)
+}
+
+func TestLabelsRecovered(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gots-labels")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	now := time.Now()
+	stg, err := New(testOptions(4, withSnapshot(dir)))
+	require.Nil(t, err)
+	stg.WriteLabels(context.Background(), "A", Labels{"venue": "arca"}, now, nil)
+	stg.WriteLabels(context.Background(), "B", Labels{"venue": "bats"}, now, nil)
+	_, err = stg.Snapshot(context.Background())
+	require.Nil(t, err)
+	// B is relabelled in the write ahead log after the snapshot was taken
+	stg.WriteLabels(context.Background(), "B", Labels{"venue": "arca"}, now.Add(1), nil)
+	stg.WriteLabels(context.Background(), "C", Labels{"venue": "arca"}, now, nil)
+	require.Nil(t, stg.Close())
+
+	stg, err = New(testOptions(3, withSnapshot(dir)))
+	require.Nil(t, err)
+	defer stg.Close()
+	results, err := stg.SearchLabels(context.Background(), []LabelMatcher{mustLabelMatcher(t, LabelEqual, "venue", "arca")}, api.NoLowerBound, api.NoUpperBound)
+	require.Nil(t, err)
+	require.Len(t, results, 3)
+	for i, key := range []string{"A", "B", "C"} {
+		assert.Equal(t, key, results[i].Key)
+		assert.Equal(t, Labels{"venue": "arca"}, results[i].Labels)
+	}
+	assert.Len(t, results[1].Elements, 2)
+}
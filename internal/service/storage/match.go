@@ -0,0 +1,79 @@
+package storage
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"time"
+)
+
+// MatchType describes how a KeyMatcher compares its pattern to a key.
+type MatchType int
+
+const (
+	// MatchExact matches a key equal to the pattern.
+	MatchExact MatchType = iota
+	// MatchPrefix matches keys that begin with the pattern.
+	MatchPrefix
+	// MatchGlob matches keys using shell file name patterns as implemented by path.Match.
+	MatchGlob
+)
+
+// KeyMatcher selects a set of keys. It is used to apply settings to some keys but not others.
+type KeyMatcher struct {
+	Type    MatchType
+	Pattern string
+}
+
+// ParseKeyMatcher reads a matcher written as the match type followed by a colon and the pattern, for example
+// "prefix:book." or "glob:index.*". Specifications without a colon are exact matches. Keys that contain a colon must
+// be written with the exact type, for example "exact:a:b".
+func ParseKeyMatcher(spec string) (KeyMatcher, error) {
+	types := map[string]MatchType{
+		"exact":  MatchExact,
+		"prefix": MatchPrefix,
+		"glob":   MatchGlob,
+	}
+	i := strings.Index(spec, ":")
+	if i < 0 {
+		return KeyMatcher{Type: MatchExact, Pattern: spec}, nil
+	}
+	t, ok := types[spec[:i]]
+	if !ok {
+		return KeyMatcher{}, fmt.Errorf("unknown key match type '%s'", spec[:i])
+	}
+	return KeyMatcher{Type: t, Pattern: spec[i+1:]}, nil
+}
+
+// Match returns true if key is selected by the matcher.
+func (m KeyMatcher) Match(key string) bool {
+	switch m.Type {
+	case MatchExact:
+		return key == m.Pattern
+	case MatchPrefix:
+		return strings.HasPrefix(key, m.Pattern)
+	case MatchGlob:
+		matched, err := path.Match(m.Pattern, key)
+		return err == nil && matched
+	}
+	return false
+}
+
+// CompressionPolicy applies a compression scheme to the keys selected by Keys.
+type CompressionPolicy struct {
+	Keys        KeyMatcher
+	Compression Compression
+}
+
+// DuplicatePolicy decides what happens to elements written to the keys selected by Keys with the same timestamp as
+// an element already stored.
+type DuplicatePolicy struct {
+	Keys       KeyMatcher
+	Duplicates Duplicates
+}
+
+// RetentionPolicy sets the maximum age of elements belonging to the keys selected by Keys.
+type RetentionPolicy struct {
+	Keys   KeyMatcher
+	MaxAge time.Duration
+}
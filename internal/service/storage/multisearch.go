@@ -0,0 +1,89 @@
+package storage
+
+import (
+	"context"
+
+	"github.com/murphybytes/gots/api"
+)
+
+// KeyResult is the outcome of searching one key. Err is an ErrorNotFound if the key does not exist.
+type KeyResult struct {
+	Key      string
+	Labels   Labels
+	Elements []api.Element
+	Err      error
+	// index is the position of the key in the request.
+	index int
+}
+
+// MultiSearcher searches many keys in a single request, issuing one job to each worker that owns at least one of the
+// keys rather than one job per key.
+type MultiSearcher interface {
+	// MultiSearch returns a result for each of keys, in the same order, with the elements between first and last.
+	MultiSearch(ctx context.Context, keys []string, first, last uint64) ([]KeyResult, error)
+	// MultiSearchStream passes the results of each worker to fn as soon as they are ready. If fn returns an error no
+	// further results are passed to it and the error is returned.
+	MultiSearchStream(ctx context.Context, keys []string, first, last uint64, fn func([]KeyResult) error) error
+}
+
+// MultiSearch returns a result for each key in the order requested.
+func (s *storage) MultiSearch(ctx context.Context, keys []string, first, last uint64) ([]KeyResult, error) {
+	results := make([]KeyResult, len(keys))
+	err := s.MultiSearchStream(ctx, keys, first, last, func(batch []KeyResult) error {
+		for _, r := range batch {
+			results[r.index] = r
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// MultiSearchStream groups keys by worker and searches them concurrently, passing each worker's results to fn.
+func (s *storage) MultiSearchStream(ctx context.Context, keys []string, first, last uint64, fn func([]KeyResult) error) error {
+	if first > last {
+		return &ErrorInvalidSearch{}
+	}
+	partitions := make(map[int][]int)
+	for i, key := range keys {
+		partition := s.calculateWorkerPartition(key)
+		partitions[partition] = append(partitions[partition], i)
+	}
+
+	// buffered so that workers never wait for a caller that has stopped reading
+	responses := make(chan []KeyResult, len(partitions))
+	for partition, indexes := range partitions {
+		indexes := indexes
+		err := s.submit(ctx, partition, func(w *worker) {
+			batch := make([]KeyResult, len(indexes))
+			for j, i := range indexes {
+				batch[j] = KeyResult{Key: keys[i], index: i}
+				if ser, ok := w.data[keys[i]]; ok {
+					batch[j].Labels = ser.labels.copy()
+					batch[j].Elements = search(ser, int64(first), int64(last))
+				} else {
+					batch[j].Err = &ErrorNotFound{Key: keys[i]}
+				}
+			}
+			responses <- batch
+		})
+		if err != nil {
+			return err
+		}
+	}
+	for range partitions {
+		select {
+		case batch := <-responses:
+			if err := fn(batch); err != nil {
+				return err
+			}
+		case <-s.close:
+			return ErrClosed
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/metrics/discard"
+	"github.com/murphybytes/gots/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMultiSearch(t *testing.T) {
+	stg, err := New(Options{
+		MaxAge:            time.Hour,
+		WorkerCount:       4,
+		ChannelBufferSize: DefaultChannelBufferSize,
+		MessageCounter:    discard.NewCounter(),
+	})
+	require.Nil(t, err)
+	defer stg.Close()
+
+	base := time.Now()
+	var keys []string
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("key%d", i)
+		keys = append(keys, key)
+		for j := 0; j <= i; j++ {
+			stg.Write(context.Background(), key, base.Add(time.Duration(j)), []byte(key))
+		}
+	}
+	keys = append(keys, "missing", "key3")
+
+	results, err := stg.MultiSearch(context.Background(), keys, api.NoLowerBound, api.NoUpperBound)
+	require.Nil(t, err)
+	require.Len(t, results, len(keys))
+	for i, r := range results {
+		assert.Equal(t, keys[i], r.Key)
+		if r.Key == "missing" {
+			assert.IsType(t, &ErrorNotFound{}, r.Err)
+			continue
+		}
+		require.Nil(t, r.Err)
+		expected, err := stg.Search(context.Background(), r.Key, api.NoLowerBound, api.NoUpperBound)
+		require.Nil(t, err)
+		assert.Equal(t, expected, r.Elements)
+	}
+
+	var batches, count int
+	err = stg.MultiSearchStream(context.Background(), keys, api.NoLowerBound, api.NoUpperBound, func(batch []KeyResult) error {
+		batches++
+		count += len(batch)
+		return nil
+	})
+	require.Nil(t, err)
+	assert.Equal(t, len(keys), count)
+	assert.True(t, batches <= 4)
+
+	stop := fmt.Errorf("stop")
+	err = stg.MultiSearchStream(context.Background(), keys, api.NoLowerBound, api.NoUpperBound, func([]KeyResult) error {
+		return stop
+	})
+	assert.Equal(t, stop, err)
+
+	_, err = stg.MultiSearch(context.Background(), keys, 2, 1)
+	assert.IsType(t, &ErrorInvalidSearch{}, err)
+}
@@ -0,0 +1,192 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/murphybytes/gots/api"
+	"github.com/pkg/errors"
+)
+
+const (
+	// DefaultOverloadTimeout is how long BlockWritesWithTimeout waits for room in a write queue.
+	DefaultOverloadTimeout = time.Second
+
+	queueSampleInterval = 100 * time.Millisecond
+	// Backpressure is signalled once a write queue is this full and released when every queue has drained to
+	// lowWaterMark.
+	highWaterMark = 0.9
+	lowWaterMark  = 0.5
+)
+
+// ErrOverloaded is returned by Write when an element is discarded because the write queue of its worker is full.
+var ErrOverloaded = errors.New("storage is overloaded")
+
+// OverloadPolicy decides what Write does when the write queue of a worker is full.
+type OverloadPolicy int
+
+const (
+	// BlockWrites waits until there is room in the queue.
+	BlockWrites OverloadPolicy = iota
+	// BlockWritesWithTimeout waits for up to Options.OverloadTimeout and then discards the element.
+	BlockWritesWithTimeout
+	// DropNewest discards the element being written.
+	DropNewest
+	// DropOldest discards the oldest elements waiting in the queue to make room for the element being written. Writes
+	// to unbuffered queues wait as they do with BlockWrites.
+	DropOldest
+)
+
+// ParseOverloadPolicy converts the name of a policy, "block", "timeout", "drop-newest" or "drop-oldest", into an
+// OverloadPolicy.
+func ParseOverloadPolicy(name string) (OverloadPolicy, error) {
+	switch name {
+	case "block":
+		return BlockWrites, nil
+	case "timeout":
+		return BlockWritesWithTimeout, nil
+	case "drop-newest":
+		return DropNewest, nil
+	case "drop-oldest":
+		return DropOldest, nil
+	}
+	return BlockWrites, fmt.Errorf("unknown overload policy '%s'", name)
+}
+
+// Backpressure tells a source of writes, such as a Kafka consumer, when to pause so that it does not stall in Write
+// or have elements dropped.
+type Backpressure interface {
+	// Overloaded returns a channel that receives true when the write queue of any worker is nearly full and false
+	// once every queue has drained. Only changes are sent and a value that has not been received is replaced by the
+	// next one.
+	Overloaded() <-chan bool
+}
+
+// pendingWrite is an element waiting in the write queue of a worker.
+type pendingWrite struct {
+	key    string
+	labels Labels
+	elt    api.Element
+	source *SourceOffset
+	// result receives whether the write was stored when the writer waits for it. It is buffered so that the worker
+	// never blocks on a writer that gave up.
+	result chan<- error
+}
+
+// done reports the outcome of the write to a writer waiting for it.
+func (pw pendingWrite) done(err error) {
+	if pw.result != nil {
+		pw.result <- err
+	}
+}
+
+// Overloaded returns the backpressure signal of storage.
+func (s *storage) Overloaded() <-chan bool {
+	return s.pressure
+}
+
+// enqueue places pw on the write queue for partition, applying the overload policy if the queue is full.
+func (s *storage) enqueue(ctx context.Context, partition int, pw pendingWrite) error {
+	select {
+	case <-s.close:
+		return ErrClosed
+	default:
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	queue := s.writes[partition]
+	select {
+	case queue <- pw:
+		return nil
+	default:
+	}
+
+	switch s.opts.OverloadPolicy {
+	case DropNewest:
+		s.dropped[partition].Add(1)
+		return ErrOverloaded
+	case DropOldest:
+		// an unbuffered queue holds nothing to drop, so writes wait for the worker as they do with BlockWrites
+		for cap(queue) > 0 {
+			// room made by the last drop is taken before dropping again
+			select {
+			case <-s.close:
+				return ErrClosed
+			default:
+			}
+			select {
+			case queue <- pw:
+				return nil
+			default:
+			}
+			select {
+			case queue <- pw:
+				return nil
+			case old := <-queue:
+				s.dropped[partition].Add(1)
+				old.done(ErrOverloaded)
+			case <-s.close:
+				return ErrClosed
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	case BlockWritesWithTimeout:
+		timer := time.NewTimer(s.opts.OverloadTimeout)
+		defer timer.Stop()
+		select {
+		case queue <- pw:
+			return nil
+		case <-timer.C:
+			s.dropped[partition].Add(1)
+			return ErrOverloaded
+		case <-s.close:
+			return ErrClosed
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	select {
+	case queue <- pw:
+		return nil
+	case <-s.close:
+		return ErrClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// monitorQueues publishes the depth of each write queue and signals backpressure until storage is closed.
+func (s *storage) monitorQueues() {
+	defer s.wait.Done()
+	ticker := time.NewTicker(queueSampleInterval)
+	defer ticker.Stop()
+	var overloaded bool
+	for {
+		select {
+		case <-s.close:
+			return
+		case <-ticker.C:
+		}
+		high, low := false, true
+		for i, queue := range s.writes {
+			depth := len(queue)
+			s.queueDepth[i].Set(float64(depth))
+			if capacity := float64(cap(queue)); capacity > 0 {
+				high = high || float64(depth) >= capacity*highWaterMark
+				low = low && float64(depth) <= capacity*lowWaterMark
+			}
+		}
+		if (high && !overloaded) || (low && overloaded) {
+			overloaded = !overloaded
+			// only the goroutine sends so after emptying the buffer there is always room
+			select {
+			case <-s.pressure:
+			default:
+			}
+			s.pressure <- overloaded
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package storage
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/metrics"
+	"github.com/go-kit/kit/metrics/discard"
+	"github.com/murphybytes/gots/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testCounter struct {
+	n *int64
+}
+
+func (c testCounter) With(...string) metrics.Counter { return c }
+func (c testCounter) Add(delta float64)              { atomic.AddInt64(c.n, int64(delta)) }
+
+var overloadPolicyNames = []string{"block", "timeout", "drop-newest", "drop-oldest"}
+
+// stall blocks the only worker of s until the returned function is called.
+func stall(s *storage) func() {
+	started, blocked := make(chan struct{}), make(chan struct{})
+	s.work[0] <- func(w *worker) {
+		close(started)
+		<-blocked
+	}
+	<-started
+	return func() { close(blocked) }
+}
+
+func TestOverloadPolicy(t *testing.T) {
+	base := time.Now()
+	tt := []struct {
+		policy   OverloadPolicy
+		errs     []error
+		expected []int64
+	}{
+		{DropNewest, []error{nil, nil, ErrOverloaded}, []int64{0, 1}},
+		{DropOldest, []error{nil, nil, nil}, []int64{1, 2}},
+		{BlockWritesWithTimeout, []error{nil, nil, ErrOverloaded}, []int64{0, 1}},
+		{BlockWrites, []error{nil, nil, context.DeadlineExceeded}, []int64{0, 1}},
+	}
+	for _, tc := range tt {
+		t.Run(overloadPolicyNames[tc.policy], func(t *testing.T) {
+			var dropped int64
+			s, err := New(Options{
+				MaxAge:            time.Hour,
+				WorkerCount:       1,
+				ChannelBufferSize: 2,
+				MessageCounter:    discard.NewCounter(),
+				OverloadPolicy:    tc.policy,
+				OverloadTimeout:   10 * time.Millisecond,
+				DropCounter:       testCounter{&dropped},
+			})
+			require.Nil(t, err)
+			defer s.Close()
+
+			resume := stall(s)
+			for i, expected := range tc.errs {
+				ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+				assert.Equal(t, expected, s.Write(ctx, "A", base.Add(time.Duration(i)), nil))
+				cancel()
+			}
+			resume()
+
+			elts, err := s.Search(context.Background(), "A", api.NoLowerBound, api.NoUpperBound)
+			require.Nil(t, err)
+			var timestamps []int64
+			for _, elt := range elts {
+				timestamps = append(timestamps, elt.Timestamp-base.UnixNano())
+			}
+			assert.Equal(t, tc.expected, timestamps)
+			if tc.policy != BlockWrites {
+				assert.Equal(t, int64(1), atomic.LoadInt64(&dropped))
+			}
+		})
+	}
+}
+
+func TestDropOldestWaitingWriter(t *testing.T) {
+	s, err := New(Options{
+		MaxAge:            time.Hour,
+		WorkerCount:       1,
+		ChannelBufferSize: 2,
+		MessageCounter:    discard.NewCounter(),
+		OverloadPolicy:    DropOldest,
+	})
+	require.Nil(t, err)
+	defer s.Close()
+
+	resume := stall(s)
+	defer resume()
+	now := time.Now()
+	a, err := s.WriteAdmitted(context.Background(), "A", nil, now, nil)
+	require.Nil(t, err)
+	for i := 1; i <= 2; i++ {
+		require.Nil(t, s.Write(context.Background(), "A", now.Add(time.Duration(i)), nil))
+	}
+	assert.Equal(t, ErrOverloaded, a.Wait(context.Background()))
+}
+
+func TestDropOldestUnbuffered(t *testing.T) {
+	s, err := New(Options{
+		MaxAge:            time.Hour,
+		WorkerCount:       1,
+		ChannelBufferSize: 0,
+		MessageCounter:    discard.NewCounter(),
+		OverloadPolicy:    DropOldest,
+	})
+	require.Nil(t, err)
+
+	// writes wait for the busy worker until their context is done
+	resume := stall(s)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, s.Write(ctx, "A", time.Now(), nil))
+
+	// and a write waiting when storage is closed returns ErrClosed
+	result := make(chan error, 1)
+	go func() {
+		result <- s.Write(context.Background(), "A", time.Now(), nil)
+	}()
+	closed := make(chan struct{})
+	go func() {
+		s.Close()
+		close(closed)
+	}()
+	assert.Equal(t, ErrClosed, <-result)
+	resume()
+	<-closed
+}
+
+func TestDropOldestClosed(t *testing.T) {
+	s, err := New(Options{
+		MaxAge:            time.Hour,
+		WorkerCount:       1,
+		ChannelBufferSize: 2,
+		MessageCounter:    discard.NewCounter(),
+		OverloadPolicy:    DropOldest,
+	})
+	require.Nil(t, err)
+	require.Nil(t, s.Close())
+	for i := 0; i < 4; i++ {
+		assert.Equal(t, ErrClosed, s.Write(context.Background(), "A", time.Now(), nil))
+	}
+}
+
+func TestParseOverloadPolicy(t *testing.T) {
+	for policy, name := range overloadPolicyNames {
+		p, err := ParseOverloadPolicy(name)
+		require.Nil(t, err)
+		assert.Equal(t, OverloadPolicy(policy), p)
+	}
+	_, err := ParseOverloadPolicy("fast")
+	assert.NotNil(t, err)
+}
+
+func TestBackpressure(t *testing.T) {
+	s, err := New(Options{
+		MaxAge:            time.Hour,
+		WorkerCount:       1,
+		ChannelBufferSize: 4,
+		MessageCounter:    discard.NewCounter(),
+	})
+	require.Nil(t, err)
+	defer s.Close()
+
+	resume := stall(s)
+	for i := 0; i < 4; i++ {
+		require.Nil(t, s.Write(context.Background(), "A", time.Now(), nil))
+	}
+	select {
+	case overloaded := <-s.Overloaded():
+		assert.True(t, overloaded)
+	case <-time.After(time.Second):
+		t.Fatal("backpressure was not signalled")
+	}
+
+	resume()
+	select {
+	case overloaded := <-s.Overloaded():
+		assert.False(t, overloaded)
+	case <-time.After(time.Second):
+		t.Fatal("backpressure was not released")
+	}
+}
@@ -0,0 +1,536 @@
+package storage
+
+import (
+	"sort"
+	"time"
+
+	"github.com/murphybytes/gots/api"
+)
+
+// chunk is a fixed capacity block of time ordered elements. Keeping elements in contiguous blocks avoids a heap
+// allocation per element and lets searches and expiration skip whole blocks by looking at min and max.
+type chunk struct {
+	min  int64
+	max  int64
+	elts []api.Element
+	// sealed holds the compressed elements of a full chunk, elts is nil while a chunk is sealed.
+	sealed      []byte
+	sealedCount int
+	// incompressible is set once a chunk is found to hold elements that cannot be compressed.
+	incompressible bool
+}
+
+func newChunk(capacity int) *chunk {
+	return &chunk{elts: make([]api.Element, 0, capacity)}
+}
+
+func (c *chunk) len() int {
+	if c.sealed != nil {
+		return c.sealedCount
+	}
+	return len(c.elts)
+}
+
+// size returns the uncompressed number of bytes used by elements in the chunk.
+func (c *chunk) size() int64 {
+	if c.sealed != nil {
+		return int64(c.sealedCount) * (elementOverhead + gorillaValueSize)
+	}
+	var total int64
+	for i := range c.elts {
+		total += elementSize(c.elts[i])
+	}
+	return total
+}
+
+// elements returns the elements in the chunk, decompressing them if the chunk is sealed.
+func (c *chunk) elements() []api.Element {
+	if c.sealed != nil {
+		return decodeGorilla(c.sealed, c.sealedCount)
+	}
+	return c.elts
+}
+
+// seal compresses the elements in the chunk if possible.
+func (c *chunk) seal() {
+	if c.sealed != nil || c.incompressible {
+		return
+	}
+	if !compressible(c.elts) {
+		c.incompressible = true
+		return
+	}
+	c.sealed = encodeGorilla(c.elts)
+	c.sealedCount = len(c.elts)
+	c.elts = nil
+}
+
+// unseal decompresses a sealed chunk so that it can be modified.
+func (c *chunk) unseal() {
+	if c.sealed == nil {
+		return
+	}
+	c.elts = decodeGorilla(c.sealed, c.sealedCount)
+	c.sealed = nil
+	c.sealedCount = 0
+}
+
+// bounds recalculates min and max after elements have been added or removed.
+func (c *chunk) bounds() {
+	if len(c.elts) == 0 {
+		c.min, c.max = 0, 0
+		return
+	}
+	c.min = c.elts[0].Timestamp
+	c.max = c.elts[len(c.elts)-1].Timestamp
+}
+
+// insertAt places elt at position i, shifting later elements to the right.
+func (c *chunk) insertAt(i int, elt api.Element) {
+	c.elts = append(c.elts, api.Element{})
+	copy(c.elts[i+1:], c.elts[i:])
+	c.elts[i] = elt
+	c.bounds()
+}
+
+// removeFront discards the first n elements while keeping the chunk's backing array.
+func (c *chunk) removeFront(n int) {
+	remaining := copy(c.elts, c.elts[n:])
+	for i := remaining; i < len(c.elts); i++ {
+		c.elts[i] = api.Element{}
+	}
+	c.elts = c.elts[:remaining]
+	c.bounds()
+}
+
+// split moves the upper half of c into a new chunk and returns it.
+func (c *chunk) split(capacity int) *chunk {
+	half := len(c.elts) / 2
+	upper := newChunk(capacity)
+	upper.elts = append(upper.elts, c.elts[half:]...)
+	upper.bounds()
+	c.removeBack(len(c.elts) - half)
+	return upper
+}
+
+// remove discards the elements in positions [lo, hi).
+func (c *chunk) remove(lo, hi int) {
+	remaining := lo + copy(c.elts[lo:], c.elts[hi:])
+	for i := remaining; i < len(c.elts); i++ {
+		c.elts[i] = api.Element{}
+	}
+	c.elts = c.elts[:remaining]
+	c.bounds()
+}
+
+func (c *chunk) removeBack(n int) {
+	remaining := len(c.elts) - n
+	for i := remaining; i < len(c.elts); i++ {
+		c.elts[i] = api.Element{}
+	}
+	c.elts = c.elts[:remaining]
+	c.bounds()
+}
+
+// elementOverhead approximates the memory used by an element apart from its payload.
+const elementOverhead = 32
+
+// elementSize approximates the memory used by an uncompressed element.
+func elementSize(elt api.Element) int64 {
+	return elementOverhead + int64(len(elt.Data))
+}
+
+// series holds the elements for a single key as a list of chunks. Timestamps in a chunk are never greater than the
+// timestamps in the chunk that follows it, so the series as a whole is time ordered.
+type series struct {
+	chunks      []*chunk
+	count       int
+	bytes       int64
+	chunkSize   int
+	compression Compression
+	// maxAge is the retention period for elements in the series.
+	maxAge time.Duration
+	// duplicates decides what happens to elements with the same timestamp as a stored element.
+	duplicates Duplicates
+	// labels describe the series, they are never modified once set.
+	labels Labels
+}
+
+func newSeries(chunkSize int, compression Compression) *series {
+	return &series{chunkSize: chunkSize, compression: compression}
+}
+
+func (s *series) len() int {
+	return s.count
+}
+
+// oldest returns the timestamp of the first element in a series that is not empty.
+func (s *series) oldest() int64 {
+	return s.chunks[0].min
+}
+
+// newest returns the timestamp of the last element in a series that is not empty.
+func (s *series) newest() int64 {
+	return s.chunks[len(s.chunks)-1].max
+}
+
+// elements returns a copy of every element in the series.
+func (s *series) elements() []api.Element {
+	result := make([]api.Element, 0, s.count)
+	for _, c := range s.chunks {
+		result = append(result, c.elements()...)
+	}
+	return result
+}
+
+// insert adds elt to s keeping elements in time order. Elements sharing a timestamp are kept in the order they
+// arrived. Most elements arrive in order, so the chunk that receives elt is located by walking back from the tail.
+// Full chunks other than the tail are sealed if the series is compressed.
+func insert(s *series, elt api.Element) {
+	i := s.add(elt)
+	if s.compression == CompressionNone {
+		return
+	}
+	for j := i - 1; j <= i+1; j++ {
+		if j >= 0 && j < len(s.chunks)-1 && s.chunks[j].len() == s.chunkSize {
+			s.chunks[j].seal()
+		}
+	}
+}
+
+// add inserts elt and returns the index of a chunk next to the chunks that were modified.
+func (s *series) add(elt api.Element) int {
+	s.count++
+	s.bytes += elementSize(elt)
+	if len(s.chunks) == 0 {
+		s.insertChunk(0, elt)
+		return 0
+	}
+
+	i := len(s.chunks) - 1
+	for ; i > 0; i-- {
+		if s.chunks[i].min <= elt.Timestamp {
+			break
+		}
+	}
+	c := s.chunks[i]
+	c.unseal()
+	pos := c.len()
+	for ; pos > 0; pos-- {
+		if c.elts[pos-1].Timestamp <= elt.Timestamp {
+			break
+		}
+	}
+
+	if c.len() < s.chunkSize {
+		c.insertAt(pos, elt)
+		return i
+	}
+
+	// The chunk is full. Elements that belong at either end of it go into a neighbouring or new chunk, anything else
+	// splits the chunk in two.
+	switch {
+	case pos == c.len():
+		if i+1 < len(s.chunks) && s.chunks[i+1].len() < s.chunkSize {
+			s.chunks[i+1].insertAt(0, elt)
+			return i
+		}
+		s.insertChunk(i+1, elt)
+	case pos == 0:
+		if i > 0 && s.chunks[i-1].len() < s.chunkSize {
+			s.chunks[i-1].insertAt(s.chunks[i-1].len(), elt)
+			return i
+		}
+		s.insertChunk(i, elt)
+		i++
+	default:
+		upper := c.split(s.chunkSize)
+		s.chunks = append(s.chunks, nil)
+		copy(s.chunks[i+2:], s.chunks[i+1:])
+		s.chunks[i+1] = upper
+		if pos > c.len() {
+			upper.insertAt(pos-c.len(), elt)
+		} else {
+			c.insertAt(pos, elt)
+		}
+	}
+	return i
+}
+
+// find returns the position of the first element in s with timestamp ts.
+func (s *series) find(ts int64) (position, bool) {
+	if s.len() == 0 || ts < s.oldest() || ts > s.newest() {
+		return position{}, false
+	}
+	decoded := make(decodedChunks)
+	pos := s.lowerBound(ts, decoded)
+	return pos, decoded.take(s, pos.chunk)[pos.elt].Timestamp == ts
+}
+
+// replace overwrites the element at pos with elt, which has the same timestamp.
+func (s *series) replace(pos position, elt api.Element) {
+	c := s.chunks[pos.chunk]
+	c.unseal()
+	s.bytes += elementSize(elt) - elementSize(c.elts[pos.elt])
+	c.elts[pos.elt] = elt
+	if s.compression != CompressionNone && pos.chunk < len(s.chunks)-1 && c.len() == s.chunkSize {
+		c.seal()
+	}
+}
+
+// insertChunk creates a chunk holding elt at index i of the series.
+func (s *series) insertChunk(i int, elt api.Element) {
+	c := newChunk(s.chunkSize)
+	c.insertAt(0, elt)
+	s.chunks = append(s.chunks, nil)
+	copy(s.chunks[i+1:], s.chunks[i:])
+	s.chunks[i] = c
+}
+
+// position identifies an element by chunk and offset within that chunk.
+type position struct {
+	chunk int
+	elt   int
+}
+
+// decodedChunks holds the sealed chunks decoded while a query finds its bounds, so that the query decodes each chunk
+// once. Chunks are keyed by index and a nil decodedChunks keeps nothing.
+type decodedChunks map[int][]api.Element
+
+// elements returns the elements of chunk i of s, decoding a sealed chunk unless it has already been decoded.
+func (d decodedChunks) elements(s *series, i int) []api.Element {
+	if elts, ok := d[i]; ok {
+		return elts
+	}
+	elts := s.chunks[i].elements()
+	if d != nil && s.chunks[i].sealed != nil {
+		d[i] = elts
+	}
+	return elts
+}
+
+// take returns the elements of chunk i of s like elements and forgets them, so that a query walking a range does
+// not hold on to every chunk it reads.
+func (d decodedChunks) take(s *series, i int) []api.Element {
+	if elts, ok := d[i]; ok {
+		delete(d, i)
+		return elts
+	}
+	return s.chunks[i].elements()
+}
+
+// lowerBound returns the position of the first element with a timestamp greater than or equal to ts. If every
+// element is older than ts the position is one past the last chunk. Runs in logarithmic time, decoding at most the
+// chunk holding the position, which is kept in decoded.
+func (s *series) lowerBound(ts int64, decoded decodedChunks) position {
+	i := sort.Search(len(s.chunks), func(i int) bool {
+		return s.chunks[i].max >= ts
+	})
+	if i == len(s.chunks) {
+		return position{chunk: i}
+	}
+	elts := decoded.elements(s, i)
+	j := sort.Search(len(elts), func(j int) bool {
+		return elts[j].Timestamp >= ts
+	})
+	return position{chunk: i, elt: j}
+}
+
+// search returns the elements in s with timestamps in the range [first, last).
+func search(s *series, first, last int64) []api.Element {
+	if s.len() == 0 || first >= last {
+		return nil
+	}
+	decoded := make(decodedChunks)
+	start, end := s.lowerBound(first, decoded), s.lowerBound(last, decoded)
+	if start == end {
+		return nil
+	}
+
+	var count int
+	for i := start.chunk; i <= end.chunk && i < len(s.chunks); i++ {
+		count += s.chunks[i].len()
+	}
+	count -= start.elt
+	if end.chunk < len(s.chunks) {
+		count -= s.chunks[end.chunk].len() - end.elt
+	}
+
+	result := make([]api.Element, 0, count)
+	for i := start.chunk; i <= end.chunk && i < len(s.chunks); i++ {
+		elts := decoded.take(s, i)
+		if i == end.chunk {
+			elts = elts[:end.elt]
+		}
+		if i == start.chunk {
+			elts = elts[start.elt:]
+		}
+		result = append(result, elts...)
+	}
+	return result
+}
+
+// last returns up to n of the newest elements in s in time order. Only the chunks at the tail that hold them are
+// read.
+func (s *series) last(n int) []api.Element {
+	if n > s.count {
+		n = s.count
+	}
+	result := make([]api.Element, n)
+	for i := len(s.chunks) - 1; n > 0; i-- {
+		elts := s.chunks[i].elements()
+		if len(elts) > n {
+			elts = elts[len(elts)-n:]
+		}
+		n -= copy(result[n-len(elts):n], elts)
+	}
+	return result
+}
+
+// lastBefore returns the newest element in s with a timestamp at or before ts. Chunk minimums never decrease along
+// the series so the chunk holding it is found in logarithmic time.
+func (s *series) lastBefore(ts int64) (api.Element, bool) {
+	if s.len() == 0 || s.oldest() > ts {
+		return api.Element{}, false
+	}
+	i := sort.Search(len(s.chunks), func(i int) bool {
+		return s.chunks[i].min > ts
+	})
+	elts := s.chunks[i-1].elements()
+	j := sort.Search(len(elts), func(j int) bool {
+		return elts[j].Timestamp > ts
+	})
+	return elts[j-1], true
+}
+
+// each passes the elements in s with timestamps in the range [first, last) to fn in time order without copying
+// uncompressed chunks.
+func (s *series) each(first, last int64, fn func(api.Element)) {
+	if s.len() == 0 || first >= last {
+		return
+	}
+	decoded := make(decodedChunks)
+	start, end := s.lowerBound(first, decoded), s.lowerBound(last, decoded)
+	for i := start.chunk; i <= end.chunk && i < len(s.chunks); i++ {
+		elts := decoded.take(s, i)
+		if i == end.chunk {
+			elts = elts[:end.elt]
+		}
+		if i == start.chunk {
+			elts = elts[start.elt:]
+		}
+		for _, elt := range elts {
+			fn(elt)
+		}
+	}
+}
+
+// removeFront removes the first n elements from s passing each to fn if it is not nil.
+func (s *series) removeFront(n int, fn func(api.Element)) {
+	if n > s.count {
+		n = s.count
+	}
+	s.count -= n
+	var drop int
+	for ; drop < len(s.chunks) && n >= s.chunks[drop].len(); drop++ {
+		c := s.chunks[drop]
+		n -= c.len()
+		s.bytes -= c.size()
+		if fn != nil {
+			for _, elt := range c.elements() {
+				fn(elt)
+			}
+		}
+	}
+	remaining := copy(s.chunks, s.chunks[drop:])
+	for i := remaining; i < len(s.chunks); i++ {
+		s.chunks[i] = nil
+	}
+	s.chunks = s.chunks[:remaining]
+
+	if n == 0 {
+		return
+	}
+	c := s.chunks[0]
+	c.unseal()
+	for _, elt := range c.elts[:n] {
+		s.bytes -= elementSize(elt)
+		if fn != nil {
+			fn(elt)
+		}
+	}
+	c.removeFront(n)
+}
+
+// removeRange removes the elements of s with timestamps in the range [first, last), passing each to fn if it is not
+// nil, and returns the number of elements removed. Chunks that are emptied are dropped.
+func (s *series) removeRange(first, last int64, fn func(api.Element)) int {
+	if s.len() == 0 || first >= last {
+		return 0
+	}
+	decoded := make(decodedChunks)
+	start, end := s.lowerBound(first, decoded), s.lowerBound(last, decoded)
+	if start == end {
+		return 0
+	}
+
+	var removed int
+	chunks := append(make([]*chunk, 0, len(s.chunks)), s.chunks[:start.chunk]...)
+	for i := start.chunk; i < len(s.chunks); i++ {
+		c := s.chunks[i]
+		lo, hi := 0, c.len()
+		if i == start.chunk {
+			lo = start.elt
+		}
+		if i == end.chunk {
+			hi = end.elt
+		}
+		if i > end.chunk || lo == hi {
+			chunks = append(chunks, c)
+			continue
+		}
+		removed += hi - lo
+		if lo == 0 && hi == c.len() {
+			s.bytes -= c.size()
+			if fn != nil {
+				for _, elt := range decoded.take(s, i) {
+					fn(elt)
+				}
+			}
+			continue
+		}
+		c.unseal()
+		for _, elt := range c.elts[lo:hi] {
+			s.bytes -= elementSize(elt)
+			if fn != nil {
+				fn(elt)
+			}
+		}
+		c.remove(lo, hi)
+		chunks = append(chunks, c)
+	}
+	s.chunks = chunks
+	s.count -= removed
+	return removed
+}
+
+// before returns the number of elements in s with timestamps older than ts.
+func (s *series) before(ts int64) int {
+	pos := s.lowerBound(ts, nil)
+	n := pos.elt
+	for _, c := range s.chunks[:pos.chunk] {
+		n += c.len()
+	}
+	return n
+}
+
+// expire removes elements older than firstTimestamp from the front of s and passes them to onExpire.
+func expire(key string, s *series, firstTimestamp int64, onExpire ExpiryHandler) {
+	var fn func(api.Element)
+	if onExpire != nil {
+		fn = func(elt api.Element) {
+			onExpire(key, elt, Expired)
+		}
+	}
+	s.removeFront(s.before(firstTimestamp), fn)
+}
@@ -0,0 +1,393 @@
+package storage
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/murphybytes/gots/api"
+	"github.com/pkg/errors"
+)
+
+const (
+	snapshotMagic   = "GOTSSNAP"
+	snapshotVersion = 2
+)
+
+// ErrSnapshotDisabled is returned by Snapshot when no snapshot path has been configured.
+var ErrSnapshotDisabled = errors.New("snapshots are not enabled")
+
+// SnapshotOptions configure point in time snapshots of storage.
+type SnapshotOptions struct {
+	// Path of the snapshot file. Snapshots are disabled if Path is empty. If the file exists when storage is created
+	// it is loaded before the write ahead log is replayed.
+	Path string
+	// Interval between snapshots. If zero snapshots are only taken when Snapshot is called.
+	Interval time.Duration
+}
+
+// SourceOffset is the position of the last message written to storage from a partition of an ingestion source such
+// as a Kafka topic.
+type SourceOffset struct {
+	Topic     string
+	Partition int32
+	Offset    int64
+}
+
+// Checkpointer tracks how far ingestion sources have been consumed. Offsets are recorded in snapshots, and recovered
+// from writes logged by SourceWriter, so that when storage is restored sources resume after the last message it
+// holds.
+type Checkpointer interface {
+	// MarkOffset records that the message at offset has been written to storage.
+	MarkOffset(topic string, partition int32, offset int64)
+	// Offset returns the last offset recorded for a partition.
+	Offset(topic string, partition int32) (int64, bool)
+}
+
+// Snapshotter writes a point in time copy of storage to disk.
+type Snapshotter interface {
+	Snapshot(ctx context.Context) (SnapshotInfo, error)
+}
+
+// SnapshotInfo describes a snapshot that has been written.
+type SnapshotInfo struct {
+	Path     string
+	Created  time.Time
+	Series   int
+	Elements int
+	Offsets  []SourceOffset
+}
+
+type topicPartition struct {
+	topic     string
+	partition int32
+}
+
+// offsets is a concurrency safe record of source offsets.
+type offsets struct {
+	sync.Mutex
+	m map[topicPartition]int64
+}
+
+// MarkOffset records that the message at offset has been written to storage.
+func (s *storage) MarkOffset(topic string, partition int32, offset int64) {
+	s.offsets.Lock()
+	s.offsets.m[topicPartition{topic, partition}] = offset
+	s.offsets.Unlock()
+}
+
+// Offset returns the last offset recorded for a partition, either by MarkOffset or by loading a snapshot.
+func (s *storage) Offset(topic string, partition int32) (int64, bool) {
+	s.offsets.Lock()
+	defer s.offsets.Unlock()
+	offset, ok := s.offsets.m[topicPartition{topic, partition}]
+	return offset, ok
+}
+
+func (s *storage) sourceOffsets() []SourceOffset {
+	s.offsets.Lock()
+	defer s.offsets.Unlock()
+	result := make([]SourceOffset, 0, len(s.offsets.m))
+	for tp, offset := range s.offsets.m {
+		result = append(result, SourceOffset{Topic: tp.topic, Partition: tp.partition, Offset: offset})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Topic != result[j].Topic {
+			return result[i].Topic < result[j].Topic
+		}
+		return result[i].Partition < result[j].Partition
+	})
+	return result
+}
+
+// workerSnapshot is a copy of the series held by a worker.
+type workerSnapshot struct {
+	keys   []string
+	labels []Labels
+	series [][]api.Element
+	// walSeq is the first write ahead log segment written after the copy was taken.
+	walSeq uint64
+}
+
+// Snapshot writes the contents of storage to the configured snapshot path. Offsets recorded by MarkOffset are read
+// before any data is copied, so every message up to and including those offsets is in the snapshot. Each worker
+// is copied between operations so the copy of a key is always consistent, although workers are not copied at
+// exactly the same moment.
+func (s *storage) Snapshot(ctx context.Context) (SnapshotInfo, error) {
+	info := SnapshotInfo{
+		Path:    s.opts.Snapshot.Path,
+		Created: time.Now(),
+	}
+	if info.Path == "" {
+		return info, ErrSnapshotDisabled
+	}
+	s.snapshotLock.Lock()
+	defer s.snapshotLock.Unlock()
+
+	info.Offsets = s.sourceOffsets()
+	copies := make([]workerSnapshot, len(s.work))
+	errs := make([]error, len(s.work))
+	for i := range s.work {
+		err := s.do(ctx, i, func(w *worker) {
+			c := &copies[i]
+			for key, ser := range w.data {
+				c.keys = append(c.keys, key)
+				c.labels = append(c.labels, ser.labels)
+				c.series = append(c.series, ser.elements())
+			}
+			if w.log != nil {
+				// New writes go to a new segment so that recovery can skip segments covered by the snapshot.
+				errs[i] = w.log.rotate()
+				c.walSeq = w.log.seq
+			}
+		})
+		if err != nil {
+			return info, err
+		}
+	}
+	for _, err := range errs {
+		if err != nil {
+			return info, err
+		}
+	}
+
+	for _, c := range copies {
+		info.Series += len(c.keys)
+		for _, elts := range c.series {
+			info.Elements += len(elts)
+		}
+	}
+	return info, writeSnapshot(info, copies)
+}
+
+// writeSnapshot writes to a temporary file which replaces the snapshot once it is complete.
+func writeSnapshot(info SnapshotInfo, copies []workerSnapshot) (err error) {
+	tmp := info.Path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return errors.Wrap(err, "creating snapshot")
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(tmp)
+		}
+	}()
+
+	crc := crc32.New(walTable)
+	buf := bufio.NewWriter(f)
+	w := &snapshotWriter{w: io.MultiWriter(buf, crc)}
+	w.bytes([]byte(snapshotMagic))
+	w.uvarint(snapshotVersion)
+	w.varint(info.Created.UnixNano())
+	w.uvarint(uint64(len(info.Offsets)))
+	for _, o := range info.Offsets {
+		w.bytes([]byte(o.Topic))
+		w.varint(int64(o.Partition))
+		w.varint(o.Offset)
+	}
+	w.uvarint(uint64(len(copies)))
+	for i, c := range copies {
+		w.uvarint(uint64(i))
+		w.uvarint(c.walSeq)
+	}
+	for _, c := range copies {
+		for i, key := range c.keys {
+			w.uvarint(1)
+			w.bytes([]byte(key))
+			labels := c.labels[i]
+			w.uvarint(uint64(len(labels)))
+			for _, name := range labels.names() {
+				w.bytes([]byte(name))
+				w.bytes([]byte(labels[name]))
+			}
+			w.uvarint(uint64(len(c.series[i])))
+			for _, elt := range c.series[i] {
+				w.varint(elt.Timestamp)
+				w.bytes(elt.Data)
+			}
+		}
+	}
+	w.uvarint(0)
+	if w.err != nil {
+		return errors.Wrap(w.err, "writing snapshot")
+	}
+	if err = binary.Write(buf, binary.LittleEndian, crc.Sum32()); err != nil {
+		return errors.Wrap(err, "writing snapshot")
+	}
+	if err = buf.Flush(); err != nil {
+		return errors.Wrap(err, "writing snapshot")
+	}
+	if err = f.Sync(); err != nil {
+		return errors.Wrap(err, "syncing snapshot")
+	}
+	if err = f.Close(); err != nil {
+		return errors.Wrap(err, "closing snapshot")
+	}
+	if err = os.Rename(tmp, info.Path); err != nil {
+		return errors.Wrap(err, "replacing snapshot")
+	}
+	if dir, e := os.Open(filepath.Dir(info.Path)); e == nil {
+		dir.Sync()
+		dir.Close()
+	}
+	return nil
+}
+
+// snapshotWriter writes length prefixed values, remembering the first error.
+type snapshotWriter struct {
+	w       io.Writer
+	err     error
+	scratch [binary.MaxVarintLen64]byte
+}
+
+func (w *snapshotWriter) write(p []byte) {
+	if w.err == nil {
+		_, w.err = w.w.Write(p)
+	}
+}
+
+func (w *snapshotWriter) uvarint(v uint64) {
+	w.write(w.scratch[:binary.PutUvarint(w.scratch[:], v)])
+}
+
+func (w *snapshotWriter) varint(v int64) {
+	w.write(w.scratch[:binary.PutVarint(w.scratch[:], v)])
+}
+
+func (w *snapshotWriter) bytes(p []byte) {
+	w.uvarint(uint64(len(p)))
+	w.write(p)
+}
+
+// snapshotReader reads values written by snapshotWriter, remembering the first error.
+type snapshotReader struct {
+	r   *bufio.Reader
+	crc hash.Hash32
+	err error
+}
+
+func (r *snapshotReader) ReadByte() (byte, error) {
+	b, err := r.r.ReadByte()
+	if err == nil {
+		r.crc.Write([]byte{b})
+	}
+	return b, err
+}
+
+func (r *snapshotReader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	var v uint64
+	v, r.err = binary.ReadUvarint(r)
+	return v
+}
+
+func (r *snapshotReader) varint() int64 {
+	if r.err != nil {
+		return 0
+	}
+	var v int64
+	v, r.err = binary.ReadVarint(r)
+	return v
+}
+
+func (r *snapshotReader) bytes() []byte {
+	n := r.uvarint()
+	if r.err != nil || n == 0 {
+		return nil
+	}
+	p := make([]byte, n)
+	if _, r.err = io.ReadFull(r.r, p); r.err == nil {
+		r.crc.Write(p)
+	}
+	return p
+}
+
+// loadSnapshot reads the snapshot into workers. It returns the write ahead log segment that each worker started
+// after the snapshot was taken, keyed by worker index. Elements that have expired since the snapshot was taken are
+// skipped.
+func (s *storage) loadSnapshot(workers []*worker) (map[int]uint64, error) {
+	f, err := os.Open(s.opts.Snapshot.Path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "opening snapshot")
+	}
+	defer f.Close()
+
+	r := &snapshotReader{r: bufio.NewReader(f), crc: crc32.New(walTable)}
+	if magic := r.bytes(); string(magic) != snapshotMagic {
+		return nil, errors.New("file is not a snapshot")
+	}
+	// version 1 snapshots do not hold labels
+	version := r.uvarint()
+	if r.err == nil && version != 1 && version != snapshotVersion {
+		return nil, errors.Errorf("unsupported snapshot version %d", version)
+	}
+	r.varint()
+
+	loaded := make(map[topicPartition]int64)
+	for n := r.uvarint(); n > 0 && r.err == nil; n-- {
+		topic := string(r.bytes())
+		partition := int32(r.varint())
+		loaded[topicPartition{topic, partition}] = r.varint()
+	}
+	walSeqs := make(map[int]uint64)
+	for n := r.uvarint(); n > 0 && r.err == nil; n-- {
+		i := int(r.uvarint())
+		walSeqs[i] = r.uvarint()
+	}
+
+	now := time.Now().UnixNano()
+	for r.uvarint() == 1 && r.err == nil {
+		key := string(r.bytes())
+		var labels Labels
+		if version > 1 {
+			for n := r.uvarint(); n > 0 && r.err == nil; n-- {
+				if labels == nil {
+					labels = make(Labels)
+				}
+				name := string(r.bytes())
+				labels[name] = string(r.bytes())
+			}
+		}
+		w := workers[s.calculateWorkerPartition(key)]
+		cutOff := now - int64(s.opts.maxAgeFor(key))
+		for n := r.uvarint(); n > 0 && r.err == nil; n-- {
+			elt := api.Element{Timestamp: r.varint(), Data: r.bytes()}
+			if r.err == nil && elt.Timestamp >= cutOff {
+				s.insert(w, key, elt)
+			}
+		}
+		w.label(key, labels)
+	}
+	if r.err != nil {
+		return nil, errors.Wrap(r.err, "reading snapshot")
+	}
+	expected := r.crc.Sum32()
+	var actual uint32
+	if err := binary.Read(r.r, binary.LittleEndian, &actual); err != nil {
+		return nil, errors.Wrap(err, "reading snapshot")
+	}
+	if actual != expected {
+		return nil, errors.New("snapshot checksum does not match")
+	}
+
+	s.offsets.Lock()
+	for tp, offset := range loaded {
+		s.offsets.m[tp] = offset
+	}
+	s.offsets.Unlock()
+	return walSeqs, nil
+}
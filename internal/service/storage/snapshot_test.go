@@ -0,0 +1,198 @@
+package storage
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/metrics/discard"
+	"github.com/murphybytes/gots/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSnapshotRestore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gots-snapshot")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	now := time.Now()
+	expected := map[string][]api.Element{}
+	write := func(stg *storage, key string, ts time.Time) {
+		stg.Write(context.Background(), key, ts, []byte(key))
+		expected[key] = append(expected[key], api.Element{Timestamp: ts.UnixNano(), Data: []byte(key)})
+	}
+
+	stg, err := New(testOptions(4, withSnapshot(dir)))
+	require.Nil(t, err)
+	for i := 0; i < 20; i++ {
+		write(stg, "A", now.Add(time.Duration(i)*time.Millisecond))
+		write(stg, "B", now.Add(time.Duration(i)*time.Millisecond))
+	}
+	stg.MarkOffset("prices", 3, 41)
+	info, err := stg.Snapshot(context.Background())
+	require.Nil(t, err)
+	assert.Equal(t, 2, info.Series)
+	assert.Equal(t, 40, info.Elements)
+	assert.Equal(t, []SourceOffset{{Topic: "prices", Partition: 3, Offset: 41}}, info.Offsets)
+
+	// writes after the snapshot are recovered from the write ahead log
+	for i := 20; i < 30; i++ {
+		write(stg, "A", now.Add(time.Duration(i)*time.Millisecond))
+		write(stg, "C", now.Add(time.Duration(i)*time.Millisecond))
+	}
+	for key := range expected {
+		_, err = stg.Search(context.Background(), key, api.NoLowerBound, api.NoUpperBound)
+		require.Nil(t, err)
+	}
+	require.Nil(t, stg.Close())
+
+	for _, workers := range []int{4, 3} {
+		stg, err = New(testOptions(workers, withSnapshot(dir)))
+		require.Nil(t, err)
+		for key, elts := range expected {
+			actual, err := stg.Search(context.Background(), key, api.NoLowerBound, api.NoUpperBound)
+			require.Nil(t, err)
+			assert.Equal(t, elts, actual, key)
+		}
+		offset, ok := stg.Offset("prices", 3)
+		assert.True(t, ok)
+		assert.Equal(t, int64(41), offset)
+		_, ok = stg.Offset("prices", 4)
+		assert.False(t, ok)
+		require.Nil(t, stg.Close())
+	}
+}
+
+func TestSnapshotCorrupt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gots-snapshot")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	opts := Options{
+		MaxAge:            time.Hour,
+		WorkerCount:       2,
+		ChannelBufferSize: DefaultChannelBufferSize,
+		MessageCounter:    discard.NewCounter(),
+		Snapshot:          SnapshotOptions{Path: filepath.Join(dir, "snapshot")},
+	}
+	stg, err := New(opts)
+	require.Nil(t, err)
+	stg.Write(context.Background(), "A", time.Now(), []byte("hello"))
+	_, err = stg.Snapshot(context.Background())
+	require.Nil(t, err)
+	require.Nil(t, stg.Close())
+
+	contents, err := ioutil.ReadFile(opts.Snapshot.Path)
+	require.Nil(t, err)
+	contents[len(contents)-6] ^= 0xff
+	require.Nil(t, ioutil.WriteFile(opts.Snapshot.Path, contents, 0644))
+	_, err = New(opts)
+	assert.Error(t, err)
+}
+
+func TestSnapshotDisabled(t *testing.T) {
+	stg, err := New(Options{
+		MaxAge:            time.Hour,
+		WorkerCount:       1,
+		ChannelBufferSize: DefaultChannelBufferSize,
+		MessageCounter:    discard.NewCounter(),
+	})
+	require.Nil(t, err)
+	defer stg.Close()
+	_, err = stg.Snapshot(context.Background())
+	assert.Equal(t, ErrSnapshotDisabled, err)
+}
+
+func TestSnapshotWALSourceOffsets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gots-snapshot")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	now := time.Now()
+	// message i of partition 0 holds an element for A and, before message 19, one for B
+	consume := func(stg *storage, first, last int64) {
+		for i := first; i <= last; i++ {
+			src := SourceOffset{Topic: "prices", Partition: 0, Offset: i}
+			ts := now.Add(time.Duration(i) * time.Millisecond)
+			require.Nil(t, stg.WriteSource(context.Background(), src, "A", nil, ts, nil))
+			if i < 19 {
+				require.Nil(t, stg.WriteSource(context.Background(), src, "B", nil, ts, nil))
+			}
+			stg.MarkOffset(src.Topic, src.Partition, src.Offset)
+		}
+	}
+
+	stg, err := New(testOptions(4, withSnapshot(dir)))
+	require.Nil(t, err)
+	consume(stg, 0, 9)
+	_, err = stg.Snapshot(context.Background())
+	require.Nil(t, err)
+	consume(stg, 10, 19)
+	// reads wait for the writes queued before them, so every write is logged before closing
+	for _, key := range []string{"A", "B"} {
+		_, err = stg.Last(context.Background(), key, 1)
+		require.Nil(t, err)
+	}
+	require.Nil(t, stg.Close())
+
+	// the last message with every write recovered is 19 if A and B share a worker and otherwise 18, as the log of
+	// B's worker ends with message 18
+	expected := int64(18)
+	if stg.calculateWorkerPartition("A") == stg.calculateWorkerPartition("B") {
+		expected = 19
+	}
+
+	// the source resumes after the recovered offset and every message is stored once
+	stg, err = New(testOptions(4, withSnapshot(dir)))
+	require.Nil(t, err)
+	defer stg.Close()
+	offset, ok := stg.Offset("prices", 0)
+	require.True(t, ok)
+	assert.Equal(t, expected, offset)
+	consume(stg, offset+1, 19)
+	for key, count := range map[string]int{"A": 20, "B": 19} {
+		elts, err := stg.Search(context.Background(), key, api.NoLowerBound, api.NoUpperBound)
+		require.Nil(t, err)
+		assert.Len(t, elts, count, key)
+		for i, elt := range elts {
+			assert.Equal(t, now.Add(time.Duration(i)*time.Millisecond).UnixNano(), elt.Timestamp, key)
+		}
+	}
+}
+
+func TestSnapshotSourceOffsetsWithoutWAL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gots-snapshot")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	opts := testOptions(4)
+	opts.Snapshot = SnapshotOptions{Path: filepath.Join(dir, "snapshot")}
+
+	now := time.Now()
+	stg, err := New(opts)
+	require.Nil(t, err)
+	for i := int64(0); i < 20; i++ {
+		src := SourceOffset{Topic: "prices", Partition: 0, Offset: i}
+		require.Nil(t, stg.WriteSource(context.Background(), src, "A", nil, now.Add(time.Duration(i)), nil))
+		stg.MarkOffset(src.Topic, src.Partition, src.Offset)
+		if i == 9 {
+			_, err = stg.Snapshot(context.Background())
+			require.Nil(t, err)
+		}
+	}
+	require.Nil(t, stg.Close())
+
+	// only the snapshot restores the offset, so the source resumes after the last message it holds
+	stg, err = New(opts)
+	require.Nil(t, err)
+	defer stg.Close()
+	offset, ok := stg.Offset("prices", 0)
+	require.True(t, ok)
+	assert.Equal(t, int64(9), offset)
+	elts, err := stg.Search(context.Background(), "A", api.NoLowerBound, api.NoUpperBound)
+	require.Nil(t, err)
+	assert.Len(t, elts, 10)
+}
@@ -4,13 +4,16 @@
 package storage
 
 import (
-	"container/list"
+	"context"
 	"io"
+	"strconv"
 	"sync"
 	"time"
 
 	"github.com/OneOfOne/xxhash"
+	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/metrics"
+	"github.com/go-kit/kit/metrics/discard"
 	"github.com/murphybytes/gots/api"
 )
 
@@ -23,221 +26,687 @@ const (
 	DefaultWorkerCount = 256
 	// DefaultChannelBufferSize is the default buffer size for work channels
 	DefaultChannelBufferSize = 100
+	// DefaultChunkSize is the default number of elements held in each block of a series
+	DefaultChunkSize = 512
 )
 
-// Writer this that write time series data associated with key at time ts.
+// Writer this that write time series data associated with key at time ts. Write returns once the element is queued
+// for its worker, or with ctx.Err() or ErrClosed if it could not be queued. If the queue is full the OverloadPolicy
+// decides whether Write waits or the element is dropped with ErrOverloaded.
 type Writer interface {
-	Write(key string, ts time.Time, data []byte)
+	Write(ctx context.Context, key string, ts time.Time, data []byte) error
+	// WriteLabels writes like Write and replaces the labels of the series with labels. Empty labels leave the labels
+	// of the series unchanged.
+	WriteLabels(ctx context.Context, key string, labels Labels, ts time.Time, data []byte) error
+}
+
+// AdmittedWriter writes elements for callers that report whether each element was stored, such as the write
+// endpoints.
+type AdmittedWriter interface {
+	// WriteAdmitted queues an element like WriteLabels and returns an Admission that waits for the worker to decide
+	// whether it is stored. Callers queue many elements before waiting so that the workers decide on them together.
+	WriteAdmitted(ctx context.Context, key string, labels Labels, ts time.Time, data []byte) (Admission, error)
+}
+
+// Admission is the pending outcome of a write queued by WriteAdmitted.
+type Admission struct {
+	result <-chan error
+	closed <-chan struct{}
+}
+
+// Wait returns nil once the element is stored and ErrRejected if it is not. ErrOverloaded is returned if DropOldest
+// discarded the element while it was queued.
+func (a Admission) Wait(ctx context.Context) error {
+	select {
+	case err := <-a.result:
+		return err
+	default:
+	}
+	select {
+	case err := <-a.result:
+		return err
+	case <-a.closed:
+		return ErrClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// SourceWriter writes elements read from a partition of an ingestion source. The position of the message is logged
+// with the element so that, after a restart, the source resumes after the last message recovered from the write
+// ahead log and no message is stored twice.
+type SourceWriter interface {
+	WriteSource(ctx context.Context, src SourceOffset, key string, labels Labels, ts time.Time, data []byte) error
 }
 
 // Searcher returns time series elements associated with key between first and last times. Times are represented
-// as the number of nanoseconds since January 1, 1970 UTC.
+// as the number of nanoseconds since January 1, 1970 UTC. Last returns the n newest elements of a series and
+// LastBefore the newest element at or before a time, both without scanning the series. Candles summarises trades
+// into open, high, low, close and volume bars.
 type Searcher interface {
-	Search(key string, first, last uint64) ([]api.Element, error)
+	Search(ctx context.Context, key string, first, last uint64) ([]api.Element, error)
+	Last(ctx context.Context, key string, n int) ([]api.Element, error)
+	LastBefore(ctx context.Context, key string, ts uint64) (api.Element, error)
+	Candles(ctx context.Context, req CandleRequest) ([]Candle, error)
 }
 
-// Manager contains Search, Write and Close.
+// Manager contains Search, MultiSearch, SearchLabels, Aggregate, Write, Delete, Subscribe, ListKeys, Snapshot,
+// Cardinality and Close. Every
+// operation returns ctx.Err() if ctx is done, or ErrClosed if storage is closed, before it completes.
 type Manager interface {
 	io.Closer
 	Searcher
+	MultiSearcher
+	LabelSearcher
+	Aggregator
 	Writer
+	AdmittedWriter
+	Deleter
+	Subscriber
+	KeyLister
+	Snapshotter
+	CardinalityReporter
 }
 
 // ExpiryHandler is a callback that will receive time series elements when they expire.  This can be used
-// to aggregate and persist old elements.
-type ExpiryHandler func(key string, elt api.Element)
+// to aggregate and persist old elements. Reason describes why the element was removed.
+type ExpiryHandler func(key string, elt api.Element, reason ExpiryReason)
+
+// ExpiryReason explains why an element was removed from storage.
+type ExpiryReason int
+
+const (
+	// Expired elements were older than the maximum age.
+	Expired ExpiryReason = iota
+	// Evicted elements were removed to keep storage within its memory limits.
+	Evicted
+	// Deleted elements were removed by DeleteSeries or DeleteRange.
+	Deleted
+)
+
+func (r ExpiryReason) String() string {
+	switch r {
+	case Expired:
+		return "expired"
+	case Evicted:
+		return "evicted"
+	case Deleted:
+		return "deleted"
+	}
+	return "unknown"
+}
 
 // Element storage is optimized for inserts
-type elementMap map[string]*list.List
-type operation func(data elementMap)
+type elementMap map[string]*series
+
+// worker is the state owned by a single storage goroutine. Operations run on the goroutine that owns the worker so
+// no locking is required.
+type worker struct {
+	data elementMap
+	// index finds the keys of series by their labels.
+	index labelIndex
+	// limiter is shared by every worker and counts the series they create.
+	limiter *seriesLimiter
+	// bytes approximates the memory used by uncompressed elements in data.
+	bytes int64
+	// log is the worker's write ahead log, nil if the log is disabled.
+	log *wal
+	// subscriptions receive elements written to the worker's keys.
+	subscriptions []*Subscription
+}
+
+type operation func(w *worker)
 
 type storage struct {
 	wait  sync.WaitGroup
 	close chan struct{}
 	work  []chan operation
-	opts  Options
+	// writes are queued separately from other operations so that the overload policy only ever discards writes.
+	writes       []chan pendingWrite
+	queueDepth   []metrics.Gauge
+	dropped      []metrics.Counter
+	pressure     chan bool
+	opts         Options
+	logger       log.Logger
+	offsets      offsets
+	snapshotLock sync.Mutex
+	closeOnce    sync.Once
+	limiter      *seriesLimiter
+	// lateCounter, duplicateCounter, seriesLimitCounter and seriesRateCounter count rejected writes.
+	lateCounter        metrics.Counter
+	duplicateCounter   metrics.Counter
+	seriesLimitCounter metrics.Counter
+	seriesRateCounter  metrics.Counter
 }
 
 // Options for storage of time series.
 type Options struct {
-	// MaxAge time series elements older than this will be discarded.
+	// MaxAge time series elements older than this will be discarded unless the key is matched by one of the
+	// RetentionPolicies.
 	MaxAge time.Duration
+	// RetentionPolicies sets the maximum age for particular keys. The first matching policy is used.
+	RetentionPolicies []RetentionPolicy
 	// WorkerCount is the number of goroutines that process incoming messages.
 	WorkerCount int
 	// ChannelBufferSize is the number of jobs that can be buffered in the jobs channel to improve throughput and async processing.
+	// Each worker also has a queue of this size for writes.
 	ChannelBufferSize int
+	// OverloadPolicy decides what Write does when the write queue of a worker is full.
+	OverloadPolicy OverloadPolicy
+	// OverloadTimeout is how long BlockWritesWithTimeout waits for room. Defaults to DefaultOverloadTimeout.
+	OverloadTimeout time.Duration
+	// QueueDepth is set to the number of writes waiting for each worker, labelled by "worker".
+	QueueDepth metrics.Gauge
+	// DropCounter keeps tally of elements discarded by the OverloadPolicy, labelled by "worker".
+	DropCounter metrics.Counter
 	// OnExpire is an optional method that is called when a time series element expires. This could be used to
 	// aggregate expiring elements into courser granularity or to write to persistent storage.
 	OnExpire ExpiryHandler
+	// NotifyDeletes passes elements removed by DeleteSeries and DeleteRange to OnExpire.
+	NotifyDeletes bool
 	// MessageCounter keeps tally of the number of messages that have arrived.
 	MessageCounter metrics.Counter
+	// ChunkSize is the number of elements stored in each contiguous block of a series. Defaults to DefaultChunkSize.
+	ChunkSize int
+	// Compression is applied to full chunks of series that are not matched by CompressionPolicies.
+	Compression Compression
+	// CompressionPolicies selects compression for particular keys. The first matching policy is used.
+	CompressionPolicies []CompressionPolicy
+	// Duplicates decides what happens to elements with the same timestamp as a stored element of keys that are not
+	// matched by DuplicatePolicies.
+	Duplicates Duplicates
+	// DuplicatePolicies selects the handling of duplicates for particular keys. The first matching policy is used.
+	DuplicatePolicies []DuplicatePolicy
+	// MaxLateness rejects elements older than the newest element of their series by more than this. Zero means
+	// elements are accepted however late they are.
+	MaxLateness time.Duration
+	// MaxSeries limits the number of series held. Zero means there is no limit.
+	MaxSeries int
+	// MaxNewSeriesPerSecond limits the rate at which series are created. Zero means there is no limit.
+	MaxNewSeriesPerSecond float64
+	// SeriesLimits apply further limits to particular keys. The first matching limit is used, along with MaxSeries
+	// and MaxNewSeriesPerSecond.
+	SeriesLimits []SeriesLimit
+	// RejectCounter keeps tally of elements rejected by MaxLateness, RejectDuplicates or the series limits,
+	// labelled by "reason" which is late, duplicate, series_limit or series_rate.
+	RejectCounter metrics.Counter
+	// MaxBytes limits the memory used by elements, measured as if they were uncompressed. When exceeded elements
+	// are evicted according to EvictionPolicy. Zero means there is no limit.
+	MaxBytes int64
+	// MaxElementsPerKey limits the number of elements kept for a key, the oldest elements are evicted first. Zero
+	// means there is no limit.
+	MaxElementsPerKey int
+	// EvictionPolicy chooses the elements that are removed when MaxBytes is exceeded.
+	EvictionPolicy EvictionPolicy
+	// EvictionCounter keeps tally of the number of elements that have been evicted.
+	EvictionCounter metrics.Counter
+	// WAL configures an optional write ahead log that is replayed when storage is created.
+	WAL WALOptions
+	// Snapshot configures optional point in time snapshots that are loaded when storage is created.
+	Snapshot SnapshotOptions
+	// SubscriberBufferSize is the number of elements buffered for each subscription. Defaults to
+	// DefaultSubscriberBufferSize.
+	SubscriberBufferSize int
+	// SlowSubscriberPolicy decides what happens to subscriptions whose buffer is full.
+	SlowSubscriberPolicy SlowSubscriberPolicy
+	// Logger receives storage errors that cannot be returned to a caller. Nothing is logged if Logger is nil.
+	Logger log.Logger
+}
+
+// compressionFor returns the compression scheme used for a key.
+func (o *Options) compressionFor(key string) Compression {
+	for _, p := range o.CompressionPolicies {
+		if p.Keys.Match(key) {
+			return p.Compression
+		}
+	}
+	return o.Compression
+}
+
+// duplicatesFor returns the handling of duplicates for a key.
+func (o *Options) duplicatesFor(key string) Duplicates {
+	for _, p := range o.DuplicatePolicies {
+		if p.Keys.Match(key) {
+			return p.Duplicates
+		}
+	}
+	return o.Duplicates
 }
 
-// New creates in memory storage for time series data.
-func New(opts Options) *storage {
+// maxAgeFor returns how long elements are kept for a key.
+func (o *Options) maxAgeFor(key string) time.Duration {
+	for _, p := range o.RetentionPolicies {
+		if p.Keys.Match(key) {
+			return p.MaxAge
+		}
+	}
+	return o.MaxAge
+}
+
+// maxRetention returns the longest time any element is kept.
+func (o *Options) maxRetention() time.Duration {
+	longest := o.MaxAge
+	for _, p := range o.RetentionPolicies {
+		if p.MaxAge > longest {
+			longest = p.MaxAge
+		}
+	}
+	return longest
+}
+
+// New creates in memory storage for time series data. If a snapshot exists it is loaded, and if a write ahead log is
+// configured it is replayed, before New returns.
+func New(opts Options) (*storage, error) {
+	if opts.ChunkSize <= 0 {
+		opts.ChunkSize = DefaultChunkSize
+	}
+	if opts.EvictionCounter == nil {
+		opts.EvictionCounter = discard.NewCounter()
+	}
+	if opts.Logger == nil {
+		opts.Logger = log.NewNopLogger()
+	}
+	if opts.WAL.SegmentSize <= 0 {
+		opts.WAL.SegmentSize = DefaultWALSegmentSize
+	}
+	if opts.WAL.SyncInterval <= 0 {
+		opts.WAL.SyncInterval = DefaultWALSyncInterval
+	}
+	if opts.SubscriberBufferSize <= 0 {
+		opts.SubscriberBufferSize = DefaultSubscriberBufferSize
+	}
+	if opts.OverloadTimeout <= 0 {
+		opts.OverloadTimeout = DefaultOverloadTimeout
+	}
+	if opts.QueueDepth == nil {
+		opts.QueueDepth = discard.NewGauge()
+	}
+	if opts.DropCounter == nil {
+		opts.DropCounter = discard.NewCounter()
+	}
+	if opts.RejectCounter == nil {
+		opts.RejectCounter = discard.NewCounter()
+	}
 	s := &storage{
-		close: make(chan struct{}),
-		opts:  opts,
+		close:    make(chan struct{}),
+		pressure: make(chan bool, 1),
+		opts:     opts,
+		logger:   log.With(opts.Logger, "component", "storage"),
+		offsets:  offsets{m: make(map[topicPartition]int64)},
+		limiter:  newSeriesLimiter(opts.MaxSeries, opts.MaxNewSeriesPerSecond, opts.SeriesLimits),
+
+		lateCounter:        opts.RejectCounter.With("reason", "late"),
+		duplicateCounter:   opts.RejectCounter.With("reason", "duplicate"),
+		seriesLimitCounter: opts.RejectCounter.With("reason", "series_limit"),
+		seriesRateCounter:  opts.RejectCounter.With("reason", "series_rate"),
+	}
+
+	workers := make([]*worker, opts.WorkerCount)
+	for i := range workers {
+		workers[i] = &worker{data: make(elementMap), index: make(labelIndex), limiter: s.limiter}
+	}
+	var walSeqs map[int]uint64
+	if opts.Snapshot.Path != "" {
+		var err error
+		if walSeqs, err = s.loadSnapshot(workers); err != nil {
+			return nil, err
+		}
+	}
+	if opts.WAL.Dir != "" {
+		if err := s.recover(workers, walSeqs); err != nil {
+			for _, w := range workers {
+				if w.log != nil {
+					w.log.close()
+				}
+			}
+			return nil, err
+		}
 	}
+
 	s.work = make([]chan operation, opts.WorkerCount)
+	s.writes = make([]chan pendingWrite, opts.WorkerCount)
+	s.queueDepth = make([]metrics.Gauge, opts.WorkerCount)
+	s.dropped = make([]metrics.Counter, opts.WorkerCount)
 	s.wait.Add(opts.WorkerCount)
 
 	for i := 0; i < opts.WorkerCount; i++ {
 		s.work[i] = make(chan operation, opts.ChannelBufferSize)
-		go func(work <-chan operation, close <-chan struct{}) {
+		s.writes[i] = make(chan pendingWrite, opts.ChannelBufferSize)
+		s.queueDepth[i] = opts.QueueDepth.With("worker", strconv.Itoa(i))
+		s.dropped[i] = opts.DropCounter.With("worker", strconv.Itoa(i))
+		go func(w *worker, work <-chan operation, writes <-chan pendingWrite, close <-chan struct{}) {
 			defer s.wait.Done()
+			defer func() {
+				for _, sub := range w.subscriptions {
+					sub.Close()
+				}
+			}()
 			ticker := time.Tick(expirationFrequency)
-			data := make(elementMap)
+			var syncTicker <-chan time.Time
+			if w.log != nil {
+				defer func() {
+					s.logWALError(w.log.close())
+				}()
+				if opts.WAL.Sync != SyncAlways {
+					t := time.NewTicker(opts.WAL.SyncInterval)
+					defer t.Stop()
+					syncTicker = t.C
+				}
+			}
 			for {
 				select {
 				case <-close:
 					return
+				case pw := <-writes:
+					s.apply(w, pw)
 				case job := <-work:
-					job(data)
+					// writes queued before the job are applied first so that callers see their own writes
+					s.drain(w, writes)
+					job(w)
 				case <-ticker:
-					cutOff := time.Now().Add(-1 * opts.MaxAge).UnixNano()
-					expireOldElements(data, cutOff, opts.OnExpire)
+					now := time.Now().UnixNano()
+					w.expire(now, opts.OnExpire)
+					w.pruneSubscriptions()
+					if w.log != nil {
+						s.logWALError(w.log.truncate(now - int64(opts.maxRetention())))
+					}
+				case <-syncTicker:
+					s.logWALError(w.log.sync())
+				}
+			}
+		}(workers[i], s.work[i], s.writes[i], s.close)
+	}
+
+	s.wait.Add(1)
+	go s.monitorQueues()
+
+	if opts.Snapshot.Path != "" && opts.Snapshot.Interval > 0 {
+		s.wait.Add(1)
+		go func() {
+			defer s.wait.Done()
+			ticker := time.NewTicker(opts.Snapshot.Interval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-s.close:
+					return
+				case <-ticker.C:
+					if _, err := s.Snapshot(context.Background()); err != nil {
+						s.logger.Log("msg", "snapshot failed", "err", err)
+					}
 				}
 			}
-		}(s.work[i], s.close)
+		}()
+	}
+	return s, nil
+
+}
+
+func (s *storage) logWALError(err error) {
+	if err != nil {
+		s.logger.Log("msg", "write ahead log failure", "err", err)
+	}
+}
+
+// submit queues op for the worker that owns partition.
+func (s *storage) submit(ctx context.Context, partition int, op operation) error {
+	// a closed storage may still have room in its work channels, so check before trying to send
+	select {
+	case <-s.close:
+		return ErrClosed
+	default:
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	select {
+	case s.work[partition] <- op:
+		return nil
+	case <-s.close:
+		return ErrClosed
+	case <-ctx.Done():
+		return ctx.Err()
 	}
-	return s
+}
 
+// do runs op on the worker that owns partition and waits for it to finish. Results should be passed back on
+// buffered channels so that op never blocks when do has already returned an error.
+func (s *storage) do(ctx context.Context, partition int, op operation) error {
+	done := make(chan struct{})
+	err := s.submit(ctx, partition, func(w *worker) {
+		defer close(done)
+		op(w)
+	})
+	if err != nil {
+		return err
+	}
+	select {
+	case <-done:
+		return nil
+	case <-s.close:
+		return ErrClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 // Write adds an element to the time series for a key.
-func (s *storage) Write(key string, ts time.Time, data []byte) {
-	s.opts.MessageCounter.Add(1)
-	newElt := api.Element{Timestamp: ts.UnixNano(), Data: data}
-	partition := s.calculateWorkerPartition(key)
-	s.work[partition] <- func(elts elementMap) {
-		var (
-			pl    *list.List
-			found bool
-		)
-		if pl, found = elts[key]; !found {
-			pl = new(list.List)
-			pl.PushBack(newElt)
-			elts[key] = pl
+func (s *storage) Write(ctx context.Context, key string, ts time.Time, data []byte) error {
+	return s.WriteLabels(ctx, key, nil, ts, data)
+}
+
+// WriteLabels adds an element to the time series for a key and sets the labels of the series.
+func (s *storage) WriteLabels(ctx context.Context, key string, labels Labels, ts time.Time, data []byte) error {
+	return s.write(ctx, pendingWrite{key: key, labels: labels.copy(), elt: api.Element{Timestamp: ts.UnixNano(), Data: data}})
+}
+
+// WriteSource writes like WriteLabels and logs src, the position of the message the element was read from.
+func (s *storage) WriteSource(ctx context.Context, src SourceOffset, key string, labels Labels, ts time.Time, data []byte) error {
+	return s.write(ctx, pendingWrite{
+		key:    key,
+		labels: labels.copy(),
+		elt:    api.Element{Timestamp: ts.UnixNano(), Data: data},
+		source: &src,
+	})
+}
+
+// WriteAdmitted queues an element like WriteLabels and returns the Admission that reports whether it was stored.
+func (s *storage) WriteAdmitted(
+	ctx context.Context,
+	key string,
+	labels Labels,
+	ts time.Time,
+	data []byte,
+) (Admission, error) {
+	result := make(chan error, 1)
+	err := s.write(ctx, pendingWrite{
+		key:    key,
+		labels: labels.copy(),
+		elt:    api.Element{Timestamp: ts.UnixNano(), Data: data},
+		result: result,
+	})
+	return Admission{result: result, closed: s.close}, err
+}
+
+func (s *storage) write(ctx context.Context, pw pendingWrite) error {
+	err := s.enqueue(ctx, s.calculateWorkerPartition(pw.key), pw)
+	if err == nil {
+		s.opts.MessageCounter.Add(1)
+	}
+	return err
+}
+
+// drain applies the writes that are waiting when it is called. Writes dropped by DropOldest while draining are
+// skipped.
+func (s *storage) drain(w *worker, writes <-chan pendingWrite) {
+	for n := len(writes); n > 0; n-- {
+		select {
+		case pw := <-writes:
+			s.apply(w, pw)
+		default:
 			return
 		}
+	}
+}
+
+// apply logs and stores a write taken from the worker's queue. Writes that are not admitted are neither logged nor
+// published. The labels of the series are logged with every write so that they are recovered for as long as the
+// series has elements in the log.
+func (s *storage) apply(w *worker, pw pendingWrite) {
+	if !s.admit(w, pw.key, pw.elt) {
+		pw.done(ErrRejected)
+		return
+	}
+	if w.log != nil {
+		labels := pw.labels
+		if ser, ok := w.data[pw.key]; ok && len(labels) == 0 {
+			labels = ser.labels
+		}
+		s.logWALError(w.log.append(pw.key, labels, pw.elt, pw.source))
+	}
+	s.insert(w, pw.key, pw.elt)
+	w.label(pw.key, pw.labels)
+	w.publish(pw.key, pw.elt)
+	pw.done(nil)
+}
 
-		insert(pl, newElt)
+// insert adds elt to the series for key, creating the series if needed, and then applies storage limits. An element
+// with the same timestamp as a stored element is handled according to the duplicate policy of the series.
+func (s *storage) insert(w *worker, key string, elt api.Element) {
+	ser, found := w.data[key]
+	if !found {
+		ser = newSeries(s.opts.ChunkSize, s.opts.compressionFor(key))
+		ser.maxAge = s.opts.maxAgeFor(key)
+		ser.duplicates = s.opts.duplicatesFor(key)
+		w.data[key] = ser
+		w.limiter.add(key)
 	}
+	before := ser.bytes
+	pos, duplicate := position{}, false
+	if ser.duplicates != KeepDuplicates {
+		pos, duplicate = ser.find(elt.Timestamp)
+	}
+	switch {
+	case !duplicate:
+		insert(ser, elt)
+	case ser.duplicates == LastWriteWins:
+		ser.replace(pos, elt)
+	default:
+		return
+	}
+	w.bytes += ser.bytes - before
+	s.limit(w, key, ser)
 }
 
 type searchResult struct {
-	err  error
-	elts []api.Element
+	err     error
+	elts    []api.Element
+	candles []Candle
 }
 
 // Search returns a set of elements for a particular key between first and last times. First and last are unix time in
 // nanoseconds.
-func (s *storage) Search(key string, first, last uint64) ([]api.Element, error) {
+func (s *storage) Search(ctx context.Context, key string, first, last uint64) ([]api.Element, error) {
 	if first > last {
 		return nil, &ErrorInvalidSearch{}
 	}
-	responseChan := make(chan searchResult)
+	responseChan := make(chan searchResult, 1)
 	partition := s.calculateWorkerPartition(key)
-	s.work[partition] <- func(data elementMap) {
-		if elts, ok := data[key]; ok {
+	err := s.do(ctx, partition, func(w *worker) {
+		if elts, ok := w.data[key]; ok {
 			responseChan <- searchResult{elts: search(elts, int64(first), int64(last))}
 			return
 		}
 		responseChan <- searchResult{err: &ErrorNotFound{Key: key}}
+	})
+	if err != nil {
+		return nil, err
 	}
 	result := <-responseChan
 	return result.elts, result.err
 }
 
-func (s *storage) Close() error {
-	close(s.close)
-	s.wait.Wait()
-	return nil
+// Last returns up to n of the newest elements of key in time order.
+func (s *storage) Last(ctx context.Context, key string, n int) ([]api.Element, error) {
+	if n <= 0 {
+		return nil, &ErrorInvalidSearch{}
+	}
+	responseChan := make(chan searchResult, 1)
+	err := s.do(ctx, s.calculateWorkerPartition(key), func(w *worker) {
+		if ser, ok := w.data[key]; ok {
+			responseChan <- searchResult{elts: ser.last(n)}
+			return
+		}
+		responseChan <- searchResult{err: &ErrorNotFound{Key: key}}
+	})
+	if err != nil {
+		return nil, err
+	}
+	result := <-responseChan
+	return result.elts, result.err
 }
 
-func (s *storage) keys() []string {
-	var result []string
-	for _, w := range s.work {
-		ch := make(chan []string)
-		w <- func(data elementMap) {
-			var result []string
-			for k := range data {
-				result = append(result, k)
+// LastBefore returns the newest element of key with a timestamp at or before ts, which is the value of the series
+// as of ts. An ErrorNotFound is returned if the key does not exist or has no element that old.
+func (s *storage) LastBefore(ctx context.Context, key string, ts uint64) (api.Element, error) {
+	responseChan := make(chan searchResult, 1)
+	err := s.do(ctx, s.calculateWorkerPartition(key), func(w *worker) {
+		if ser, ok := w.data[key]; ok {
+			if elt, ok := ser.lastBefore(int64(ts)); ok {
+				responseChan <- searchResult{elts: []api.Element{elt}}
+				return
 			}
-			ch <- result
 		}
-		r := <-ch
-		close(ch)
-		result = append(result, r...)
+		responseChan <- searchResult{err: &ErrorNotFound{Key: key}}
+	})
+	if err != nil {
+		return api.Element{}, err
 	}
-	return result
+	result := <-responseChan
+	if result.err != nil {
+		return api.Element{}, result.err
+	}
+	return result.elts[0], nil
 }
 
-func (s *storage) calculateWorkerPartition(key string) int {
-	cs := xxhash.ChecksumString32(key)
-	return int(cs) % s.opts.WorkerCount
+// Close stops the workers and waits for them to exit. Operations started after Close return ErrClosed, as does
+// calling Close again.
+func (s *storage) Close() error {
+	err := ErrClosed
+	s.closeOnce.Do(func() {
+		close(s.close)
+		err = nil
+	})
+	s.wait.Wait()
+	return err
 }
 
-func insert(l *list.List, elt api.Element) {
-	for curr := l.Back(); curr != nil; curr = curr.Prev() {
-		existingElt := curr.Value.(api.Element)
-		if elt.Timestamp >= existingElt.Timestamp {
-			l.InsertAfter(elt, curr)
-			return
-		}
+func (s *storage) keys() []string {
+	infos, _, _ := s.ListKeys(context.Background(), KeyMatcher{Type: MatchPrefix}, nil, "", 0)
+	result := make([]string, len(infos))
+	for i, info := range infos {
+		result[i] = info.Key
 	}
-	l.PushFront(elt)
+	return result
 }
 
-func search(elts *list.List, first, last int64) []api.Element {
-	if elts.Len() == 0 {
-		return nil
-	}
-	lastTick := elts.Back().Value.(api.Element)
-	if lastTick.Timestamp < first {
-		return nil
-	}
-	firstTick := elts.Front().Value.(api.Element)
-	if firstTick.Timestamp >= last {
-		return nil
-	}
-	result := make([]api.Element, 0, elts.Len())
-
-	for elt := elts.Front(); elt != nil; elt = elt.Next() {
-		tick := elt.Value.(api.Element)
-		if tick.Timestamp >= first && tick.Timestamp < last {
-			result = append(result, tick)
-		}
-	}
-	return result
+func (s *storage) calculateWorkerPartition(key string) int {
+	cs := xxhash.ChecksumString32(key)
+	return int(cs) % s.opts.WorkerCount
 }
 
-func expireOldElements(data elementMap, firstTimestamp int64, onExpire ExpiryHandler) {
+// expire removes elements that have outlived the maximum age of their series. Now is in unix nanoseconds.
+func (w *worker) expire(now int64, onExpire ExpiryHandler) {
 	var empties []string
-	for key, l := range data {
-
-		for {
-			curr := l.Front()
-			if curr == nil {
-				break
-			}
-			elt := curr.Value.(api.Element)
-			if elt.Timestamp < firstTimestamp {
-				l.Remove(curr)
-				if onExpire != nil {
-					onExpire(key, elt)
-				}
-				continue
-			}
-			break
-		}
-
-		if l.Len() == 0 {
+	for key, ser := range w.data {
+		before := ser.bytes
+		expire(key, ser, now-int64(ser.maxAge), onExpire)
+		w.bytes -= before - ser.bytes
+		if ser.len() == 0 {
 			empties = append(empties, key)
 		}
 	}
 	for _, k := range empties {
-		delete(data, k)
+		w.drop(k)
 	}
 }
@@ -2,10 +2,12 @@ package storage
 
 import (
 	"container/list"
+	"context"
 	"crypto/rand"
 	"encoding/base64"
 	"fmt"
 	mr "math/rand"
+	"path/filepath"
 	"sync"
 	"testing"
 	"time"
@@ -18,12 +20,42 @@ import (
 
 var epoch = time.Date(1970, 1, 1, 0, 0, 0, 0, time.UTC)
 
-func listToArray(l list.List) []api.Element {
-	var result []api.Element
-	for elt := l.Front(); elt != nil; elt = elt.Next() {
-		result = append(result, elt.Value.(api.Element))
+func seriesOf(chunkSize int, elts ...api.Element) *series {
+	s := newSeries(chunkSize, CompressionNone)
+	for _, elt := range elts {
+		insert(s, elt)
+	}
+	return s
+}
+
+// testOptions returns the options shared by the storage tests, an hour of retention spread over workers workers, with
+// each of overrides applied in turn.
+func testOptions(workers int, overrides ...func(*Options)) Options {
+	opts := Options{
+		MaxAge:            time.Hour,
+		WorkerCount:       workers,
+		ChannelBufferSize: DefaultChannelBufferSize,
+		MessageCounter:    discard.NewCounter(),
+	}
+	for _, override := range overrides {
+		override(&opts)
+	}
+	return opts
+}
+
+// withWAL logs writes to dir, syncing every write and keeping segments small so that recovery reads several of them.
+func withWAL(dir string) func(*Options) {
+	return func(opts *Options) {
+		opts.WAL = WALOptions{Dir: dir, Sync: SyncAlways, SegmentSize: 256}
+	}
+}
+
+// withSnapshot snapshots to a directory under dir, with the write ahead log in another.
+func withSnapshot(dir string) func(*Options) {
+	return func(opts *Options) {
+		withWAL(filepath.Join(dir, "wal"))(opts)
+		opts.Snapshot = SnapshotOptions{Path: filepath.Join(dir, "snapshot")}
 	}
-	return result
 }
 
 func TestStorageCreationAndClose(t *testing.T) {
@@ -33,11 +65,72 @@ func TestStorageCreationAndClose(t *testing.T) {
 		ChannelBufferSize: DefaultChannelBufferSize,
 		MessageCounter:    discard.NewCounter(),
 	}
-	s := New(opts)
+	s, err := New(opts)
+	require.Nil(t, err)
 	require.NotNil(t, s)
 	s.Close()
 }
 
+func TestStorageCancellation(t *testing.T) {
+	s, err := New(Options{
+		MaxAge:            DefaultMaxAge,
+		WorkerCount:       4,
+		ChannelBufferSize: DefaultChannelBufferSize,
+		MessageCounter:    discard.NewCounter(),
+	})
+	require.Nil(t, err)
+	require.Nil(t, s.Write(context.Background(), "A", time.Now(), nil))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = s.Search(ctx, "A", api.NoLowerBound, api.NoUpperBound)
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, context.Canceled, s.Write(ctx, "A", time.Now(), nil))
+	_, _, err = s.ListKeys(ctx, KeyMatcher{Type: MatchPrefix}, nil, "", 0)
+	assert.Equal(t, context.Canceled, err)
+
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	blocked := make(chan struct{})
+	defer close(blocked)
+	s.work[s.calculateWorkerPartition("A")] <- func(w *worker) {
+		<-blocked
+	}
+	_, err = s.Search(ctx, "A", api.NoLowerBound, api.NoUpperBound)
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	done := make(chan error)
+	go func() {
+		_, err := s.Search(context.Background(), "A", api.NoLowerBound, api.NoUpperBound)
+		done <- err
+	}()
+	go s.Close()
+	select {
+	case err := <-done:
+		assert.Equal(t, ErrClosed, err)
+	case <-time.After(time.Second):
+		t.Fatal("search did not return after close")
+	}
+}
+
+func TestStorageClosed(t *testing.T) {
+	s, err := New(Options{
+		MaxAge:            DefaultMaxAge,
+		WorkerCount:       4,
+		ChannelBufferSize: DefaultChannelBufferSize,
+		MessageCounter:    discard.NewCounter(),
+	})
+	require.Nil(t, err)
+	require.Nil(t, s.Close())
+
+	assert.Equal(t, ErrClosed, s.Write(context.Background(), "A", time.Now(), nil))
+	_, err = s.Search(context.Background(), "A", api.NoLowerBound, api.NoUpperBound)
+	assert.Equal(t, ErrClosed, err)
+	_, err = s.Subscribe(context.Background(), SubscribeRequest{Keys: []KeyMatcher{{Type: MatchPrefix}}})
+	assert.Equal(t, ErrClosed, err)
+	assert.Equal(t, ErrClosed, s.Close())
+}
+
 func TestStorageInsertion(t *testing.T) {
 	tt := []struct {
 		desc     string
@@ -125,14 +218,31 @@ func TestStorageInsertion(t *testing.T) {
 	}
 
 	for i := range tt {
-		t.Run(tt[i].desc, func(t *testing.T) {
-			var l list.List
-			for _, elt := range tt[i].inserts {
-				insert(&l, elt)
-			}
-			actual := listToArray(l)
-			assert.Equal(t, tt[i].expected, actual)
-		})
+		for _, chunkSize := range []int{1, 2, DefaultChunkSize} {
+			t.Run(fmt.Sprintf("%s_%d", tt[i].desc, chunkSize), func(t *testing.T) {
+				s := seriesOf(chunkSize, tt[i].inserts...)
+				assert.Equal(t, tt[i].expected, s.elements())
+				assert.Equal(t, len(tt[i].expected), s.len())
+			})
+		}
+	}
+}
+
+func TestStorageChunking(t *testing.T) {
+	const chunkSize = 4
+	s := newSeries(chunkSize, CompressionNone)
+	for i := 0; i < 100; i++ {
+		insert(s, api.Element{Timestamp: int64(mr.Intn(50))})
+	}
+	require.Equal(t, 100, s.len())
+	var last int64
+	for _, c := range s.chunks {
+		require.True(t, c.len() > 0)
+		require.True(t, c.len() <= chunkSize)
+		require.Equal(t, c.elts[0].Timestamp, c.min)
+		require.Equal(t, c.elts[c.len()-1].Timestamp, c.max)
+		require.True(t, last <= c.min)
+		last = c.max
 	}
 }
 
@@ -143,36 +253,284 @@ func TestStorageExpiration(t *testing.T) {
 		{120, nil},
 		{130, nil},
 	}
-	var listA, listB, listC, listD list.List
-	for i := range elts {
-		listA.PushBack(elts[i])
-		if i > 0 {
-			listB.PushBack(elts[i])
-		}
-	}
-	listD.PushBack(elts[0])
-
-	data := elementMap{
-		"A": &listA,
-		"B": &listB,
-		"C": &listC,
-		"D": &listD,
+	w := &worker{data: elementMap{
+		"A": seriesOf(2, elts...),
+		"B": seriesOf(2, elts[1:]...),
+		"C": seriesOf(2),
+		"D": seriesOf(2, elts[0]),
+	}}
+	for _, ser := range w.data {
+		w.bytes += ser.bytes
 	}
+	partial := &worker{data: elementMap{"E": seriesOf(2, elts...)}}
 
-	expireOldElements(data, 110, nil)
+	var expired []api.Element
+	w.expire(110, nil)
+	partial.expire(125, func(key string, elt api.Element, reason ExpiryReason) {
+		assert.Equal(t, "E", key)
+		assert.Equal(t, Expired, reason)
+		expired = append(expired, elt)
+	})
 	// first elt removed
-	require.Equal(t, 3, data["A"].Len())
-	require.Equal(t, int64(110), data["A"].Front().Value.(api.Element).Timestamp)
+	require.Equal(t, 3, w.data["A"].len())
+	require.Equal(t, int64(110), w.data["A"].oldest())
 	// not elts removed
-	require.Equal(t, 3, data["B"].Len())
-	require.Equal(t, int64(110), data["B"].Front().Value.(api.Element).Timestamp)
-	_, present := data["C"]
+	require.Equal(t, 3, w.data["B"].len())
+	require.Equal(t, int64(110), w.data["B"].oldest())
+	// whole chunk and part of the next removed
+	require.Equal(t, 1, partial.data["E"].len())
+	require.Equal(t, int64(130), partial.data["E"].oldest())
+	require.Equal(t, elts[:3], expired)
+	require.Equal(t, int64(6*elementOverhead), w.bytes)
+	_, present := w.data["C"]
 	// list removed in both cases
 	require.False(t, present)
-	_, present = data["D"]
+	_, present = w.data["D"]
 	require.False(t, present)
 }
 
+func TestStorageRetention(t *testing.T) {
+	s := &storage{opts: Options{
+		MaxAge:          time.Hour,
+		WorkerCount:     1,
+		ChunkSize:       DefaultChunkSize,
+		EvictionCounter: discard.NewCounter(),
+		RetentionPolicies: []RetentionPolicy{
+			{Keys: KeyMatcher{MatchPrefix, "book."}, MaxAge: 5 * time.Minute},
+			{Keys: KeyMatcher{MatchGlob, "index.*"}, MaxAge: 24 * time.Hour},
+		},
+	}}
+	w := &worker{data: make(elementMap)}
+	now := time.Now()
+	for _, key := range []string{"book.AAPL", "index.SPX", "AAPL"} {
+		for _, age := range []time.Duration{25 * time.Hour, 2 * time.Hour, 10 * time.Minute, time.Minute} {
+			s.insert(w, key, api.Element{Timestamp: now.Add(-age).UnixNano()})
+		}
+	}
+	w.expire(now.UnixNano(), nil)
+	assert.Equal(t, 1, w.data["book.AAPL"].len())
+	assert.Equal(t, 3, w.data["index.SPX"].len())
+	assert.Equal(t, 2, w.data["AAPL"].len())
+}
+
+func TestStorageEviction(t *testing.T) {
+	type evicted struct {
+		key string
+		ts  int64
+	}
+	tt := []struct {
+		desc     string
+		opts     Options
+		writes   []evicted
+		expected []evicted
+	}{
+		{
+			"per_key",
+			Options{MaxElementsPerKey: 2},
+			[]evicted{{"A", 100}, {"A", 110}, {"B", 90}, {"A", 120}, {"A", 105}},
+			[]evicted{{"A", 100}, {"A", 105}},
+		},
+		{
+			"oldest",
+			Options{MaxBytes: 3 * (elementOverhead + 8), EvictionPolicy: EvictOldest},
+			[]evicted{{"A", 100}, {"A", 110}, {"B", 90}, {"A", 120}, {"B", 130}},
+			[]evicted{{"B", 90}, {"A", 100}},
+		},
+		{
+			"largest",
+			Options{MaxBytes: 3 * (elementOverhead + 8), EvictionPolicy: EvictLargest},
+			[]evicted{{"A", 100}, {"A", 110}, {"B", 90}, {"A", 120}, {"B", 130}},
+			[]evicted{{"A", 100}, {"B", 90}},
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.desc, func(t *testing.T) {
+			var actual []evicted
+			tc.opts.WorkerCount = 1
+			tc.opts.ChunkSize = 2
+			tc.opts.EvictionCounter = discard.NewCounter()
+			tc.opts.OnExpire = func(key string, elt api.Element, reason ExpiryReason) {
+				assert.Equal(t, Evicted, reason)
+				actual = append(actual, evicted{key, elt.Timestamp})
+			}
+			s := &storage{opts: tc.opts}
+			w := &worker{data: make(elementMap)}
+			for _, e := range tc.writes {
+				s.insert(w, e.key, api.Element{Timestamp: e.ts, Data: benchmarkData})
+			}
+			assert.Equal(t, tc.expected, actual)
+
+			var bytes int64
+			for _, ser := range w.data {
+				bytes += ser.bytes
+			}
+			assert.Equal(t, bytes, w.bytes)
+			if tc.opts.MaxBytes > 0 {
+				assert.True(t, w.bytes <= tc.opts.MaxBytes)
+			}
+		})
+	}
+}
+
+func TestBudget(t *testing.T) {
+	tt := []struct {
+		maxBytes int64
+		workers  int
+		expected int64
+	}{
+		{0, 4, 0},
+		{1000, 4, 250},
+		{3, 4, 1},
+	}
+	for _, tc := range tt {
+		s := &storage{opts: Options{MaxBytes: tc.maxBytes, WorkerCount: tc.workers}}
+		assert.Equal(t, tc.expected, s.budget(), "%d bytes over %d workers", tc.maxBytes, tc.workers)
+	}
+}
+
+func TestKeyMatcher(t *testing.T) {
+	tt := []struct {
+		matcher  KeyMatcher
+		key      string
+		expected bool
+	}{
+		{KeyMatcher{MatchExact, "AAPL"}, "AAPL", true},
+		{KeyMatcher{MatchExact, "AAPL"}, "AAPL.bid", false},
+		{KeyMatcher{MatchPrefix, "book."}, "book.AAPL", true},
+		{KeyMatcher{MatchPrefix, "book."}, "index.SPX", false},
+		{KeyMatcher{MatchGlob, "index.*"}, "index.SPX", true},
+		{KeyMatcher{MatchGlob, "index.?"}, "index.SPX", false},
+		{KeyMatcher{MatchGlob, "[invalid"}, "[invalid", false},
+		{mustParseKeyMatcher(t, "prefix:book."), "book.AAPL", true},
+		{mustParseKeyMatcher(t, "glob:index.*"), "index.SPX", true},
+		{mustParseKeyMatcher(t, "exact:a:b"), "a:b", true},
+		{mustParseKeyMatcher(t, "AAPL"), "AAPL", true},
+	}
+	for _, tc := range tt {
+		t.Run(tc.matcher.Pattern+"_"+tc.key, func(t *testing.T) {
+			assert.Equal(t, tc.expected, tc.matcher.Match(tc.key))
+		})
+	}
+
+	for _, spec := range []string{"prefx:book.", "a:b"} {
+		_, err := ParseKeyMatcher(spec)
+		assert.NotNil(t, err, spec)
+	}
+}
+
+func mustParseKeyMatcher(t *testing.T, spec string) KeyMatcher {
+	m, err := ParseKeyMatcher(spec)
+	require.Nil(t, err)
+	return m
+}
+
+func TestSeriesSearch(t *testing.T) {
+	var elts []api.Element
+	for i := 0; i < 1000; i++ {
+		elts = append(elts, api.Element{Timestamp: int64(100 + mr.Intn(500))})
+	}
+	bruteForce := func(s *series, first, last int64) []api.Element {
+		var result []api.Element
+		for _, elt := range s.elements() {
+			if elt.Timestamp >= first && elt.Timestamp < last {
+				result = append(result, elt)
+			}
+		}
+		return result
+	}
+	bounds := [][2]int64{
+		{0, 50},
+		{0, 100},
+		{0, 101},
+		{100, 600},
+		{250, 251},
+		{250, 250},
+		{300, 200},
+		{599, 600},
+		{600, 700},
+		{0, int64(api.NoUpperBound)},
+	}
+	for _, chunkSize := range []int{1, 3, 64, DefaultChunkSize} {
+		s := seriesOf(chunkSize, elts...)
+		for _, b := range bounds {
+			t.Run(fmt.Sprintf("%d_%d_%d", chunkSize, b[0], b[1]), func(t *testing.T) {
+				assert.Equal(t, bruteForce(s, b[0], b[1]), search(s, b[0], b[1]))
+			})
+		}
+	}
+}
+
+func TestSeriesLast(t *testing.T) {
+	var elts []api.Element
+	for i := 0; i < 1000; i++ {
+		elts = append(elts, api.Element{Timestamp: int64(100 + mr.Intn(500))})
+	}
+	for _, chunkSize := range []int{1, 3, 64, DefaultChunkSize} {
+		s := seriesOf(chunkSize, elts...)
+		all := s.elements()
+		for _, n := range []int{1, 2, 63, 64, 65, 999, 1000, 2000} {
+			t.Run(fmt.Sprintf("last_%d_%d", chunkSize, n), func(t *testing.T) {
+				expected := all
+				if n < len(all) {
+					expected = all[len(all)-n:]
+				}
+				assert.Equal(t, expected, s.last(n))
+			})
+		}
+		for _, ts := range []int64{0, 99, 100, 101, 350, 599, 600, 1000} {
+			t.Run(fmt.Sprintf("before_%d_%d", chunkSize, ts), func(t *testing.T) {
+				var expected api.Element
+				var found bool
+				for _, elt := range all {
+					if elt.Timestamp <= ts {
+						expected, found = elt, true
+					}
+				}
+				actual, ok := s.lastBefore(ts)
+				assert.Equal(t, found, ok)
+				assert.Equal(t, expected, actual)
+			})
+		}
+	}
+}
+
+func TestStorageLast(t *testing.T) {
+	stg, err := New(Options{
+		MaxAge:            time.Hour,
+		WorkerCount:       2,
+		ChannelBufferSize: DefaultChannelBufferSize,
+		MessageCounter:    discard.NewCounter(),
+	})
+	require.Nil(t, err)
+	defer stg.Close()
+
+	base := time.Now()
+	for i := 0; i < 10; i++ {
+		stg.Write(context.Background(), "A", base.Add(time.Duration(10*i)), []byte{byte(i)})
+	}
+
+	elts, err := stg.Last(context.Background(), "A", 3)
+	require.Nil(t, err)
+	assert.Equal(t, []api.Element{
+		{Timestamp: base.Add(70).UnixNano(), Data: []byte{7}},
+		{Timestamp: base.Add(80).UnixNano(), Data: []byte{8}},
+		{Timestamp: base.Add(90).UnixNano(), Data: []byte{9}},
+	}, elts)
+	_, err = stg.Last(context.Background(), "A", 0)
+	assert.IsType(t, &ErrorInvalidSearch{}, err)
+	_, err = stg.Last(context.Background(), "B", 1)
+	assert.IsType(t, &ErrorNotFound{}, err)
+
+	elt, err := stg.LastBefore(context.Background(), "A", uint64(base.Add(45).UnixNano()))
+	require.Nil(t, err)
+	assert.Equal(t, api.Element{Timestamp: base.Add(40).UnixNano(), Data: []byte{4}}, elt)
+	elt, err = stg.LastBefore(context.Background(), "A", api.NoUpperBound)
+	require.Nil(t, err)
+	assert.Equal(t, []byte{9}, elt.Data)
+	_, err = stg.LastBefore(context.Background(), "A", uint64(base.UnixNano()-1))
+	assert.IsType(t, &ErrorNotFound{}, err)
+}
+
 func TestStorage(t *testing.T) {
 	randomKey := func() string {
 		key := make([]byte, 8)
@@ -201,7 +559,8 @@ func TestStorage(t *testing.T) {
 		MessageCounter:    discard.NewCounter(),
 	}
 
-	storage := New(opts)
+	storage, err := New(opts)
+	require.Nil(t, err)
 	defer storage.Close()
 	var wg sync.WaitGroup
 	wg.Add(200)
@@ -213,7 +572,7 @@ func TestStorage(t *testing.T) {
 			base := time.Now()
 			for i := 0; i < 100; i++ {
 				ts := time.Duration(mr.Int63() % 100)
-				storage.Write(key, base.Add(ts), nil)
+				storage.Write(context.Background(), key, base.Add(ts), nil)
 			}
 		}()
 	}
@@ -224,7 +583,7 @@ func TestStorage(t *testing.T) {
 
 			for i := 0; i < 100; i++ {
 				for _, k := range keys {
-					storage.Search(k, api.NoLowerBound, api.NoUpperBound)
+					storage.Search(context.Background(), k, api.NoLowerBound, api.NoUpperBound)
 				}
 			}
 		}()
@@ -235,7 +594,7 @@ func TestStorage(t *testing.T) {
 		// sample keys
 		j := mr.Int() % 100
 		t.Run(fmt.Sprintf("sampled_%d", j), func(t *testing.T) {
-			elts, err := storage.Search(keys[j], api.NoLowerBound, api.NoUpperBound)
+			elts, err := storage.Search(context.Background(), keys[j], api.NoLowerBound, api.NoUpperBound)
 			require.Nil(t, err)
 			assert.Len(t, elts, 100)
 			assert.True(t, sorted(elts))
@@ -315,19 +674,119 @@ func TestStorageSearch(t *testing.T) {
 
 	for _, tc := range tt {
 		t.Run(tc.desc, func(t *testing.T) {
-			stg := New(Options{
+			stg, err := New(Options{
 				MaxAge:            DefaultMaxAge,
 				WorkerCount:       10,
 				ChannelBufferSize: DefaultChannelBufferSize,
 				MessageCounter:    discard.NewCounter(),
 			})
+			require.Nil(t, err)
 			defer stg.Close()
 			for _, elt := range tc.inserts {
-				stg.Write(tc.key, epoch.Add(time.Duration(elt.Timestamp)), nil)
+				stg.Write(context.Background(), tc.key, epoch.Add(time.Duration(elt.Timestamp)), nil)
 			}
-			actual, err := stg.Search(tc.key, tc.first, tc.last)
+			actual, err := stg.Search(context.Background(), tc.key, tc.first, tc.last)
 			require.Equal(t, tc.err, err)
 			assert.Equal(t, tc.expected, actual)
 		})
 	}
 }
+
+// listInsert and listSearch reproduce the original container/list based storage so it can be benchmarked against
+// chunked series.
+func listInsert(l *list.List, elt api.Element) {
+	for curr := l.Back(); curr != nil; curr = curr.Prev() {
+		if elt.Timestamp >= curr.Value.(api.Element).Timestamp {
+			l.InsertAfter(elt, curr)
+			return
+		}
+	}
+	l.PushFront(elt)
+}
+
+func listSearch(elts *list.List, first, last int64) []api.Element {
+	result := make([]api.Element, 0, elts.Len())
+	for elt := elts.Front(); elt != nil; elt = elt.Next() {
+		tick := elt.Value.(api.Element)
+		if tick.Timestamp >= first && tick.Timestamp < last {
+			result = append(result, tick)
+		}
+	}
+	return result
+}
+
+const benchmarkElements = 100000
+
+var benchmarkData = []byte{1, 2, 3, 4, 5, 6, 7, 8}
+
+func BenchmarkListInsert(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		var l list.List
+		for ts := int64(0); ts < benchmarkElements; ts++ {
+			listInsert(&l, api.Element{Timestamp: ts, Data: benchmarkData})
+		}
+	}
+}
+
+func BenchmarkSeriesInsert(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		s := newSeries(DefaultChunkSize, CompressionNone)
+		for ts := int64(0); ts < benchmarkElements; ts++ {
+			insert(s, api.Element{Timestamp: ts, Data: benchmarkData})
+		}
+	}
+}
+
+func BenchmarkListSearch(b *testing.B) {
+	var l list.List
+	for ts := int64(0); ts < benchmarkElements; ts++ {
+		listInsert(&l, api.Element{Timestamp: ts, Data: benchmarkData})
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		listSearch(&l, benchmarkElements-1000, benchmarkElements)
+	}
+}
+
+func BenchmarkSeriesSearch(b *testing.B) {
+	s := newSeries(DefaultChunkSize, CompressionNone)
+	for ts := int64(0); ts < benchmarkElements; ts++ {
+		insert(s, api.Element{Timestamp: ts, Data: benchmarkData})
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		search(s, benchmarkElements-1000, benchmarkElements)
+	}
+}
+
+func BenchmarkListExpire(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		var l list.List
+		for ts := int64(0); ts < benchmarkElements; ts++ {
+			listInsert(&l, api.Element{Timestamp: ts, Data: benchmarkData})
+		}
+		b.StartTimer()
+		for curr := l.Front(); curr != nil && curr.Value.(api.Element).Timestamp < benchmarkElements/2; curr = l.Front() {
+			l.Remove(curr)
+		}
+	}
+}
+
+func BenchmarkSeriesExpire(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		s := newSeries(DefaultChunkSize, CompressionNone)
+		for ts := int64(0); ts < benchmarkElements; ts++ {
+			insert(s, api.Element{Timestamp: ts, Data: benchmarkData})
+		}
+		b.StartTimer()
+		expire("key", s, benchmarkElements/2, nil)
+	}
+}
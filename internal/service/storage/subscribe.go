@@ -0,0 +1,243 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/murphybytes/gots/api"
+	"github.com/pkg/errors"
+)
+
+// DefaultSubscriberBufferSize is the default number of elements buffered for each subscription.
+const DefaultSubscriberBufferSize = 1024
+
+// ErrSlowSubscriber ends a subscription that could not keep up with writes when the SlowSubscriberPolicy is
+// DisconnectSubscriber.
+var ErrSlowSubscriber = errors.New("subscriber is not keeping up with writes")
+
+// SlowSubscriberPolicy decides what happens when a subscription's buffer is full.
+type SlowSubscriberPolicy int
+
+const (
+	// DropUpdates discards elements that do not fit in the buffer. Dropped elements are counted by the subscription.
+	DropUpdates SlowSubscriberPolicy = iota
+	// DisconnectSubscriber ends the subscription with ErrSlowSubscriber.
+	DisconnectSubscriber
+)
+
+// ParseSlowSubscriberPolicy converts the name of a policy, "drop" or "disconnect", into a SlowSubscriberPolicy.
+func ParseSlowSubscriberPolicy(name string) (SlowSubscriberPolicy, error) {
+	switch name {
+	case "drop":
+		return DropUpdates, nil
+	case "disconnect":
+		return DisconnectSubscriber, nil
+	}
+	return DropUpdates, fmt.Errorf("unknown slow subscriber policy '%s'", name)
+}
+
+// Update is an element written to the series for Key.
+type Update struct {
+	Key     string
+	Element api.Element
+}
+
+// Subscriber streams elements as they are written to storage.
+type Subscriber interface {
+	// Subscribe returns once the subscription is registered with every worker. The subscription lasts until it is
+	// closed or storage is closed, ctx only limits how long registration can take.
+	Subscribe(ctx context.Context, req SubscribeRequest) (*Subscription, error)
+}
+
+// SubscribeRequest selects the keys of a subscription.
+type SubscribeRequest struct {
+	// Keys selects the series to subscribe to. At least one matcher is required.
+	Keys []KeyMatcher
+	// Backfill requests elements already in storage with timestamps of at least Oldest.
+	Backfill bool
+	Oldest   uint64
+}
+
+// Subscription receives elements written to the keys it selects. Backfill holds the elements that were in storage
+// when the subscription started and Updates every element written afterwards, so that together they contain each
+// element exactly once.
+type Subscription struct {
+	keys     []KeyMatcher
+	backfill []Update
+	updates  chan Update
+	policy   SlowSubscriberPolicy
+
+	lock    sync.Mutex
+	closed  bool
+	err     error
+	dropped int64
+}
+
+// Backfill returns the elements in storage when the subscription started, ordered by key and then timestamp.
+func (sub *Subscription) Backfill() []Update {
+	return sub.backfill
+}
+
+// Updates returns a channel of elements written after the subscription started. The channel is closed when the
+// subscription ends.
+func (sub *Subscription) Updates() <-chan Update {
+	return sub.updates
+}
+
+// Err returns ErrSlowSubscriber if the subscription was ended because it fell behind, otherwise nil.
+func (sub *Subscription) Err() error {
+	sub.lock.Lock()
+	defer sub.lock.Unlock()
+	return sub.err
+}
+
+// Dropped returns the number of elements discarded because the buffer was full.
+func (sub *Subscription) Dropped() int64 {
+	sub.lock.Lock()
+	defer sub.lock.Unlock()
+	return sub.dropped
+}
+
+// Close ends the subscription. Workers stop publishing to it the next time they see it.
+func (sub *Subscription) Close() {
+	sub.lock.Lock()
+	defer sub.lock.Unlock()
+	sub.end(nil)
+}
+
+func (sub *Subscription) end(err error) {
+	if sub.closed {
+		return
+	}
+	sub.closed = true
+	sub.err = err
+	close(sub.updates)
+}
+
+func (sub *Subscription) done() bool {
+	sub.lock.Lock()
+	defer sub.lock.Unlock()
+	return sub.closed
+}
+
+func (sub *Subscription) matches(key string) bool {
+	for _, m := range sub.keys {
+		if m.Match(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// publish sends u to the subscriber without blocking the worker. It returns false once the subscription has ended.
+func (sub *Subscription) publish(u Update) bool {
+	sub.lock.Lock()
+	defer sub.lock.Unlock()
+	if sub.closed {
+		return false
+	}
+	select {
+	case sub.updates <- u:
+	default:
+		if sub.policy == DisconnectSubscriber {
+			sub.end(ErrSlowSubscriber)
+			return false
+		}
+		sub.dropped++
+	}
+	return true
+}
+
+// Subscribe starts a subscription to the keys selected by req. The subscription is registered with each worker in
+// the same operation that copies its backfill, so no element is missed or repeated between Backfill and Updates.
+func (s *storage) Subscribe(ctx context.Context, req SubscribeRequest) (*Subscription, error) {
+	if len(req.Keys) == 0 {
+		return nil, &ErrorInvalidSearch{}
+	}
+	sub := &Subscription{
+		keys:    req.Keys,
+		updates: make(chan Update, s.opts.SubscriberBufferSize),
+		policy:  s.opts.SlowSubscriberPolicy,
+	}
+	for _, partition := range s.subscriptionPartitions(req.Keys) {
+		done := make(chan []Update, 1)
+		err := s.do(ctx, partition, func(w *worker) {
+			var backfill []Update
+			if req.Backfill {
+				for key, ser := range w.data {
+					if !sub.matches(key) {
+						continue
+					}
+					for _, elt := range search(ser, int64(req.Oldest), int64(api.NoUpperBound)) {
+						backfill = append(backfill, Update{Key: key, Element: elt})
+					}
+				}
+			}
+			w.subscriptions = append(w.subscriptions, sub)
+			done <- backfill
+		})
+		if err != nil {
+			sub.Close()
+			return nil, err
+		}
+		sub.backfill = append(sub.backfill, <-done...)
+	}
+	sort.SliceStable(sub.backfill, func(i, j int) bool {
+		return sub.backfill[i].Key < sub.backfill[j].Key
+	})
+	return sub, nil
+}
+
+// subscriptionPartitions returns the workers that may hold keys selected by matchers.
+func (s *storage) subscriptionPartitions(matchers []KeyMatcher) []int {
+	seen := make(map[int]bool)
+	var result []int
+	for _, m := range matchers {
+		if m.Type != MatchExact {
+			result = result[:0]
+			for i := range s.work {
+				result = append(result, i)
+			}
+			return result
+		}
+		if partition := s.calculateWorkerPartition(m.Pattern); !seen[partition] {
+			seen[partition] = true
+			result = append(result, partition)
+		}
+	}
+	return result
+}
+
+// publish passes an element written to key on to matching subscriptions.
+func (w *worker) publish(key string, elt api.Element) {
+	if len(w.subscriptions) == 0 {
+		return
+	}
+	live := w.subscriptions[:0]
+	for _, sub := range w.subscriptions {
+		if sub.matches(key) && !sub.publish(Update{Key: key, Element: elt}) {
+			continue
+		}
+		live = append(live, sub)
+	}
+	for i := len(live); i < len(w.subscriptions); i++ {
+		w.subscriptions[i] = nil
+	}
+	w.subscriptions = live
+}
+
+// pruneSubscriptions forgets subscriptions that have been closed.
+func (w *worker) pruneSubscriptions() {
+	live := w.subscriptions[:0]
+	for _, sub := range w.subscriptions {
+		if !sub.done() {
+			live = append(live, sub)
+		}
+	}
+	for i := len(live); i < len(w.subscriptions); i++ {
+		w.subscriptions[i] = nil
+	}
+	w.subscriptions = live
+}
@@ -0,0 +1,138 @@
+package storage
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/murphybytes/gots/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func receive(t *testing.T, sub *Subscription, count int) []Update {
+	var result []Update
+	for len(result) < count {
+		select {
+		case u, ok := <-sub.Updates():
+			require.True(t, ok, "subscription ended early")
+			result = append(result, u)
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for updates")
+		}
+	}
+	return result
+}
+
+func TestSubscribe(t *testing.T) {
+	stg, err := New(testOptions(4, func(opts *Options) {
+		opts.SubscriberBufferSize = 100
+		opts.SlowSubscriberPolicy = DropUpdates
+	}))
+	require.Nil(t, err)
+	defer stg.Close()
+
+	now := time.Now()
+	stg.Write(context.Background(), "book.a", now.Add(-time.Minute), []byte("old"))
+	stg.Write(context.Background(), "book.a", now, []byte("a0"))
+	stg.Write(context.Background(), "book.b", now, []byte("b0"))
+	stg.Write(context.Background(), "trade.a", now, []byte("t0"))
+
+	sub, err := stg.Subscribe(context.Background(), SubscribeRequest{
+		Keys:     []KeyMatcher{{Type: MatchPrefix, Pattern: "book."}},
+		Backfill: true,
+		Oldest:   uint64(now.UnixNano()),
+	})
+	require.Nil(t, err)
+	defer sub.Close()
+	assert.Equal(t, []Update{
+		{Key: "book.a", Element: api.Element{Timestamp: now.UnixNano(), Data: []byte("a0")}},
+		{Key: "book.b", Element: api.Element{Timestamp: now.UnixNano(), Data: []byte("b0")}},
+	}, sub.Backfill())
+
+	later := now.Add(time.Second)
+	stg.Write(context.Background(), "trade.a", later, []byte("t1"))
+	stg.Write(context.Background(), "book.a", later, []byte("a1"))
+	assert.Equal(t, []Update{
+		{Key: "book.a", Element: api.Element{Timestamp: later.UnixNano(), Data: []byte("a1")}},
+	}, receive(t, sub, 1))
+}
+
+func TestSubscribeHandoff(t *testing.T) {
+	stg, err := New(testOptions(4, func(opts *Options) {
+		opts.SubscriberBufferSize = 10000
+		opts.SlowSubscriberPolicy = DisconnectSubscriber
+	}))
+	require.Nil(t, err)
+	defer stg.Close()
+
+	// writes racing the subscription appear exactly once in either the backfill or the updates
+	const count = 5000
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < count; i++ {
+			stg.Write(context.Background(), "A", time.Unix(0, int64(i)), nil)
+		}
+	}()
+	time.Sleep(time.Millisecond)
+	sub, err := stg.Subscribe(context.Background(), SubscribeRequest{Keys: []KeyMatcher{{Pattern: "A"}}, Backfill: true})
+	require.Nil(t, err)
+	defer sub.Close()
+	<-done
+
+	backfill := sub.Backfill()
+	updates := append(backfill, receive(t, sub, count-len(backfill))...)
+	for i, u := range updates {
+		require.Equal(t, int64(i), u.Element.Timestamp)
+	}
+	assert.Nil(t, sub.Err())
+}
+
+func TestSlowSubscriber(t *testing.T) {
+	stg, err := New(testOptions(4, func(opts *Options) {
+		opts.SubscriberBufferSize = 2
+		opts.SlowSubscriberPolicy = DropUpdates
+	}))
+	require.Nil(t, err)
+	sub, err := stg.Subscribe(context.Background(), SubscribeRequest{Keys: []KeyMatcher{{Pattern: "A"}}})
+	require.Nil(t, err)
+	for i := 0; i < 5; i++ {
+		stg.Write(context.Background(), "A", time.Now(), nil)
+	}
+	_, err = stg.Search(context.Background(), "A", api.NoLowerBound, api.NoUpperBound)
+	require.Nil(t, err)
+	assert.Equal(t, int64(3), sub.Dropped())
+	assert.Len(t, receive(t, sub, 2), 2)
+	// subscriptions end when storage is closed
+	stg.Close()
+	_, ok := <-sub.Updates()
+	assert.False(t, ok)
+	assert.Nil(t, sub.Err())
+
+	stg, err = New(testOptions(4, func(opts *Options) {
+		opts.SubscriberBufferSize = 2
+		opts.SlowSubscriberPolicy = DisconnectSubscriber
+	}))
+	require.Nil(t, err)
+	defer stg.Close()
+	sub, err = stg.Subscribe(context.Background(), SubscribeRequest{Keys: []KeyMatcher{{Pattern: "A"}}})
+	require.Nil(t, err)
+	for i := 0; i < 5; i++ {
+		stg.Write(context.Background(), "A", time.Now(), nil)
+	}
+	_, err = stg.Search(context.Background(), "A", api.NoLowerBound, api.NoUpperBound)
+	require.Nil(t, err)
+	assert.Len(t, receive(t, sub, 2), 2)
+	_, ok = <-sub.Updates()
+	assert.False(t, ok)
+	assert.Equal(t, ErrSlowSubscriber, sub.Err())
+}
+
+func TestSubscribeInvalid(t *testing.T) {
+	stg, err := New(testOptions(4))
+	require.Nil(t, err)
+	defer stg.Close()
+	_, err = stg.Subscribe(context.Background(), SubscribeRequest{})
+	assert.IsType(t, &ErrorInvalidSearch{}, err)
+}
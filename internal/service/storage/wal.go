@@ -0,0 +1,620 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/murphybytes/gots/api"
+	"github.com/pkg/errors"
+)
+
+const (
+	// DefaultWALSegmentSize is the default size at which a write ahead log segment is closed and a new one started.
+	DefaultWALSegmentSize = 64 << 20
+	// DefaultWALSyncInterval is the default time between syncs of the write ahead log.
+	DefaultWALSyncInterval = time.Second
+
+	walExtension  = ".wal"
+	walHeaderSize = 8
+
+	walRecordWrite  byte = 1
+	walRecordDelete byte = 2
+	// walRecordLabelledWrite is a write followed by the labels of its series.
+	walRecordLabelledWrite byte = 3
+	// walRecordSourceWrite is a labelled write followed by the position of the message it was read from.
+	walRecordSourceWrite byte = 4
+)
+
+// SyncPolicy controls how often the write ahead log is flushed to stable storage.
+type SyncPolicy int
+
+const (
+	// SyncInterval syncs the log every WALOptions.SyncInterval.
+	SyncInterval SyncPolicy = iota
+	// SyncAlways syncs the log after every write.
+	SyncAlways
+	// SyncNever hands writes to the operating system every WALOptions.SyncInterval but never syncs the log.
+	SyncNever
+)
+
+// ParseSyncPolicy converts the name of a policy, "always", "interval" or "never", into a SyncPolicy.
+func ParseSyncPolicy(name string) (SyncPolicy, error) {
+	switch name {
+	case "always":
+		return SyncAlways, nil
+	case "interval":
+		return SyncInterval, nil
+	case "never":
+		return SyncNever, nil
+	}
+	return SyncInterval, fmt.Errorf("unknown sync policy '%s'", name)
+}
+
+// WALOptions configure the write ahead log. Each worker logs its writes to a series of segment files in its own
+// directory below Dir. Logs are replayed when storage is created and segments are removed once all of the elements
+// they hold have expired.
+type WALOptions struct {
+	// Dir is the directory holding the log. The log is disabled if Dir is empty.
+	Dir string
+	// Sync controls how often the log is synced to disk.
+	Sync SyncPolicy
+	// SyncInterval is the time between syncs for SyncInterval and SyncNever. Defaults to DefaultWALSyncInterval.
+	SyncInterval time.Duration
+	// SegmentSize is the size in bytes at which a segment is closed. Defaults to DefaultWALSegmentSize.
+	SegmentSize int64
+}
+
+var walTable = crc32.MakeTable(crc32.Castagnoli)
+
+// segment is a log file that is no longer written to.
+type segment struct {
+	path string
+	// newest is the most recent element timestamp in the segment.
+	newest int64
+}
+
+// wal is the write ahead log of a single worker. Records are a little endian length and CRC of the payload followed
+// by the payload. It is only accessed from the worker's goroutine.
+type wal struct {
+	opts    WALOptions
+	dir     string
+	seq     uint64
+	file    *os.File
+	buf     *bufio.Writer
+	size    int64
+	newest  int64
+	closed  []segment
+	scratch []byte
+}
+
+func workerWALDir(root string, worker int) string {
+	return filepath.Join(root, fmt.Sprintf("%04d", worker))
+}
+
+func segmentPath(dir string, seq uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("%016d%s", seq, walExtension))
+}
+
+// openWAL starts a new segment with sequence number seq in dir.
+func openWAL(dir string, seq uint64, opts WALOptions) (*wal, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, errors.Wrap(err, "creating write ahead log directory")
+	}
+	l := &wal{
+		opts: opts,
+		dir:  dir,
+		seq:  seq,
+	}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *wal) open() error {
+	f, err := os.OpenFile(segmentPath(l.dir, l.seq), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return errors.Wrap(err, "opening write ahead log segment")
+	}
+	l.file = f
+	l.buf = bufio.NewWriter(f)
+	l.size = 0
+	l.newest = 0
+	return nil
+}
+
+// append logs the write of elt to key, a series with labels. Source is the position of the message the element was
+// read from, or nil if it was not read from an ingestion source.
+func (l *wal) append(key string, labels Labels, elt api.Element, source *SourceOffset) error {
+	kind := walRecordWrite
+	if source != nil {
+		kind = walRecordSourceWrite
+	} else if len(labels) > 0 {
+		kind = walRecordLabelledWrite
+	}
+	record := l.record(kind, key)
+	record = appendVarint(record, elt.Timestamp)
+	record = appendUvarint(record, uint64(len(elt.Data)))
+	record = append(record, elt.Data...)
+	if kind != walRecordWrite {
+		record = appendUvarint(record, uint64(len(labels)))
+		for _, name := range labels.names() {
+			record = appendString(record, name)
+			record = appendString(record, labels[name])
+		}
+	}
+	if source != nil {
+		record = appendString(record, source.Topic)
+		record = appendVarint(record, int64(source.Partition))
+		record = appendVarint(record, source.Offset)
+	}
+	return l.write(record, elt.Timestamp)
+}
+
+// appendDelete logs the removal of the elements of key with timestamps in [first, last).
+func (l *wal) appendDelete(key string, first, last int64) error {
+	record := l.record(walRecordDelete, key)
+	record = appendVarint(record, first)
+	record = appendVarint(record, last)
+	return l.write(record, last-1)
+}
+
+// record starts a record of type kind for key, leaving room for the header.
+func (l *wal) record(kind byte, key string) []byte {
+	record := append(l.scratch[:0], make([]byte, walHeaderSize)...)
+	record = append(record, kind)
+	return appendString(record, key)
+}
+
+// write fills in the header of record and adds it to the log. Newest is the most recent element timestamp the record
+// refers to, the segment is kept until that timestamp expires.
+func (l *wal) write(record []byte, newest int64) error {
+	l.scratch = record
+	payload := record[walHeaderSize:]
+	binary.LittleEndian.PutUint32(record[0:4], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(record[4:8], crc32.Checksum(payload, walTable))
+	if _, err := l.buf.Write(record); err != nil {
+		return errors.Wrap(err, "writing to write ahead log")
+	}
+	l.size += int64(len(record))
+	if newest > l.newest {
+		l.newest = newest
+	}
+
+	if l.opts.Sync == SyncAlways {
+		if err := l.sync(); err != nil {
+			return err
+		}
+	}
+	if l.size >= l.opts.SegmentSize {
+		return l.rotate()
+	}
+	return nil
+}
+
+// sync hands buffered records to the operating system and, unless the policy is SyncNever, flushes them to disk.
+func (l *wal) sync() error {
+	if err := l.buf.Flush(); err != nil {
+		return errors.Wrap(err, "flushing write ahead log")
+	}
+	if l.opts.Sync == SyncNever {
+		return nil
+	}
+	return errors.Wrap(l.file.Sync(), "syncing write ahead log")
+}
+
+// rotate closes the current segment and starts a new one.
+func (l *wal) rotate() error {
+	if err := l.close(); err != nil {
+		return err
+	}
+	l.closed = append(l.closed, segment{path: l.file.Name(), newest: l.newest})
+	l.seq++
+	return l.open()
+}
+
+// truncate removes closed segments that only hold elements older than cutOff.
+func (l *wal) truncate(cutOff int64) error {
+	var (
+		remaining []segment
+		err       error
+	)
+	for _, seg := range l.closed {
+		if seg.newest >= cutOff {
+			remaining = append(remaining, seg)
+			continue
+		}
+		if e := os.Remove(seg.path); e != nil && !os.IsNotExist(e) {
+			remaining = append(remaining, seg)
+			err = errors.Wrap(e, "removing write ahead log segment")
+		}
+	}
+	l.closed = remaining
+	return err
+}
+
+func (l *wal) close() error {
+	if err := l.sync(); err != nil {
+		l.file.Close()
+		return err
+	}
+	return errors.Wrap(l.file.Close(), "closing write ahead log segment")
+}
+
+// walDirs returns the worker directories found below root keyed by worker index.
+func walDirs(root string) (map[int]string, error) {
+	entries, err := ioutil.ReadDir(root)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "reading write ahead log directory")
+	}
+	dirs := make(map[int]string)
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		i, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		dirs[i] = filepath.Join(root, entry.Name())
+	}
+	return dirs, nil
+}
+
+// segments returns the sequence numbers of the segments in dir in ascending order.
+func segments(dir string) ([]uint64, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading write ahead log directory")
+	}
+	var seqs []uint64
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, walExtension) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, walExtension), 10, 64)
+		if err != nil {
+			continue
+		}
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	return seqs, nil
+}
+
+// errTornRecord indicates a segment ends with a partially written or corrupt record.
+var errTornRecord = errors.New("write ahead log record is incomplete or corrupt")
+
+// walRecord is a decoded log record. Writes hold an element, the labels of the series, if any, and the position of
+// the message the element was read from, if any. Deletes hold the range [first, last) that was removed.
+type walRecord struct {
+	kind   byte
+	key    string
+	elt    api.Element
+	labels Labels
+	source *SourceOffset
+	first  int64
+	last   int64
+}
+
+// newest returns the most recent element timestamp the record refers to.
+func (r *walRecord) newest() int64 {
+	if r.kind == walRecordDelete {
+		return r.last - 1
+	}
+	return r.elt.Timestamp
+}
+
+// readSegment passes every record in a segment to fn and returns the newest timestamp found. Reading stops at the
+// first incomplete or corrupt record, which is expected if the process stopped in the middle of a write, and
+// errTornRecord is returned along with the records that could be read.
+func readSegment(path string, fn func(rec walRecord)) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, errors.Wrap(err, "opening write ahead log segment")
+	}
+	defer f.Close()
+
+	var (
+		newest  int64
+		header  [walHeaderSize]byte
+		payload []byte
+	)
+	r := bufio.NewReader(f)
+	for {
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			if err == io.EOF {
+				return newest, nil
+			}
+			return newest, errTornRecord
+		}
+		size := binary.LittleEndian.Uint32(header[0:4])
+		if cap(payload) < int(size) {
+			payload = make([]byte, size)
+		}
+		payload = payload[:size]
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return newest, errTornRecord
+		}
+		if crc32.Checksum(payload, walTable) != binary.LittleEndian.Uint32(header[4:8]) {
+			return newest, errTornRecord
+		}
+		rec, err := decodeWALRecord(payload)
+		if err != nil {
+			return newest, err
+		}
+		if rec.newest() > newest {
+			newest = rec.newest()
+		}
+		fn(rec)
+	}
+}
+
+func decodeWALRecord(payload []byte) (walRecord, error) {
+	var rec walRecord
+	if len(payload) == 0 || payload[0] < walRecordWrite || payload[0] > walRecordSourceWrite {
+		return rec, errTornRecord
+	}
+	rec.kind = payload[0]
+	key, payload, ok := readString(payload[1:])
+	if !ok {
+		return rec, errTornRecord
+	}
+	rec.key = key
+	ts, n := binary.Varint(payload)
+	if n <= 0 {
+		return rec, errTornRecord
+	}
+	payload = payload[n:]
+
+	if rec.kind == walRecordDelete {
+		last, n := binary.Varint(payload)
+		if n <= 0 || n != len(payload) {
+			return rec, errTornRecord
+		}
+		rec.first, rec.last = ts, last
+		return rec, nil
+	}
+	data, payload, ok := readString(payload)
+	if !ok {
+		return rec, errTornRecord
+	}
+	rec.elt.Timestamp = ts
+	if len(data) > 0 {
+		rec.elt.Data = []byte(data)
+	}
+	if rec.kind == walRecordLabelledWrite || rec.kind == walRecordSourceWrite {
+		count, n := binary.Uvarint(payload)
+		if n <= 0 || count > uint64(len(payload)) {
+			return rec, errTornRecord
+		}
+		payload = payload[n:]
+		rec.labels = make(Labels, count)
+		for ; count > 0; count-- {
+			var name, value string
+			if name, payload, ok = readString(payload); !ok {
+				return rec, errTornRecord
+			}
+			if value, payload, ok = readString(payload); !ok {
+				return rec, errTornRecord
+			}
+			rec.labels[name] = value
+		}
+	}
+	if rec.kind == walRecordSourceWrite {
+		var src SourceOffset
+		if src.Topic, payload, ok = readString(payload); !ok {
+			return rec, errTornRecord
+		}
+		partition, n := binary.Varint(payload)
+		if n <= 0 {
+			return rec, errTornRecord
+		}
+		payload = payload[n:]
+		if src.Offset, n = binary.Varint(payload); n <= 0 {
+			return rec, errTornRecord
+		}
+		payload = payload[n:]
+		src.Partition = int32(partition)
+		rec.source = &src
+	}
+	if len(payload) != 0 {
+		return rec, errTornRecord
+	}
+	return rec, nil
+}
+
+// readString reads a length prefixed string from the start of buf, returning the remainder of buf.
+func readString(buf []byte) (string, []byte, bool) {
+	size, n := binary.Uvarint(buf)
+	if n <= 0 || uint64(len(buf)-n) < size {
+		return "", nil, false
+	}
+	return string(buf[n : n+int(size)]), buf[n+int(size):], true
+}
+
+func appendString(buf []byte, s string) []byte {
+	buf = appendUvarint(buf, uint64(len(s)))
+	return append(buf, s...)
+}
+
+func appendUvarint(buf []byte, v uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	return append(buf, tmp[:binary.PutUvarint(tmp[:], v)]...)
+}
+
+func appendVarint(buf []byte, v int64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	return append(buf, tmp[:binary.PutVarint(tmp[:], v)]...)
+}
+
+// dirSegment is a log segment in a worker directory.
+type dirSegment struct {
+	dir int
+	seq uint64
+}
+
+// recoveredOffsets reads the segments that will be replayed and returns, for each partition of an ingestion source,
+// the offset of the last message whose writes are all held by the log, merged with the offsets loaded from a snapshot.
+// The offsets are recorded so that the source resumes after them.
+func (s *storage) recoveredOffsets(
+	dirs map[int]string,
+	all []dirSegment,
+	covered func(int, uint64) bool,
+) map[topicPartition]int64 {
+	newest := make(map[topicPartition]map[int]int64)
+	for _, ds := range all {
+		if covered(ds.dir, ds.seq) {
+			continue
+		}
+		// torn records are reported when the segment is replayed
+		readSegment(segmentPath(dirs[ds.dir], ds.seq), func(rec walRecord) {
+			if rec.source == nil {
+				return
+			}
+			tp := topicPartition{rec.source.Topic, rec.source.Partition}
+			if newest[tp] == nil {
+				newest[tp] = make(map[int]int64)
+			}
+			if offset, ok := newest[tp][ds.dir]; !ok || rec.source.Offset > offset {
+				newest[tp][ds.dir] = rec.source.Offset
+			}
+		})
+	}
+
+	s.offsets.Lock()
+	defer s.offsets.Unlock()
+	recovered := make(map[topicPartition]int64, len(newest))
+	for tp, byDir := range newest {
+		first := true
+		for _, offset := range byDir {
+			if first || offset < recovered[tp] {
+				recovered[tp], first = offset, false
+			}
+		}
+		if offset, ok := s.offsets.m[tp]; !ok || recovered[tp] > offset {
+			s.offsets.m[tp] = recovered[tp]
+		}
+		recovered[tp] = s.offsets.m[tp]
+	}
+	return recovered
+}
+
+// recover replays the write ahead log into workers and opens a new log segment for each of them. Segments written
+// by earlier runs are kept until the elements they hold expire. Segments left by workers that no longer exist,
+// because the worker count was reduced, are handed to the remaining workers. Segments in worker directory i with a
+// sequence number below skip[i] are covered by a snapshot and are not replayed. Directories missing from skip were
+// not written by the run that took the snapshot, so their segments are covered if they are older than that run.
+//
+// Every run starts its segments after the highest sequence number found in any directory, so replaying segments in
+// sequence order applies a delete after every write to the same key made by an earlier run, even if the key was
+// owned by a different worker at the time.
+//
+// Writes read from an ingestion source record the position of their message. A worker logs the writes of each
+// partition in offset order, so every element of a message up to the newest offset a directory holds was recovered
+// from that directory. The lowest of those offsets across directories is the last message recovered in full and
+// becomes the offset the source resumes after. Writes from later messages are not replayed, as the source will read
+// them again.
+func (s *storage) recover(workers []*worker, skip map[int]uint64) error {
+	root := s.opts.WAL.Dir
+	dirs, err := walDirs(root)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UnixNano()
+	var recovered map[topicPartition]int64
+	replay := func(rec walRecord) {
+		if rec.source != nil && rec.source.Offset > recovered[topicPartition{rec.source.Topic, rec.source.Partition}] {
+			return
+		}
+		w := workers[s.calculateWorkerPartition(rec.key)]
+		if rec.kind == walRecordDelete {
+			s.remove(w, rec.key, rec.first, rec.last, nil)
+			return
+		}
+		if rec.elt.Timestamp < now-int64(s.opts.maxAgeFor(rec.key)) {
+			return
+		}
+		s.insert(w, rec.key, rec.elt)
+		w.label(rec.key, rec.labels)
+	}
+
+	// New segments must sort after every segment the snapshot covers, even if those segments have been removed.
+	var next, oldest uint64
+	for _, cutOff := range skip {
+		if cutOff > next {
+			next = cutOff
+		}
+		if oldest == 0 || cutOff < oldest {
+			oldest = cutOff
+		}
+	}
+	covered := func(dir int, seq uint64) bool {
+		if cutOff, ok := skip[dir]; ok {
+			return seq < cutOff
+		}
+		return seq < oldest
+	}
+
+	var all []dirSegment
+	for i, dir := range dirs {
+		seqs, err := segments(dir)
+		if err != nil {
+			return err
+		}
+		for _, seq := range seqs {
+			all = append(all, dirSegment{dir: i, seq: seq})
+		}
+	}
+	sort.Slice(all, func(i, j int) bool {
+		if all[i].seq != all[j].seq {
+			return all[i].seq < all[j].seq
+		}
+		return all[i].dir < all[j].dir
+	})
+
+	recovered = s.recoveredOffsets(dirs, all, covered)
+
+	closed := make([][]segment, len(workers))
+	for _, ds := range all {
+		path := segmentPath(dirs[ds.dir], ds.seq)
+		fn := replay
+		if covered(ds.dir, ds.seq) {
+			fn = func(walRecord) {}
+		}
+		newest, err := readSegment(path, fn)
+		if err == errTornRecord {
+			s.logger.Log("msg", "write ahead log segment is truncated or corrupt", "segment", path)
+		} else if err != nil {
+			return err
+		}
+		owner := ds.dir % len(workers)
+		closed[owner] = append(closed[owner], segment{path: path, newest: newest})
+		if ds.seq >= next {
+			next = ds.seq + 1
+		}
+	}
+
+	for i, w := range workers {
+		if w.log, err = openWAL(workerWALDir(root, i), next, s.opts.WAL); err != nil {
+			return err
+		}
+		w.log.closed = closed[i]
+	}
+	return nil
+}
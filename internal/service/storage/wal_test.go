@@ -0,0 +1,109 @@
+package storage
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/murphybytes/gots/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWALRecovery(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gots-wal")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	now := time.Now()
+	expected := map[string][]api.Element{}
+	stg, err := New(testOptions(4, withWAL(dir)))
+	require.Nil(t, err)
+	for _, key := range []string{"A", "B", "C"} {
+		// expired elements are not recovered
+		stg.Write(context.Background(), key, now.Add(-2*time.Hour), []byte("old"))
+		for i := 0; i < 20; i++ {
+			ts := now.Add(time.Duration(i) * time.Millisecond)
+			stg.Write(context.Background(), key, ts, []byte(key))
+			expected[key] = append(expected[key], api.Element{Timestamp: ts.UnixNano(), Data: []byte(key)})
+		}
+	}
+	// searches wait for queued writes to be applied
+	for key := range expected {
+		_, err = stg.Search(context.Background(), key, api.NoLowerBound, api.NoUpperBound)
+		require.Nil(t, err)
+	}
+	require.Nil(t, stg.Close())
+
+	// recover with a different number of workers
+	for _, workers := range []int{4, 2, 7} {
+		stg, err = New(testOptions(workers, withWAL(dir)))
+		require.Nil(t, err)
+		for key, elts := range expected {
+			actual, err := stg.Search(context.Background(), key, api.NoLowerBound, api.NoUpperBound)
+			require.Nil(t, err)
+			assert.Equal(t, elts, actual)
+		}
+		require.Nil(t, stg.Close())
+	}
+}
+
+func TestWALTornRecord(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gots-wal")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	log, err := openWAL(dir, 0, WALOptions{Sync: SyncNever, SegmentSize: DefaultWALSegmentSize})
+	require.Nil(t, err)
+	require.Nil(t, log.append("A", nil, api.Element{Timestamp: 100, Data: []byte("hello")}, nil))
+	require.Nil(t, log.append("B", nil, api.Element{Timestamp: 200}, nil))
+	require.Nil(t, log.close())
+
+	path := segmentPath(dir, 0)
+	contents, err := ioutil.ReadFile(path)
+	require.Nil(t, err)
+	require.Nil(t, ioutil.WriteFile(path, contents[:len(contents)-1], 0644))
+
+	var keys []string
+	newest, err := readSegment(path, func(rec walRecord) {
+		keys = append(keys, rec.key)
+		assert.Equal(t, []byte("hello"), rec.elt.Data)
+	})
+	assert.Equal(t, errTornRecord, err)
+	assert.Equal(t, int64(100), newest)
+	assert.Equal(t, []string{"A"}, keys)
+}
+
+func TestWALTruncate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gots-wal")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	log, err := openWAL(dir, 0, WALOptions{Sync: SyncInterval, SegmentSize: 1})
+	require.Nil(t, err)
+	for ts := int64(100); ts < 500; ts += 100 {
+		require.Nil(t, log.append("A", nil, api.Element{Timestamp: ts}, nil))
+	}
+	require.Len(t, log.closed, 4)
+
+	require.Nil(t, log.truncate(300))
+	assert.Len(t, log.closed, 2)
+	files, err := filepath.Glob(filepath.Join(dir, "*"+walExtension))
+	require.Nil(t, err)
+	// two closed segments and the one being written
+	assert.Len(t, files, 3)
+	require.Nil(t, log.close())
+}
+
+func TestParseSyncPolicy(t *testing.T) {
+	for name, expected := range map[string]SyncPolicy{"always": SyncAlways, "interval": SyncInterval, "never": SyncNever} {
+		actual, err := ParseSyncPolicy(name)
+		require.Nil(t, err)
+		assert.Equal(t, expected, actual)
+	}
+	_, err := ParseSyncPolicy("sometimes")
+	assert.Error(t, err)
+}
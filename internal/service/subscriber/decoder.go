@@ -0,0 +1,359 @@
+package subscriber
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/golang/protobuf/proto"
+	"github.com/murphybytes/gots/api"
+	"github.com/murphybytes/gots/internal/service/storage"
+)
+
+// Record is a time series element decoded from a message along with the key and labels of its series. Timestamp is
+// zero if the time held by the payload is missing or invalid.
+type Record struct {
+	Key       string
+	Labels    storage.Labels
+	Timestamp time.Time
+	Data      []byte
+}
+
+// Decoder extracts time series elements from a Kafka message. A message may hold elements of several series.
+type Decoder interface {
+	Decode(msg *kafka.Message) ([]Record, error)
+}
+
+// ParseDecoder reads a decoder specification, the name of the decoder optionally followed by a colon and comma
+// separated settings. Settings that take several values separate them with |. For example
+//
+//	raw
+//	protobuf
+//	json:key=sym,timestamp=ts,format=ms,fields=px|size
+//	csv:key=0,timestamp=1,format=s,fields=px:2|size:3
+//
+// Format is one of the names accepted by ParseTimeFormat.
+func ParseDecoder(spec string) (Decoder, error) {
+	name, values, err := parseSpec(spec)
+	if err != nil {
+		return nil, err
+	}
+	format, err := ParseTimeFormat(values["format"])
+	if err != nil {
+		return nil, err
+	}
+
+	switch name {
+	case "raw":
+		return RawDecoder{}, nil
+	case "protobuf":
+		return ProtobufDecoder{}, nil
+	case "json":
+		d := JSONDecoder{Key: values["key"], Timestamp: values["timestamp"], TimeFormat: format}
+		if values["fields"] != "" {
+			d.Fields = strings.Split(values["fields"], "|")
+		}
+		return d, nil
+	case "csv":
+		d := CSVDecoder{KeyColumn: -1, TimestampColumn: -1, TimeFormat: format}
+		if v, ok := values["key"]; ok {
+			if d.KeyColumn, err = strconv.Atoi(v); err != nil {
+				return nil, fmt.Errorf("invalid key column '%s'", v)
+			}
+		}
+		if v, ok := values["timestamp"]; ok {
+			if d.TimestampColumn, err = strconv.Atoi(v); err != nil {
+				return nil, fmt.Errorf("invalid timestamp column '%s'", v)
+			}
+		}
+		if values["fields"] != "" {
+			for _, field := range strings.Split(values["fields"], "|") {
+				i := strings.LastIndex(field, ":")
+				if i < 0 {
+					return nil, fmt.Errorf("csv field '%s' is not of the form NAME:COLUMN", field)
+				}
+				column, err := strconv.Atoi(field[i+1:])
+				if err != nil {
+					return nil, fmt.Errorf("invalid column in csv field '%s'", field)
+				}
+				d.Fields = append(d.Fields, CSVField{Name: field[:i], Column: column})
+			}
+		}
+		return d, nil
+	}
+	return nil, fmt.Errorf("unknown decoder '%s'", name)
+}
+
+// parseSpec splits a specification into its name and the comma separated NAME=VALUE settings that may follow a
+// colon.
+func parseSpec(spec string) (string, map[string]string, error) {
+	name, settings := spec, ""
+	if i := strings.Index(spec, ":"); i >= 0 {
+		name, settings = spec[:i], spec[i+1:]
+	}
+	values := make(map[string]string)
+	if settings != "" {
+		for _, setting := range strings.Split(settings, ",") {
+			i := strings.Index(setting, "=")
+			if i < 0 {
+				return "", nil, fmt.Errorf("setting '%s' is not of the form NAME=VALUE", setting)
+			}
+			values[setting[:i]] = setting[i+1:]
+		}
+	}
+	return name, values, nil
+}
+
+// RawDecoder stores the message value in the series named by the message key, using the message timestamp. Headers
+// beginning with LabelHeaderPrefix set the labels of the series.
+type RawDecoder struct{}
+
+// Decode returns the message as a single record.
+func (RawDecoder) Decode(msg *kafka.Message) ([]Record, error) {
+	return []Record{{
+		Key:       string(msg.Key),
+		Labels:    headerLabels(msg.Headers),
+		Timestamp: msg.Timestamp,
+		Data:      msg.Value,
+	}}, nil
+}
+
+// ProtobufDecoder reads messages holding an api.Series. Each element of the series becomes a record. The message key
+// is used if the series has no key. Elements with a zero timestamp have no time.
+type ProtobufDecoder struct{}
+
+// Decode unmarshals the series held by the message.
+func (ProtobufDecoder) Decode(msg *kafka.Message) ([]Record, error) {
+	var series api.Series
+	if err := proto.Unmarshal(msg.Value, &series); err != nil {
+		return nil, err
+	}
+	key := series.Key
+	if key == "" {
+		key = string(msg.Key)
+	}
+	records := make([]Record, 0, len(series.Elements))
+	for _, elt := range series.Elements {
+		if elt == nil {
+			continue
+		}
+		var ts time.Time
+		if elt.Timestamp != 0 {
+			ts = time.Unix(0, elt.Timestamp)
+		}
+		records = append(records, Record{
+			Key:       key,
+			Labels:    storage.Labels(series.Labels),
+			Timestamp: ts,
+			Data:      elt.Data,
+		})
+	}
+	return records, nil
+}
+
+// JSONDecoder reads messages holding a JSON object or an array of objects, each of which is decoded separately.
+// Fields are found by paths of object keys separated by dots, for example quote.px. Headers beginning with
+// LabelHeaderPrefix set the labels of the series.
+type JSONDecoder struct {
+	// Key is the path of the field holding the series key. The message key is used if Key is empty.
+	Key string
+	// Timestamp is the path of the field holding the time, a number or string in TimeFormat. The message timestamp
+	// is used if Timestamp is empty.
+	Timestamp string
+	// TimeFormat of timestamps. Defaults to UnixNano.
+	TimeFormat TimeFormat
+	// Fields are the paths of the values to store. Each field is stored in its own series, named by the key followed
+	// by a dot and the path. Numbers are stored as eight byte, big endian, float64 values, strings as their bytes and
+	// other values as JSON. If Fields is empty the whole object is stored under the key.
+	Fields []string
+}
+
+// Decode returns a record for each field of each object in the message.
+func (d JSONDecoder) Decode(msg *kafka.Message) ([]Record, error) {
+	items := []json.RawMessage{msg.Value}
+	if value := bytes.TrimSpace(msg.Value); len(value) > 0 && value[0] == '[' {
+		if err := json.Unmarshal(value, &items); err != nil {
+			return nil, err
+		}
+	}
+
+	labels := headerLabels(msg.Headers)
+	var records []Record
+	for _, item := range items {
+		dec := json.NewDecoder(bytes.NewReader(item))
+		dec.UseNumber()
+		var object map[string]interface{}
+		if err := dec.Decode(&object); err != nil {
+			return nil, err
+		}
+		key := string(msg.Key)
+		if d.Key != "" {
+			v, err := jsonField(object, d.Key)
+			if err != nil {
+				return nil, err
+			}
+			key = jsonString(v)
+		}
+		ts := msg.Timestamp
+		if d.Timestamp != "" {
+			ts = time.Time{}
+			if v, err := jsonField(object, d.Timestamp); err == nil {
+				ts = jsonTime(v, d.TimeFormat)
+			}
+		}
+		if len(d.Fields) == 0 {
+			records = append(records, Record{Key: key, Labels: labels, Timestamp: ts, Data: []byte(item)})
+			continue
+		}
+		for _, path := range d.Fields {
+			v, err := jsonField(object, path)
+			if err != nil {
+				return nil, err
+			}
+			records = append(records, Record{Key: key + "." + path, Labels: labels, Timestamp: ts, Data: jsonValue(v)})
+		}
+	}
+	return records, nil
+}
+
+// jsonField returns the value found by following a path of object keys separated by dots.
+func jsonField(object map[string]interface{}, path string) (interface{}, error) {
+	var value interface{} = object
+	for _, name := range strings.Split(path, ".") {
+		o, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("field '%s' not found", path)
+		}
+		if value, ok = o[name]; !ok {
+			return nil, fmt.Errorf("field '%s' not found", path)
+		}
+	}
+	return value, nil
+}
+
+// jsonValue encodes a value for storage. Numbers are eight byte floats, strings their bytes and anything else JSON.
+func jsonValue(v interface{}) []byte {
+	switch value := v.(type) {
+	case json.Number:
+		if f, err := value.Float64(); err == nil {
+			return float64Bytes(f)
+		}
+		return []byte(value)
+	case string:
+		return []byte(value)
+	}
+	data, _ := json.Marshal(v)
+	return data
+}
+
+// jsonString returns strings unchanged and anything else as JSON, so that a number can be used as a key.
+func jsonString(v interface{}) string {
+	if value, ok := v.(string); ok {
+		return value
+	}
+	data, _ := json.Marshal(v)
+	return string(data)
+}
+
+// jsonTime reads a number or string in format, returning zero if it cannot be read.
+func jsonTime(v interface{}, format TimeFormat) time.Time {
+	var value string
+	switch v := v.(type) {
+	case json.Number:
+		value = string(v)
+	case string:
+		value = v
+	default:
+		return time.Time{}
+	}
+	ts, _ := format.Parse(value)
+	return ts
+}
+
+// CSVField names a column of a CSV message.
+type CSVField struct {
+	Name   string
+	Column int
+}
+
+// CSVDecoder reads messages holding lines of comma separated values, each of which is decoded separately. Columns
+// are numbered from zero. Headers beginning with LabelHeaderPrefix set the labels of the series.
+type CSVDecoder struct {
+	// KeyColumn holds the series key. The message key is used if KeyColumn is negative.
+	KeyColumn int
+	// TimestampColumn holds the time in TimeFormat. The message timestamp is used if TimestampColumn is negative.
+	TimestampColumn int
+	// TimeFormat of timestamps. Defaults to UnixNano.
+	TimeFormat TimeFormat
+	// Fields are the columns to store. Each field is stored in its own series, named by the key followed by a dot and
+	// the field name. Numbers are stored as eight byte, big endian, float64 values and anything else as its bytes. If
+	// Fields is empty the columns of the line are joined by commas and stored under the key.
+	Fields []CSVField
+}
+
+// Decode returns a record for each field of each line in the message.
+func (d CSVDecoder) Decode(msg *kafka.Message) ([]Record, error) {
+	r := csv.NewReader(bytes.NewReader(msg.Value))
+	r.FieldsPerRecord = -1
+	labels := headerLabels(msg.Headers)
+	var records []Record
+	for {
+		line, err := r.Read()
+		if err == io.EOF {
+			return records, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		column := func(i int) (string, error) {
+			if i >= len(line) {
+				return "", fmt.Errorf("line has %d columns, column %d is missing", len(line), i)
+			}
+			return line[i], nil
+		}
+
+		key := string(msg.Key)
+		if d.KeyColumn >= 0 {
+			if key, err = column(d.KeyColumn); err != nil {
+				return nil, err
+			}
+		}
+		ts := msg.Timestamp
+		if d.TimestampColumn >= 0 {
+			ts = time.Time{}
+			if v, err := column(d.TimestampColumn); err == nil {
+				ts, _ = d.TimeFormat.Parse(v)
+			}
+		}
+		if len(d.Fields) == 0 {
+			records = append(records, Record{Key: key, Labels: labels, Timestamp: ts, Data: []byte(strings.Join(line, ","))})
+			continue
+		}
+		for _, field := range d.Fields {
+			v, err := column(field.Column)
+			if err != nil {
+				return nil, err
+			}
+			data := []byte(v)
+			if f, err := strconv.ParseFloat(strings.TrimSpace(v), 64); err == nil {
+				data = float64Bytes(f)
+			}
+			records = append(records, Record{Key: key + "." + field.Name, Labels: labels, Timestamp: ts, Data: data})
+		}
+	}
+}
+
+// float64Bytes encodes f as storage.EncodingFloat64.
+func float64Bytes(f float64) []byte {
+	data := make([]byte, 8)
+	binary.BigEndian.PutUint64(data, math.Float64bits(f))
+	return data
+}
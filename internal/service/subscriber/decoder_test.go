@@ -0,0 +1,137 @@
+package subscriber
+
+import (
+	"testing"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/golang/protobuf/proto"
+	"github.com/murphybytes/gots/api"
+	"github.com/murphybytes/gots/internal/service/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func mustParseDecoder(t *testing.T, spec string) Decoder {
+	d, err := ParseDecoder(spec)
+	require.Nil(t, err)
+	return d
+}
+
+func TestRawDecoder(t *testing.T) {
+	now := time.Now()
+	records, err := mustParseDecoder(t, "raw").Decode(&kafka.Message{
+		Key:       []byte("ibm"),
+		Value:     []byte("100.5"),
+		Timestamp: now,
+		Headers:   []kafka.Header{{Key: "label.venue", Value: []byte("arca")}},
+	})
+	require.Nil(t, err)
+	assert.Equal(t, []Record{{
+		Key:       "ibm",
+		Labels:    storage.Labels{"venue": "arca"},
+		Timestamp: now,
+		Data:      []byte("100.5"),
+	}}, records)
+}
+
+func TestJSONDecoder(t *testing.T) {
+	now := time.Now()
+	d := mustParseDecoder(t, "json:key=sym,timestamp=ts,format=ms,fields=px|quote.size")
+	records, err := d.Decode(&kafka.Message{
+		Value: []byte(`[{"sym":"ibm","ts":1500000000000,"px":100.5,"quote":{"size":200}},{"sym":"aapl","ts":1500000000001,"px":"n/a","quote":{"size":[1]}}]`),
+	})
+	require.Nil(t, err)
+	assert.Equal(t, []Record{
+		{Key: "ibm.px", Timestamp: time.Unix(1500000000, 0), Data: float64Bytes(100.5)},
+		{Key: "ibm.quote.size", Timestamp: time.Unix(1500000000, 0), Data: float64Bytes(200)},
+		{Key: "aapl.px", Timestamp: time.Unix(1500000000, int64(time.Millisecond)), Data: []byte("n/a")},
+		{Key: "aapl.quote.size", Timestamp: time.Unix(1500000000, int64(time.Millisecond)), Data: []byte("[1]")},
+	}, records)
+
+	// without fields the object is stored under the message key and timestamp
+	value := []byte(`{"px": 100.5}`)
+	records, err = mustParseDecoder(t, "json").Decode(&kafka.Message{Key: []byte("ibm"), Value: value, Timestamp: now})
+	require.Nil(t, err)
+	assert.Equal(t, []Record{{Key: "ibm", Timestamp: now, Data: value}}, records)
+
+	records, err = mustParseDecoder(t, "json:key=id,timestamp=at,format=rfc3339").Decode(&kafka.Message{
+		Value: []byte(`{"id": 42, "at": "2017-07-14T02:40:00Z"}`),
+	})
+	require.Nil(t, err)
+	require.Len(t, records, 1)
+	assert.Equal(t, "42", records[0].Key)
+	assert.True(t, time.Date(2017, 7, 14, 2, 40, 0, 0, time.UTC).Equal(records[0].Timestamp))
+
+	for _, value := range []string{`{"sym": "ibm"`, `{"px": 1}`} {
+		_, err = d.Decode(&kafka.Message{Value: []byte(value)})
+		assert.NotNil(t, err, value)
+	}
+
+	// missing and invalid times are left zero for the timestamp settings of the topic to resolve
+	for _, value := range []string{
+		`{"sym": "ibm", "px": 1, "quote": {"size": 1}}`,
+		`{"sym": "ibm", "ts": true, "px": 1, "quote": {"size": 1}}`,
+	} {
+		records, err = d.Decode(&kafka.Message{Value: []byte(value), Timestamp: now})
+		require.Nil(t, err)
+		require.Len(t, records, 2)
+		assert.True(t, records[0].Timestamp.IsZero(), value)
+	}
+}
+
+func TestCSVDecoder(t *testing.T) {
+	d := mustParseDecoder(t, "csv:key=0,timestamp=1,format=s,fields=px:2|venue:3")
+	records, err := d.Decode(&kafka.Message{
+		Value:   []byte("ibm,1500000000,100.5,arca\naapl,1500000001,150,bats\n"),
+		Headers: []kafka.Header{{Key: "label.source", Value: []byte("feed")}},
+	})
+	require.Nil(t, err)
+	labels := storage.Labels{"source": "feed"}
+	assert.Equal(t, []Record{
+		{Key: "ibm.px", Labels: labels, Timestamp: time.Unix(1500000000, 0), Data: float64Bytes(100.5)},
+		{Key: "ibm.venue", Labels: labels, Timestamp: time.Unix(1500000000, 0), Data: []byte("arca")},
+		{Key: "aapl.px", Labels: labels, Timestamp: time.Unix(1500000001, 0), Data: float64Bytes(150)},
+		{Key: "aapl.venue", Labels: labels, Timestamp: time.Unix(1500000001, 0), Data: []byte("bats")},
+	}, records)
+
+	_, err = d.Decode(&kafka.Message{Value: []byte("ibm,1500000000")})
+	assert.NotNil(t, err)
+	records, err = d.Decode(&kafka.Message{Value: []byte("ibm,yesterday,100.5,arca")})
+	require.Nil(t, err)
+	assert.True(t, records[0].Timestamp.IsZero())
+}
+
+func TestProtobufDecoder(t *testing.T) {
+	value, err := proto.Marshal(&api.Series{
+		Labels: map[string]string{"venue": "arca"},
+		Elements: []*api.Element{
+			{Timestamp: 1, Data: []byte("a")},
+			{Timestamp: 2, Data: []byte("b")},
+		},
+	})
+	require.Nil(t, err)
+	records, err := mustParseDecoder(t, "protobuf").Decode(&kafka.Message{Key: []byte("ibm"), Value: value})
+	require.Nil(t, err)
+	labels := storage.Labels{"venue": "arca"}
+	assert.Equal(t, []Record{
+		{Key: "ibm", Labels: labels, Timestamp: time.Unix(0, 1), Data: []byte("a")},
+		{Key: "ibm", Labels: labels, Timestamp: time.Unix(0, 2), Data: []byte("b")},
+	}, records)
+}
+
+func TestParseDecoder(t *testing.T) {
+	d, err := ParseDecoder("csv:fields=px:1")
+	require.Nil(t, err)
+	assert.Equal(t, CSVDecoder{
+		KeyColumn:       -1,
+		TimestampColumn: -1,
+		TimeFormat:      UnixNano,
+		Fields:          []CSVField{{Name: "px", Column: 1}},
+	}, d)
+
+	for _, spec := range []string{"avro", "json:key", "json:format=days", "csv:key=first", "csv:fields=px"} {
+		_, err := ParseDecoder(spec)
+		assert.NotNil(t, err, spec)
+	}
+}
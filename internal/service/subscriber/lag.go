@@ -0,0 +1,164 @@
+package subscriber
+
+import (
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+)
+
+// DefaultMaxReadyLag is the number of messages each partition may be behind while the subscriber is ready.
+const DefaultMaxReadyLag = 1000
+
+type partition struct {
+	topic     string
+	partition int32
+}
+
+// watermarks returns the low and high offsets of a partition.
+type watermarks func(topic string, partition int32) (low, high int64, err error)
+
+// committed returns the offsets committed by the consumer group for partitions.
+type committed func(partitions []kafka.TopicPartition) ([]kafka.TopicPartition, error)
+
+// lagTracker follows how far the consumer is behind the end of each assigned partition. It is owned by the consumer
+// goroutine.
+type lagTracker struct {
+	maxLag   int64
+	assigned bool
+	// next is the offset of the next message to consume from each partition, negative until it is known.
+	next map[partition]int64
+	// lag is the number of messages each partition is behind, negative until it is known.
+	lag map[partition]int64
+}
+
+func newLagTracker(maxLag int64) *lagTracker {
+	return &lagTracker{
+		maxLag: maxLag,
+		next:   make(map[partition]int64),
+		lag:    make(map[partition]int64),
+	}
+}
+
+// assign starts tracking partitions from the offsets they are assigned at.
+func (l *lagTracker) assign(partitions []kafka.TopicPartition) {
+	l.revoke()
+	l.assigned = true
+	for _, p := range partitions {
+		if p.Topic == nil {
+			continue
+		}
+		key := partition{*p.Topic, p.Partition}
+		l.next[key] = int64(p.Offset)
+		l.lag[key] = -1
+	}
+}
+
+// revoke stops tracking every partition. The consumer is not ready until partitions are assigned again.
+func (l *lagTracker) revoke() {
+	l.assigned = false
+	l.next = make(map[partition]int64)
+	l.lag = make(map[partition]int64)
+}
+
+// consumed records that the message at tp was read.
+func (l *lagTracker) consumed(tp kafka.TopicPartition) {
+	if tp.Topic == nil {
+		return
+	}
+	key := partition{*tp.Topic, tp.Partition}
+	if _, ok := l.next[key]; ok {
+		l.next[key] = int64(tp.Offset) + 1
+	}
+}
+
+// eof records that the consumer reached the end of a partition.
+func (l *lagTracker) eof(tp kafka.TopicPartition) {
+	if tp.Topic == nil {
+		return
+	}
+	key := partition{*tp.Topic, tp.Partition}
+	if _, ok := l.next[key]; ok {
+		l.next[key] = int64(tp.Offset)
+		l.lag[key] = 0
+	}
+}
+
+// update resolves the position of partitions assigned at a logical offset and then recalculates the lag of each
+// partition whose position is known from its high watermark, calling report with the lag of each.
+func (l *lagTracker) update(offsets watermarks, stored committed, report func(partition, int64)) {
+	l.resolve(offsets, stored)
+	for key, next := range l.next {
+		if next < 0 {
+			continue
+		}
+		_, high, err := offsets(key.topic, key.partition)
+		if err != nil || high < 0 {
+			continue
+		}
+		lag := high - next
+		if lag < 0 {
+			lag = 0
+		}
+		l.lag[key] = lag
+		report(key, lag)
+	}
+}
+
+// resolve replaces the logical offsets that partitions were assigned at with the position they stand for. The
+// beginning and end are the low and high watermarks and the stored offset is the offset committed by the consumer
+// group. Partitions without a committed offset are taken to start at the low watermark, as the consumer resets to the
+// earliest offset; with other reset policies their lag is overstated until a message or the end is reached.
+func (l *lagTracker) resolve(offsets watermarks, stored committed) {
+	var unknown []kafka.TopicPartition
+	for key, next := range l.next {
+		switch kafka.Offset(next) {
+		case kafka.OffsetBeginning, kafka.OffsetEnd:
+			low, high, err := offsets(key.topic, key.partition)
+			if err != nil || low < 0 || high < 0 {
+				continue
+			}
+			if kafka.Offset(next) == kafka.OffsetEnd {
+				l.next[key] = high
+			} else {
+				l.next[key] = low
+			}
+		case kafka.OffsetStored, kafka.OffsetInvalid:
+			topic := key.topic
+			unknown = append(unknown, kafka.TopicPartition{Topic: &topic, Partition: key.partition})
+		}
+	}
+	if len(unknown) == 0 {
+		return
+	}
+	positions, err := stored(unknown)
+	if err != nil {
+		return
+	}
+	for _, p := range positions {
+		if p.Topic == nil || p.Error != nil {
+			continue
+		}
+		key := partition{*p.Topic, p.Partition}
+		if next, ok := l.next[key]; !ok || next >= 0 {
+			continue
+		}
+		if p.Offset >= 0 {
+			l.next[key] = int64(p.Offset)
+			continue
+		}
+		if low, _, err := offsets(key.topic, key.partition); err == nil && low >= 0 {
+			l.next[key] = low
+		}
+	}
+}
+
+// ready returns true once partitions are assigned and none of them is more than maxLag messages behind.
+func (l *lagTracker) ready() bool {
+	if !l.assigned {
+		return false
+	}
+	for _, lag := range l.lag {
+		if lag < 0 || lag > l.maxLag {
+			return false
+		}
+	}
+	return true
+}
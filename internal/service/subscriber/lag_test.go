@@ -0,0 +1,94 @@
+package subscriber
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLagTracker(t *testing.T) {
+	quotes := "quotes"
+	high := map[int32]int64{0: 5000, 1: 10}
+	offsets := func(topic string, p int32) (int64, int64, error) {
+		if h, ok := high[p]; ok {
+			return 0, h, nil
+		}
+		return 0, 0, errors.New("unknown partition")
+	}
+	// the group coordinator is unavailable until commits are set
+	var commits map[int32]kafka.Offset
+	stored := func(partitions []kafka.TopicPartition) ([]kafka.TopicPartition, error) {
+		if commits == nil {
+			return nil, errors.New("coordinator not available")
+		}
+		result := make([]kafka.TopicPartition, len(partitions))
+		for i, p := range partitions {
+			result[i] = p
+			result[i].Offset = kafka.OffsetInvalid
+			if offset, ok := commits[p.Partition]; ok {
+				result[i].Offset = offset
+			}
+		}
+		return result, nil
+	}
+	reported := make(map[partition]int64)
+	report := func(p partition, n int64) {
+		reported[p] = n
+	}
+
+	lag := newLagTracker(100)
+	assert.False(t, lag.ready(), "not ready before partitions are assigned")
+
+	lag.assign([]kafka.TopicPartition{
+		{Topic: &quotes, Partition: 0, Offset: 1000},
+		{Topic: &quotes, Partition: 1, Offset: kafka.OffsetInvalid},
+	})
+	lag.update(offsets, stored, report)
+	assert.Equal(t, map[partition]int64{{"quotes", 0}: 4000}, reported)
+	assert.False(t, lag.ready(), "partition 1 has no known position")
+
+	lag.consumed(kafka.TopicPartition{Topic: &quotes, Partition: 1, Offset: 9})
+	lag.update(offsets, stored, report)
+	assert.Equal(t, int64(0), reported[partition{"quotes", 1}])
+	assert.False(t, lag.ready(), "partition 0 is too far behind")
+
+	lag.consumed(kafka.TopicPartition{Topic: &quotes, Partition: 0, Offset: 4950})
+	lag.update(offsets, stored, report)
+	assert.Equal(t, int64(49), reported[partition{"quotes", 0}])
+	assert.True(t, lag.ready())
+
+	lag.revoke()
+	assert.False(t, lag.ready(), "not ready while partitions are revoked")
+
+	// partitions with nothing to replay are ready once the consumer reaches their end
+	lag.assign([]kafka.TopicPartition{{Topic: &quotes, Partition: 2, Offset: kafka.OffsetEnd}})
+	lag.update(offsets, stored, report)
+	assert.False(t, lag.ready())
+	lag.eof(kafka.TopicPartition{Topic: &quotes, Partition: 2, Offset: 42})
+	assert.True(t, lag.ready())
+
+	lag.assign(nil)
+	assert.True(t, lag.ready(), "ready with no partitions assigned")
+
+	// partitions assigned at a logical offset are ready without reaching their end once their position is resolved
+	high[2], high[3], high[4] = 20, 30, 40
+	commits = map[int32]kafka.Offset{3: 25}
+	lag.assign([]kafka.TopicPartition{
+		{Topic: &quotes, Partition: 0, Offset: kafka.OffsetBeginning},
+		{Topic: &quotes, Partition: 2, Offset: kafka.OffsetEnd},
+		{Topic: &quotes, Partition: 3, Offset: kafka.OffsetStored},
+		{Topic: &quotes, Partition: 4, Offset: kafka.OffsetStored},
+	})
+	lag.update(offsets, stored, report)
+	assert.Equal(t, int64(5000), reported[partition{"quotes", 0}], "the beginning is the low watermark")
+	assert.Equal(t, int64(0), reported[partition{"quotes", 2}], "the end is the high watermark")
+	assert.Equal(t, int64(5), reported[partition{"quotes", 3}], "the stored offset is the committed offset")
+	assert.Equal(t, int64(40), reported[partition{"quotes", 4}], "no commit starts at the low watermark")
+	assert.False(t, lag.ready())
+	lag.consumed(kafka.TopicPartition{Topic: &quotes, Partition: 0, Offset: 4999})
+	lag.consumed(kafka.TopicPartition{Topic: &quotes, Partition: 4, Offset: 39})
+	lag.update(offsets, stored, report)
+	assert.True(t, lag.ready())
+}
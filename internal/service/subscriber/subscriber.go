@@ -2,75 +2,312 @@
 package subscriber
 
 import (
+	"context"
 	"fmt"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/confluentinc/confluent-kafka-go/kafka"
 	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/metrics"
+	"github.com/go-kit/kit/metrics/discard"
 	"github.com/murphybytes/gots/internal/config"
 	"github.com/murphybytes/gots/internal/service/storage"
 )
 
+// lagInterval is the time between updates of the consumer lag.
+const lagInterval = time.Second
+
+// LabelHeaderPrefix marks the message headers that hold labels of the series. A header named label.exchange sets
+// the exchange label to the header value.
+const LabelHeaderPrefix = "label."
+
 type svr struct {
-	closer chan struct{}
-	wait   sync.WaitGroup
-	logger log.Logger
+	cfg        *kafka.ConfigMap
+	closer     chan struct{}
+	wait       sync.WaitGroup
+	logger     log.Logger
+	decoders   map[string]Decoder
+	failures   metrics.Counter
+	timestamps map[string]Timestamps
+	missing    metrics.Counter
+	rewind     time.Duration
+	maxLag     int64
+	lagGauge   metrics.Gauge
+	ready      int32
+}
+
+// Option configures the subscriber.
+type Option func(*svr)
+
+// Decoders sets the decoder used for the messages of each topic. Topics without a decoder are read by RawDecoder.
+func Decoders(decoders map[string]Decoder) Option {
+	return func(s *svr) {
+		s.decoders = decoders
+	}
+}
+
+// DecodeFailures counts the messages that could not be decoded, labelled by topic.
+func DecodeFailures(counter metrics.Counter) Option {
+	return func(s *svr) {
+		s.failures = counter
+	}
+}
+
+// TimestampSources sets where the time of the elements of each topic comes from. Topics without an entry use
+// DefaultTimestamps.
+func TimestampSources(timestamps map[string]Timestamps) Option {
+	return func(s *svr) {
+		s.timestamps = timestamps
+	}
+}
+
+// MissingTimestamps counts the elements whose time was missing or invalid and which were given the fallback time or
+// dropped, labelled by topic.
+func MissingTimestamps(counter metrics.Counter) Option {
+	return func(s *svr) {
+		s.missing = counter
+	}
+}
+
+// Rewind starts assigned partitions without an offset recorded by storage at the first message produced within
+// maxAge of the assignment, so that a new instance rebuilds its retention window rather than resuming from the
+// offsets committed by the consumer group. Partitions this instance has already read from are not rewound when they
+// are assigned again after a rebalance. Message times are the Kafka timestamps. Zero keeps the committed offsets.
+func Rewind(maxAge time.Duration) Option {
+	return func(s *svr) {
+		s.rewind = maxAge
+	}
+}
+
+// MaxReadyLag is the number of messages each assigned partition may be behind while the subscriber is ready.
+func MaxReadyLag(n int64) Option {
+	return func(s *svr) {
+		s.maxLag = n
+	}
+}
+
+// ConsumerLag reports the number of messages each assigned partition is behind, labelled by topic and partition.
+func ConsumerLag(gauge metrics.Gauge) Option {
+	return func(s *svr) {
+		s.lagGauge = gauge
+	}
+}
+
+// New creates an ingestion source that consumes the Kafka topics named in the gots configuration.
+func New(cfg *kafka.ConfigMap, opts ...Option) *svr {
+	s := &svr{
+		cfg:      cfg,
+		closer:   make(chan struct{}),
+		failures: discard.NewCounter(),
+		missing:  discard.NewCounter(),
+		maxLag:   DefaultMaxReadyLag,
+		lagGauge: discard.NewGauge(),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// decoder returns the decoder for topic.
+func (s *svr) decoder(topic string) Decoder {
+	if d, ok := s.decoders[topic]; ok {
+		return d
+	}
+	return RawDecoder{}
+}
+
+// Ready returns true once partitions have been assigned and the consumer is no more than the maximum ready lag behind
+// on each of them. Searches made before then may be missing elements that are still being replayed.
+func (s *svr) Ready() bool {
+	return atomic.LoadInt32(&s.ready) == 1
+}
+
+// setReady records the readiness of the consumer, logging changes.
+func (s *svr) setReady(ready bool) {
+	var value int32
+	if ready {
+		value = 1
+	}
+	if atomic.SwapInt32(&s.ready, value) != value {
+		s.logger.Log(
+			"msg", "readiness changed",
+			"ready", ready,
+		)
+	}
 }
 
-// New creates a subscriber which writes messages received from publisher to storage.
-func New(wtr storage.Writer, cfg *kafka.ConfigMap, logger log.Logger) (*svr, error) {
-	svr := &svr{
-		closer: make(chan struct{}),
-		logger: log.With(logger, "component", "subscriber"),
+// timestampsFor returns the timestamp settings for topic.
+func (s *svr) timestampsFor(topic string) Timestamps {
+	if t, ok := s.timestamps[topic]; ok {
+		return t
 	}
+	return DefaultTimestamps
+}
+
+// Start subscribes to the topics and writes the messages received to wtr until Close is called. If wtr is also a
+// storage.Checkpointer the offset of each message is recorded after it is written, and partitions are resumed from
+// the recorded offsets when they are assigned. If wtr is a storage.Backpressure assigned partitions are paused while
+// storage is overloaded rather than blocking the consumer in Write. Messages are decoded by the decoder of their
+// topic, and messages that cannot be decoded are counted and skipped. The time of each element is then chosen by the
+// timestamp settings of the topic.
+func (s *svr) Start(wtr storage.Writer, logger log.Logger) error {
+	s.logger = log.With(logger, "component", "subscriber")
 
 	config, err := config.New()
 	if err != nil {
-		return nil, err
+		return err
 	}
 	c, err := kafka.NewConsumer(
-		cfg,
+		s.cfg,
 	)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	if err = c.SubscribeTopics(config.Kafka.Topics, nil); err != nil {
-		return nil, err
+		c.Close()
+		return err
 	}
-	svr.wait.Add(1)
+	checkpointer, _ := wtr.(storage.Checkpointer)
+	var overloaded <-chan bool
+	if bp, ok := wtr.(storage.Backpressure); ok {
+		overloaded = bp.Overloaded()
+	}
+	s.wait.Add(1)
 
 	go func(closer <-chan struct{}, wtr storage.Writer, consumer *kafka.Consumer) {
-		defer svr.wait.Done()
-		svr.logger.Log("msg", "starting")
-		defer svr.logger.Log("msg", "shutting down")
+		defer s.wait.Done()
+		s.logger.Log("msg", "starting")
+		defer s.logger.Log("msg", "shutting down")
+
+		var assigned []kafka.TopicPartition
+		var paused bool
+		// consumed holds the partitions this process has read messages from, which are never rewound again
+		consumed := make(map[partition]bool)
+		lag := newLagTracker(s.maxLag)
+		stored := func(partitions []kafka.TopicPartition) ([]kafka.TopicPartition, error) {
+			return c.Committed(partitions, config.Kafka.TimeoutMS())
+		}
+		ticker := time.NewTicker(lagInterval)
+		defer ticker.Stop()
 
 		for {
 			select {
 			case <-closer:
-				break
+				c.Close()
+				return
+			case paused = <-overloaded:
+				s.logger.Log(
+					"msg", "storage backpressure",
+					"paused", paused,
+				)
+				var err error
+				if paused {
+					err = c.Pause(assigned)
+				} else {
+					err = c.Resume(assigned)
+				}
+				if err != nil {
+					s.logger.Log(
+						"msg", "unable to pause or resume partitions",
+						"err", err,
+					)
+				}
+			case <-ticker.C:
+				lag.update(c.GetWatermarkOffsets, stored, func(p partition, n int64) {
+					s.lagGauge.With("topic", p.topic, "partition", strconv.Itoa(int(p.partition))).Set(float64(n))
+				})
+				s.setReady(lag.ready())
 			case evt := <-c.Events():
 				switch msg := evt.(type) {
 				case kafka.AssignedPartitions:
-					svr.logger.Log(
+					s.logger.Log(
 						"msg", "assigned partitions",
 						"details", fmt.Sprintf("%v", msg),
 					)
+					if checkpointer != nil {
+						resume(checkpointer, msg.Partitions)
+					}
+					if s.rewind > 0 {
+						err := rewind(c, msg.Partitions, consumed, time.Now().Add(-s.rewind), config.Kafka.TimeoutMS())
+						if err != nil {
+							s.logger.Log(
+								"msg", "unable to rewind partitions, using committed offsets",
+								"err", err,
+							)
+						}
+					}
 					c.Assign(msg.Partitions)
+					assigned = msg.Partitions
+					lag.assign(assigned)
+					s.setReady(lag.ready())
+					if paused {
+						c.Pause(assigned)
+					}
 				case kafka.RevokedPartitions:
-					svr.logger.Log(
+					s.logger.Log(
 						"msg", "unassign partitions",
 						"details", fmt.Sprintf("%v", msg),
 					)
 					c.Unassign()
+					assigned = nil
+					lag.revoke()
+					s.setReady(false)
 				case *kafka.Message:
-					wtr.Write(string(msg.Key), msg.Timestamp, msg.Value)
+					lag.consumed(msg.TopicPartition)
+					if msg.TopicPartition.Topic != nil {
+						consumed[partition{*msg.TopicPartition.Topic, msg.TopicPartition.Partition}] = true
+					}
+					topic := topicName(msg.TopicPartition.Topic)
+					records, err := s.decoder(topic).Decode(msg)
+					if err != nil {
+						s.failures.With("topic", topic).Add(1)
+						s.logger.Log(
+							"msg", "decode failed",
+							"topic", topic,
+							"offset", msg.TopicPartition.Offset,
+							"err", err,
+						)
+					}
+					decoded := len(records)
+					records, missing := s.timestampsFor(topic).apply(msg, records, time.Now())
+					if missing > 0 {
+						s.missing.With("topic", topic).Add(float64(missing))
+					}
+					if dropped := decoded - len(records); dropped > 0 {
+						s.logger.Log(
+							"msg", "elements without a timestamp dropped",
+							"topic", topic,
+							"offset", msg.TopicPartition.Offset,
+							"count", dropped,
+						)
+					}
+					if err = write(wtr, msg.TopicPartition, records); err != nil {
+						s.logger.Log(
+							"msg", "write failed",
+							"err", err,
+						)
+						continue
+					}
+					if checkpointer != nil && msg.TopicPartition.Topic != nil {
+						checkpointer.MarkOffset(
+							*msg.TopicPartition.Topic,
+							msg.TopicPartition.Partition,
+							int64(msg.TopicPartition.Offset),
+						)
+					}
 				case kafka.PartitionEOF:
-					svr.logger.Log(
+					s.logger.Log(
 						"msg", "partition eof",
 						"details", fmt.Sprintf("%v", msg),
 					)
+					lag.eof(kafka.TopicPartition(msg))
 				case kafka.Error:
-					svr.logger.Log(
+					s.logger.Log(
 						"msg", "error",
 						"err", fmt.Sprintf("%v", msg),
 					)
@@ -78,13 +315,109 @@ func New(wtr storage.Writer, cfg *kafka.ConfigMap, logger log.Logger) (*svr, err
 				}
 			}
 		}
+	}(s.closer, wtr, c)
 
-		c.Close()
+	return nil
+}
 
-	}(svr.closer, wtr, c)
+// write stores each record, stopping at the first that fails. If wtr is a storage.SourceWriter the position of the
+// message is written with each record.
+func write(wtr storage.Writer, tp kafka.TopicPartition, records []Record) error {
+	sw, ok := wtr.(storage.SourceWriter)
+	for _, r := range records {
+		var err error
+		if ok && tp.Topic != nil {
+			src := storage.SourceOffset{Topic: *tp.Topic, Partition: tp.Partition, Offset: int64(tp.Offset)}
+			err = sw.WriteSource(context.Background(), src, r.Key, r.Labels, r.Timestamp, r.Data)
+		} else {
+			err = wtr.WriteLabels(context.Background(), r.Key, r.Labels, r.Timestamp, r.Data)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	return svr, nil
+// topicName returns the name of topic, or an empty string if it is not known.
+func topicName(topic *string) string {
+	if topic == nil {
+		return ""
+	}
+	return *topic
+}
 
+// resume starts partitions after the last offset recorded by the checkpointer, for example offsets restored from a
+// snapshot or the write ahead log. Partitions without a recorded offset start from the committed offset of the consumer group.
+func resume(checkpointer storage.Checkpointer, partitions []kafka.TopicPartition) {
+	for i, p := range partitions {
+		if p.Topic == nil {
+			continue
+		}
+		if offset, ok := checkpointer.Offset(*p.Topic, p.Partition); ok {
+			partitions[i].Offset = kafka.Offset(offset + 1)
+		}
+	}
+}
+
+// offsetLookup finds the offsets of partitions by time.
+type offsetLookup interface {
+	OffsetsForTimes(times []kafka.TopicPartition, timeoutMs int) ([]kafka.TopicPartition, error)
+}
+
+// rewind starts partitions that have no offset at the first message with a timestamp at or after since. Partitions
+// without such a message start at the end. Partitions resumed from a recovered offset or already read by this process,
+// before a rebalance, are left at their offset so that their messages are not stored twice.
+func rewind(
+	lookup offsetLookup,
+	partitions []kafka.TopicPartition,
+	consumed map[partition]bool,
+	since time.Time,
+	timeoutMs int,
+) error {
+	unresolved := func(p kafka.TopicPartition) bool {
+		return p.Offset < 0 && p.Topic != nil && !consumed[partition{*p.Topic, p.Partition}]
+	}
+	ms := kafka.Offset(since.UnixNano() / int64(time.Millisecond))
+	var times []kafka.TopicPartition
+	for _, p := range partitions {
+		if unresolved(p) {
+			times = append(times, kafka.TopicPartition{Topic: p.Topic, Partition: p.Partition, Offset: ms})
+		}
+	}
+	if len(times) == 0 {
+		return nil
+	}
+	offsets, err := lookup.OffsetsForTimes(times, timeoutMs)
+	if err != nil {
+		return err
+	}
+	for _, o := range offsets {
+		if o.Error != nil || o.Topic == nil {
+			continue
+		}
+		for i, p := range partitions {
+			if unresolved(p) && *p.Topic == *o.Topic && p.Partition == o.Partition {
+				partitions[i].Offset = o.Offset
+			}
+		}
+	}
+	return nil
+}
+
+// headerLabels returns the labels found in message headers, or nil if there are none.
+func headerLabels(headers []kafka.Header) storage.Labels {
+	var labels storage.Labels
+	for _, h := range headers {
+		if !strings.HasPrefix(h.Key, LabelHeaderPrefix) {
+			continue
+		}
+		if labels == nil {
+			labels = make(storage.Labels)
+		}
+		labels[strings.TrimPrefix(h.Key, LabelHeaderPrefix)] = string(h.Value)
+	}
+	return labels
 }
 
 func (s *svr) Close() error {
@@ -0,0 +1,111 @@
+package subscriber
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/go-kit/kit/metrics/discard"
+	"github.com/murphybytes/gots/internal/service/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeLookup struct {
+	times  []kafka.TopicPartition
+	result []kafka.TopicPartition
+	err    error
+}
+
+func (f *fakeLookup) OffsetsForTimes(times []kafka.TopicPartition, timeoutMs int) ([]kafka.TopicPartition, error) {
+	f.times = times
+	return f.result, f.err
+}
+
+func TestRewind(t *testing.T) {
+	quotes, trades := "quotes", "trades"
+	since := time.Unix(1500000000, 0)
+	partitions := []kafka.TopicPartition{
+		{Topic: &quotes, Partition: 0, Offset: kafka.OffsetInvalid},
+		{Topic: &quotes, Partition: 1, Offset: 42},
+		{Topic: &trades, Partition: 0, Offset: kafka.OffsetInvalid},
+		{Topic: &trades, Partition: 1, Offset: kafka.OffsetInvalid},
+	}
+	lookup := &fakeLookup{result: []kafka.TopicPartition{
+		{Topic: &quotes, Partition: 0, Offset: 100},
+		{Topic: &trades, Partition: 0, Offset: kafka.OffsetEnd},
+		{Topic: &trades, Partition: 1, Offset: 7, Error: errors.New("leader not available")},
+	}}
+	require.Nil(t, rewind(lookup, partitions, nil, since, 1000))
+
+	// only partitions without an offset are looked up, by time in milliseconds
+	require.Len(t, lookup.times, 3)
+	for _, p := range lookup.times {
+		assert.Equal(t, kafka.Offset(1500000000000), p.Offset)
+	}
+	var offsets []kafka.Offset
+	for _, p := range partitions {
+		offsets = append(offsets, p.Offset)
+	}
+	assert.Equal(t, []kafka.Offset{100, 42, kafka.OffsetEnd, kafka.OffsetInvalid}, offsets)
+
+	lookup = &fakeLookup{err: errors.New("timed out")}
+	assert.NotNil(t, rewind(lookup, []kafka.TopicPartition{{Topic: &quotes, Offset: kafka.OffsetInvalid}}, nil, since, 1000))
+
+	// partitions read before a rebalance keep their committed offsets
+	lookup = &fakeLookup{result: []kafka.TopicPartition{{Topic: &quotes, Partition: 1, Offset: 100}}}
+	partitions = []kafka.TopicPartition{
+		{Topic: &quotes, Partition: 0, Offset: kafka.OffsetInvalid},
+		{Topic: &quotes, Partition: 1, Offset: kafka.OffsetInvalid},
+	}
+	require.Nil(t, rewind(lookup, partitions, map[partition]bool{{"quotes", 0}: true}, since, 1000))
+	require.Len(t, lookup.times, 1)
+	assert.Equal(t, int32(1), lookup.times[0].Partition)
+	assert.Equal(t, kafka.OffsetInvalid, partitions[0].Offset)
+	assert.Equal(t, kafka.Offset(100), partitions[1].Offset)
+}
+
+func TestRewindAfterWALRecovery(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gots-subscriber")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	opts := storage.Options{
+		MaxAge:            time.Hour,
+		WorkerCount:       2,
+		ChannelBufferSize: storage.DefaultChannelBufferSize,
+		MessageCounter:    discard.NewCounter(),
+		WAL:               storage.WALOptions{Dir: dir, Sync: storage.SyncAlways},
+	}
+
+	now := time.Now()
+	stg, err := storage.New(opts)
+	require.Nil(t, err)
+	for i := int64(0); i < 10; i++ {
+		src := storage.SourceOffset{Topic: "quotes", Partition: 0, Offset: i}
+		require.Nil(t, stg.WriteSource(context.Background(), src, "ibm", nil, now.Add(time.Duration(i)), nil))
+	}
+	// reads wait for the writes queued before them
+	_, err = stg.Last(context.Background(), "ibm", 1)
+	require.Nil(t, err)
+	require.Nil(t, stg.Close())
+
+	// without snapshots the offset recovered from the log keeps the partition from being rewound
+	stg, err = storage.New(opts)
+	require.Nil(t, err)
+	defer stg.Close()
+	quotes := "quotes"
+	partitions := []kafka.TopicPartition{
+		{Topic: &quotes, Partition: 0, Offset: kafka.OffsetInvalid},
+		{Topic: &quotes, Partition: 1, Offset: kafka.OffsetInvalid},
+	}
+	resume(stg, partitions)
+	lookup := &fakeLookup{result: []kafka.TopicPartition{{Topic: &quotes, Partition: 1, Offset: 3}}}
+	require.Nil(t, rewind(lookup, partitions, nil, now.Add(-time.Hour), 1000))
+	require.Len(t, lookup.times, 1)
+	assert.Equal(t, int32(1), lookup.times[0].Partition)
+	assert.Equal(t, []kafka.Offset{10, 3}, []kafka.Offset{partitions[0].Offset, partitions[1].Offset})
+}
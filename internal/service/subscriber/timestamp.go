@@ -0,0 +1,194 @@
+package subscriber
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+)
+
+// TimeFormat describes how a time is written in a header or payload.
+type TimeFormat int
+
+const (
+	// UnixNano is a number of nanoseconds since the Unix epoch.
+	UnixNano TimeFormat = iota
+	// UnixMicro is a number of microseconds since the Unix epoch.
+	UnixMicro
+	// UnixMilli is a number of milliseconds since the Unix epoch.
+	UnixMilli
+	// UnixSeconds is a number of seconds since the Unix epoch.
+	UnixSeconds
+	// RFC3339 is a string such as 2017-07-14T02:40:00.5Z.
+	RFC3339
+)
+
+// ParseTimeFormat returns the format named ns, us, ms, s or rfc3339. An empty name is UnixNano.
+func ParseTimeFormat(name string) (TimeFormat, error) {
+	switch name {
+	case "", "ns":
+		return UnixNano, nil
+	case "us":
+		return UnixMicro, nil
+	case "ms":
+		return UnixMilli, nil
+	case "s":
+		return UnixSeconds, nil
+	case "rfc3339":
+		return RFC3339, nil
+	}
+	return UnixNano, fmt.Errorf("unknown time format '%s'", name)
+}
+
+// Parse reads a time in the format. Unix times may have a fractional part.
+func (f TimeFormat) Parse(v string) (time.Time, error) {
+	v = strings.TrimSpace(v)
+	var unit time.Duration
+	switch f {
+	case UnixNano:
+		unit = time.Nanosecond
+	case UnixMicro:
+		unit = time.Microsecond
+	case UnixMilli:
+		unit = time.Millisecond
+	case UnixSeconds:
+		unit = time.Second
+	case RFC3339:
+		return time.Parse(time.RFC3339Nano, v)
+	default:
+		return time.Time{}, fmt.Errorf("unknown time format %d", f)
+	}
+	if n, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return time.Unix(0, n*int64(unit)), nil
+	}
+	n, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid timestamp '%s'", v)
+	}
+	return time.Unix(0, int64(n*float64(unit))), nil
+}
+
+// TimestampSource is where the time of an element comes from.
+type TimestampSource int
+
+const (
+	// TimestampPayload is the time found in the payload by the decoder of the topic. Decoders without a timestamp
+	// field use the Kafka timestamp.
+	TimestampPayload TimestampSource = iota
+	// TimestampKafka is the time set on the message by the producer or broker.
+	TimestampKafka
+	// TimestampHeader is the time held by a message header.
+	TimestampHeader
+	// TimestampIngest is the time the message was received.
+	TimestampIngest
+	// TimestampDrop discards the element. It is only useful as a fallback.
+	TimestampDrop
+)
+
+// Timestamps decides the time of the elements read from a topic.
+type Timestamps struct {
+	Source TimestampSource
+	// Header names the header holding the time when Source or Fallback is TimestampHeader.
+	Header string
+	// Format of the header time.
+	Format TimeFormat
+	// Fallback is the source used when the time from Source is missing or invalid.
+	Fallback TimestampSource
+}
+
+// DefaultTimestamps is used by topics without timestamp settings. It uses the time found by the decoder and the
+// ingest time for elements without one, such as raw messages from producers that do not set the Kafka timestamp.
+var DefaultTimestamps = Timestamps{Source: TimestampPayload, Fallback: TimestampIngest}
+
+// ParseTimestamps reads a timestamp specification, the name of the source optionally followed by a colon and comma
+// separated settings. For example
+//
+//	kafka
+//	payload:fallback=ingest
+//	header:name=exchange-time,format=ms,fallback=kafka
+//
+// Sources are payload, kafka, header and ingest. Fallback may also be drop, the default. Format is one of the names
+// accepted by ParseTimeFormat.
+func ParseTimestamps(spec string) (Timestamps, error) {
+	t := Timestamps{Source: TimestampPayload, Fallback: TimestampDrop}
+	name, values, err := parseSpec(spec)
+	if err != nil {
+		return t, err
+	}
+	if t.Source, err = parseTimestampSource(name); err != nil {
+		return t, err
+	}
+	if v, ok := values["fallback"]; ok {
+		if t.Fallback, err = parseTimestampSource(v); err != nil {
+			return t, err
+		}
+	}
+	if t.Format, err = ParseTimeFormat(values["format"]); err != nil {
+		return t, err
+	}
+	t.Header = values["name"]
+	if t.Source == TimestampDrop {
+		return t, fmt.Errorf("drop may only be used as a fallback")
+	}
+	if (t.Source == TimestampHeader || t.Fallback == TimestampHeader) && t.Header == "" {
+		return t, fmt.Errorf("header timestamps require a header name")
+	}
+	return t, nil
+}
+
+func parseTimestampSource(name string) (TimestampSource, error) {
+	switch name {
+	case "payload":
+		return TimestampPayload, nil
+	case "kafka":
+		return TimestampKafka, nil
+	case "header":
+		return TimestampHeader, nil
+	case "ingest":
+		return TimestampIngest, nil
+	case "drop":
+		return TimestampDrop, nil
+	}
+	return TimestampDrop, fmt.Errorf("unknown timestamp source '%s'", name)
+}
+
+// apply sets the time of each record, dropping those whose time cannot be found. Missing counts the records that
+// used the fallback.
+func (t Timestamps) apply(msg *kafka.Message, records []Record, now time.Time) (kept []Record, missing int) {
+	kept = records[:0]
+	for _, r := range records {
+		ts, ok := t.resolve(t.Source, msg, r, now)
+		if !ok {
+			missing++
+			if ts, ok = t.resolve(t.Fallback, msg, r, now); !ok {
+				continue
+			}
+		}
+		r.Timestamp = ts
+		kept = append(kept, r)
+	}
+	return kept, missing
+}
+
+// resolve returns the time of the record from source, or false if it is missing or invalid.
+func (t Timestamps) resolve(source TimestampSource, msg *kafka.Message, r Record, now time.Time) (time.Time, bool) {
+	var ts time.Time
+	switch source {
+	case TimestampPayload:
+		ts = r.Timestamp
+	case TimestampKafka:
+		ts = msg.Timestamp
+	case TimestampHeader:
+		for _, h := range msg.Headers {
+			if h.Key == t.Header {
+				ts, _ = t.Format.Parse(string(h.Value))
+				break
+			}
+		}
+	case TimestampIngest:
+		ts = now
+	}
+	return ts, !ts.IsZero()
+}
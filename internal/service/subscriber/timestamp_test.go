@@ -0,0 +1,93 @@
+package subscriber
+
+import (
+	"testing"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTimeFormat(t *testing.T) {
+	tt := []struct {
+		format   string
+		value    string
+		expected time.Time
+	}{
+		{"ns", "1500000000000000001", time.Unix(1500000000, 1)},
+		{"us", "1500000000000001", time.Unix(1500000000, 1000)},
+		{"ms", "1500000000001", time.Unix(1500000000, 1000000)},
+		{"s", "1500000000.5", time.Unix(1500000000, 500000000)},
+		{"rfc3339", "2017-07-14T02:40:00.5Z", time.Date(2017, 7, 14, 2, 40, 0, 500000000, time.UTC)},
+	}
+	for _, tc := range tt {
+		f, err := ParseTimeFormat(tc.format)
+		require.Nil(t, err)
+		ts, err := f.Parse(tc.value)
+		require.Nil(t, err, tc.format)
+		assert.True(t, tc.expected.Equal(ts), "%s %s", tc.format, ts)
+	}
+
+	_, err := UnixMilli.Parse("yesterday")
+	assert.NotNil(t, err)
+	_, err = RFC3339.Parse("1500000000")
+	assert.NotNil(t, err)
+	_, err = ParseTimeFormat("days")
+	assert.NotNil(t, err)
+}
+
+func TestTimestamps(t *testing.T) {
+	now := time.Now()
+	kafkaTime := now.Add(-time.Second)
+	exchangeTime := time.Unix(1500000000, 0)
+	payloadTime := time.Unix(1600000000, 0)
+	msg := &kafka.Message{
+		Timestamp: kafkaTime,
+		Headers:   []kafka.Header{{Key: "exchange-time", Value: []byte("1500000000000")}},
+	}
+
+	times := func(spec string, msg *kafka.Message, records ...Record) ([]time.Time, int) {
+		ts, err := ParseTimestamps(spec)
+		require.Nil(t, err, spec)
+		kept, missing := ts.apply(msg, records, now)
+		var times []time.Time
+		for _, r := range kept {
+			times = append(times, r.Timestamp)
+		}
+		return times, missing
+	}
+	tt := []struct {
+		spec     string
+		msg      *kafka.Message
+		records  []Record
+		expected []time.Time
+		missing  int
+	}{
+		{"payload", msg, []Record{{Timestamp: payloadTime}, {}}, []time.Time{payloadTime}, 1},
+		{"payload:fallback=ingest", msg, []Record{{Timestamp: payloadTime}, {}}, []time.Time{payloadTime, now}, 1},
+		{"kafka", msg, []Record{{Timestamp: payloadTime}}, []time.Time{kafkaTime}, 0},
+		{"kafka", &kafka.Message{}, []Record{{}}, nil, 1},
+		{"header:name=exchange-time,format=ms", msg, []Record{{Timestamp: payloadTime}}, []time.Time{exchangeTime}, 0},
+		{"header:name=quote-time,fallback=kafka", msg, []Record{{}}, []time.Time{kafkaTime}, 1},
+		{"ingest", msg, []Record{{}, {}}, []time.Time{now, now}, 0},
+	}
+	for _, tc := range tt {
+		actual, missing := times(tc.spec, tc.msg, tc.records...)
+		assert.Equal(t, tc.expected, actual, tc.spec)
+		assert.Equal(t, tc.missing, missing, tc.spec)
+	}
+
+	// topics without timestamp settings keep raw messages that have no Kafka timestamp
+	records, err := RawDecoder{}.Decode(&kafka.Message{Key: []byte("ibm")})
+	require.Nil(t, err)
+	kept, missing := DefaultTimestamps.apply(&kafka.Message{}, records, now)
+	require.Len(t, kept, 1)
+	assert.Equal(t, now, kept[0].Timestamp)
+	assert.Equal(t, 1, missing)
+
+	for _, spec := range []string{"producer", "drop", "header", "kafka:fallback=header", "kafka:fallback=later", "header:name=x,format=days"} {
+		_, err := ParseTimestamps(spec)
+		assert.NotNil(t, err, spec)
+	}
+}
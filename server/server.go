@@ -12,7 +12,6 @@ import (
 	"context"
 	"net"
 
-	"github.com/confluentinc/confluent-kafka-go/kafka"
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/metrics"
 	"github.com/go-kit/kit/metrics/discard"
@@ -20,8 +19,9 @@ import (
 	"github.com/murphybytes/gots/api"
 	"github.com/murphybytes/gots/internal/service"
 	"github.com/murphybytes/gots/internal/service/storage"
-	"github.com/murphybytes/gots/internal/service/subscriber"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
 )
 
 const (
@@ -29,10 +29,36 @@ const (
 	defaultWorkerCount       = 128
 	defaultChannelBufferSize = 512
 	defaultGRPCListenAddress = ":8088"
+	// readinessInterval is the time between checks of the readiness of the ingestion sources.
+	readinessInterval = time.Second
+	// serviceName is the name the health of the time series service is reported under.
+	serviceName = "api.TimeseriesService"
 )
 
 type Option func(*svr)
 
+// Source feeds time series elements from an ingestion source, such as Kafka topics, to storage.
+type Source interface {
+	// Start begins writing elements to wtr and returns once the source is running.
+	Start(wtr storage.Writer, logger log.Logger) error
+	// Close stops the source and waits for it to finish writing.
+	io.Closer
+}
+
+// Readiness is implemented by sources that replay elements into storage when they start, such as the Kafka
+// subscriber, and which should not be considered ready until they have caught up.
+type Readiness interface {
+	Ready() bool
+}
+
+// Sources adds ingestion sources that write to storage while the server runs. Without any sources elements can only
+// be added through the Write endpoints.
+func Sources(sources ...Source) Option {
+	return func(s *svr) {
+		s.sources = append(s.sources, sources...)
+	}
+}
+
 // ElementMaxAge set the age at which time series elements will be discarded
 func ElementMaxAge(age time.Duration) Option {
 	return func(s *svr) {
@@ -40,6 +66,14 @@ func ElementMaxAge(age time.Duration) Option {
 	}
 }
 
+// RetentionPolicies set the age at which time series elements are discarded for particular keys. Keys not matched
+// by any policy use ElementMaxAge.
+func RetentionPolicies(policies ...storage.RetentionPolicy) Option {
+	return func(s *svr) {
+		s.retentionPolicies = append(s.retentionPolicies, policies...)
+	}
+}
+
 // StorageWorkerCount set the number of goroutines that will process incoming time series elements
 func StorageWorkerCount(workers int) Option {
 	return func(s *svr) {
@@ -84,6 +118,13 @@ func ExpiredElementHandler(hnd storage.ExpiryHandler) Option {
 	}
 }
 
+// NotifyDeletes passes elements removed by the DeleteSeries and DeleteRange endpoints to the expired element handler.
+func NotifyDeletes(notify bool) Option {
+	return func(s *svr) {
+		s.notifyDeletes = notify
+	}
+}
+
 // MessageCounter count incoming messages.
 func MessageCounter(counter metrics.Counter) Option {
 	return func(s *svr) {
@@ -91,6 +132,123 @@ func MessageCounter(counter metrics.Counter) Option {
 	}
 }
 
+// MemoryBudget limits the memory used by time series elements to approximately bytes. Zero means there is no limit.
+func MemoryBudget(bytes int64) Option {
+	return func(s *svr) {
+		s.storageMaxBytes = bytes
+	}
+}
+
+// MaxElementsPerKey limits the number of time series elements kept for each key. Zero means there is no limit.
+func MaxElementsPerKey(count int) Option {
+	return func(s *svr) {
+		s.storageMaxElementsPerKey = count
+	}
+}
+
+// Eviction sets the policy used to choose elements to discard when the memory budget is exceeded.
+func Eviction(policy storage.EvictionPolicy) Option {
+	return func(s *svr) {
+		s.evictionPolicy = policy
+	}
+}
+
+// EvictionCounter count time series elements evicted to stay within memory limits.
+func EvictionCounter(counter metrics.Counter) Option {
+	return func(s *svr) {
+		s.evictionCounter = counter
+	}
+}
+
+// Overload sets what happens to incoming time series elements when a storage worker's queue is full. Timeout is only
+// used by storage.BlockWritesWithTimeout.
+func Overload(policy storage.OverloadPolicy, timeout time.Duration) Option {
+	return func(s *svr) {
+		s.overloadPolicy = policy
+		s.overloadTimeout = timeout
+	}
+}
+
+// QueueDepth set to the number of elements waiting for each storage worker, labelled by worker. Backends that ignore
+// labels, such as expvar, hold the depth of whichever worker was sampled last.
+func QueueDepth(gauge metrics.Gauge) Option {
+	return func(s *svr) {
+		s.queueDepth = gauge
+	}
+}
+
+// DropCounter count time series elements dropped by the overload policy, labelled by worker. Backends that ignore
+// labels, such as expvar, count the drops of every worker together.
+func DropCounter(counter metrics.Counter) Option {
+	return func(s *svr) {
+		s.dropCounter = counter
+	}
+}
+
+// Duplicates sets what happens to a time series element with the same timestamp as an element already stored for its
+// key. Policies override the default for particular keys.
+func Duplicates(duplicates storage.Duplicates, policies ...storage.DuplicatePolicy) Option {
+	return func(s *svr) {
+		s.duplicates = duplicates
+		s.duplicatePolicies = append(s.duplicatePolicies, policies...)
+	}
+}
+
+// MaxLateness rejects time series elements older than the newest element of their key by more than lateness.
+func MaxLateness(lateness time.Duration) Option {
+	return func(s *svr) {
+		s.maxLateness = lateness
+	}
+}
+
+// SeriesLimits rejects time series elements that would create a series once maxSeries series are held or faster
+// than maxNewPerSecond. Limits apply further limits to particular keys. Zero means there is no limit.
+func SeriesLimits(maxSeries int, maxNewPerSecond float64, limits ...storage.SeriesLimit) Option {
+	return func(s *svr) {
+		s.maxSeries = maxSeries
+		s.maxNewSeriesPerSecond = maxNewPerSecond
+		s.seriesLimits = append(s.seriesLimits, limits...)
+	}
+}
+
+// RejectCounter count time series elements rejected as late, duplicate or by the series limits, labelled by reason.
+func RejectCounter(counter metrics.Counter) Option {
+	return func(s *svr) {
+		s.rejectCounter = counter
+	}
+}
+
+// WriteAheadLog enables logging of incoming time series elements to disk so that they can be recovered when the
+// server restarts.
+func WriteAheadLog(opts storage.WALOptions) Option {
+	return func(s *svr) {
+		s.wal = opts
+	}
+}
+
+// SubscriptionBuffer is the number of elements buffered for each client of the Subscribe endpoint.
+func SubscriptionBuffer(size int) Option {
+	return func(s *svr) {
+		s.subscriberBufferSize = size
+	}
+}
+
+// SlowSubscribers sets what happens to Subscribe clients that fall behind, elements are either dropped or the client
+// is disconnected.
+func SlowSubscribers(policy storage.SlowSubscriberPolicy) Option {
+	return func(s *svr) {
+		s.slowSubscriberPolicy = policy
+	}
+}
+
+// Snapshots enables point in time snapshots of time series elements. A snapshot is loaded when the server starts, is
+// written every opts.Interval and can be requested through the Snapshot endpoint.
+func Snapshots(opts storage.SnapshotOptions) Option {
+	return func(s *svr) {
+		s.snapshot = opts
+	}
+}
+
 // WantAuth enables authentication for the server.  A login handler takes a user name and password and
 // if authorized returns a token that will be passed to the server in subsequent requests from the client.  The
 // auth handler receives this token and uses it to authorize requests. Typically the this would
@@ -104,11 +262,32 @@ func WantAuth(auth service.AuthHandler, login service.LoginHandler) Option {
 
 type svr struct {
 	storageMaxAge            time.Duration
+	retentionPolicies        []storage.RetentionPolicy
 	storageWorkersCount      int
 	storageChannelBufferSize int
+	storageMaxBytes          int64
+	storageMaxElementsPerKey int
+	evictionPolicy           storage.EvictionPolicy
+	evictionCounter          metrics.Counter
+	overloadPolicy           storage.OverloadPolicy
+	overloadTimeout          time.Duration
+	queueDepth               metrics.Gauge
+	dropCounter              metrics.Counter
+	duplicates               storage.Duplicates
+	duplicatePolicies        []storage.DuplicatePolicy
+	maxLateness              time.Duration
+	maxSeries                int
+	maxNewSeriesPerSecond    float64
+	seriesLimits             []storage.SeriesLimit
+	rejectCounter            metrics.Counter
 	expiryHandler            storage.ExpiryHandler
+	notifyDeletes            bool
+	wal                      storage.WALOptions
+	snapshot                 storage.SnapshotOptions
+	subscriberBufferSize     int
+	slowSubscriberPolicy     storage.SlowSubscriberPolicy
 	storage                  io.Closer
-	subscriber               io.Closer
+	sources                  []Source
 	logger                   log.Logger
 	listenAddress            string
 	messageCounter           metrics.Counter
@@ -116,8 +295,8 @@ type svr struct {
 	loginHandler             service.LoginHandler
 }
 
-// Run starts processing time series messages and exposes them via grpc endpoint. Run is a blocking call.
-func Run(kcfg *kafka.ConfigMap, opts ...Option) error {
+// Run starts the ingestion sources and exposes the time series they write via grpc endpoint. Run is a blocking call.
+func Run(opts ...Option) error {
 	var err error
 	s := &svr{
 		storageMaxAge:            defaultMaxAge,
@@ -125,37 +304,71 @@ func Run(kcfg *kafka.ConfigMap, opts ...Option) error {
 		storageChannelBufferSize: defaultChannelBufferSize,
 		listenAddress:            defaultGRPCListenAddress,
 		messageCounter:           discard.NewCounter(),
+		evictionCounter:          discard.NewCounter(),
 	}
 	for _, opt := range opts {
 		opt(s)
 	}
-	storage := storage.New(
-		storage.Options{
-			MaxAge:            s.storageMaxAge,
-			WorkerCount:       s.storageWorkersCount,
-			ChannelBufferSize: s.storageChannelBufferSize,
-			OnExpire:          s.expiryHandler,
-			MessageCounter:    s.messageCounter,
-		},
-	)
-	defer storage.Close()
-
 	if s.logger == nil {
 		s.logger = log.NewLogfmtLogger(log.NewSyncWriter(os.Stdout))
 	}
 
-	subs, err := subscriber.New(storage, kcfg, s.logger)
+	storage, err := storage.New(
+		storage.Options{
+			MaxAge:                s.storageMaxAge,
+			RetentionPolicies:     s.retentionPolicies,
+			WorkerCount:           s.storageWorkersCount,
+			ChannelBufferSize:     s.storageChannelBufferSize,
+			OnExpire:              s.expiryHandler,
+			NotifyDeletes:         s.notifyDeletes,
+			MessageCounter:        s.messageCounter,
+			MaxBytes:              s.storageMaxBytes,
+			MaxElementsPerKey:     s.storageMaxElementsPerKey,
+			EvictionPolicy:        s.evictionPolicy,
+			EvictionCounter:       s.evictionCounter,
+			OverloadPolicy:        s.overloadPolicy,
+			OverloadTimeout:       s.overloadTimeout,
+			QueueDepth:            s.queueDepth,
+			DropCounter:           s.dropCounter,
+			Duplicates:            s.duplicates,
+			DuplicatePolicies:     s.duplicatePolicies,
+			MaxLateness:           s.maxLateness,
+			MaxSeries:             s.maxSeries,
+			MaxNewSeriesPerSecond: s.maxNewSeriesPerSecond,
+			SeriesLimits:          s.seriesLimits,
+			RejectCounter:         s.rejectCounter,
+			WAL:                   s.wal,
+			Snapshot:              s.snapshot,
+			SubscriberBufferSize:  s.subscriberBufferSize,
+			SlowSubscriberPolicy:  s.slowSubscriberPolicy,
+			Logger:                s.logger,
+		},
+	)
 	if err != nil {
 		return err
 	}
-	defer subs.Close()
+	defer storage.Close()
+
+	for _, src := range s.sources {
+		if err = src.Start(storage, s.logger); err != nil {
+			return err
+		}
+		defer src.Close()
+	}
 
-	svc := service.New(s.logger, storage, s.loginHandler)
+	svc := service.New(s.logger, storage, s.authHandler, s.loginHandler, s.ready)
 	grpcServer := grpc.NewServer(
 		grpc.UnaryInterceptor(grpc_auth.UnaryServerInterceptor(injectAuthFunctions(s.authHandler))),
+		grpc.StreamInterceptor(grpc_auth.StreamServerInterceptor(injectAuthFunctions(s.authHandler))),
 	)
 	api.RegisterTimeseriesServiceServer(grpcServer, svc)
 
+	healthServer := health.NewServer()
+	grpc_health_v1.RegisterHealthServer(grpcServer, healthServer)
+	done := make(chan struct{})
+	defer close(done)
+	go s.reportHealth(healthServer, done)
+
 	listener, err := net.Listen("tcp", s.listenAddress)
 	if err != nil {
 		return err
@@ -168,6 +381,36 @@ func Run(kcfg *kafka.ConfigMap, opts ...Option) error {
 	return nil
 }
 
+// ready returns true once every source that replays elements has caught up.
+func (s *svr) ready() bool {
+	for _, src := range s.sources {
+		if r, ok := src.(Readiness); ok && !r.Ready() {
+			return false
+		}
+	}
+	return true
+}
+
+// reportHealth sets the serving status of the health service from the readiness of the sources until done is closed.
+// The server is not serving while sources are replaying.
+func (s *svr) reportHealth(h *health.Server, done <-chan struct{}) {
+	ticker := time.NewTicker(readinessInterval)
+	defer ticker.Stop()
+	for {
+		status := grpc_health_v1.HealthCheckResponse_NOT_SERVING
+		if s.ready() {
+			status = grpc_health_v1.HealthCheckResponse_SERVING
+		}
+		h.SetServingStatus("", status)
+		h.SetServingStatus(serviceName, status)
+		select {
+		case <-ticker.C:
+		case <-done:
+			return
+		}
+	}
+}
+
 func injectAuthFunctions(h service.AuthHandler) grpc_auth.AuthFunc {
 	return func(ctx context.Context) (context.Context, error) {
 		// If no auth handler exists we are always authenticated
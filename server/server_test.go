@@ -2,6 +2,9 @@ package server
 
 import (
 	"context"
+	"encoding/binary"
+	"io"
+	"math"
 	"net"
 	"sync"
 	"testing"
@@ -15,27 +18,37 @@ import (
 	"github.com/murphybytes/gots/internal/service"
 	"github.com/murphybytes/gots/internal/service/storage"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"fmt"
 )
 
 func createTestServer(lh service.LoginHandler, ah service.AuthHandler, wg sync.WaitGroup) (*grpc.Server, storage.Manager, error) {
-	storage := storage.New(storage.Options{
+	storage, err := storage.New(storage.Options{
 		MaxAge:            time.Hour,
 		WorkerCount:       10,
 		ChannelBufferSize: 10,
 		MessageCounter:    discard.NewCounter(),
 	})
+	if err != nil {
+		return nil, nil, err
+	}
 
-	svc := service.New(log.NewNopLogger(), storage, lh)
+	svc := service.New(log.NewNopLogger(), storage, ah, lh, nil)
 	gsvr := grpc.NewServer(
 		grpc.UnaryInterceptor(
 			grpc_auth.UnaryServerInterceptor(
 				injectAuthFunctions(ah),
 			),
 		),
+		grpc.StreamInterceptor(
+			grpc_auth.StreamServerInterceptor(
+				injectAuthFunctions(ah),
+			),
+		),
 	)
 	api.RegisterTimeseriesServiceServer(gsvr, svc)
 	listener, err := net.Listen("tcp", ":50001")
@@ -95,7 +108,7 @@ func TestAuthenticatedRequest(t *testing.T) {
 		var wg sync.WaitGroup
 		svr, strg, err := createTestServer(loginHandler, authHandler, wg)
 		require.Nil(t, err)
-		strg.Write("key", time.Now(), []byte("hello there"))
+		strg.Write(context.Background(), "key", time.Now(), []byte("hello there"))
 		f(t)
 		strg.Close()
 		svr.GracefulStop()
@@ -131,3 +144,542 @@ func TestAuthenticatedRequest(t *testing.T) {
 
 	})
 }
+
+func TestUnauthenticatedWrite(t *testing.T) {
+	loginHandler := func(u, p string) (string, error) {
+		return "token", nil
+	}
+	authHandler := func(jwt string) error {
+		return nil
+	}
+	var wg sync.WaitGroup
+	svr, strg, err := createTestServer(loginHandler, authHandler, wg)
+	require.Nil(t, err)
+	defer func() {
+		strg.Close()
+		svr.GracefulStop()
+		wg.Wait()
+	}()
+
+	conn, err := grpc.Dial(":50001", grpc.WithInsecure())
+	require.Nil(t, err)
+	defer conn.Close()
+	client := api.NewTimeseriesServiceClient(conn)
+	series := &api.Series{Key: "key", Elements: []*api.Element{{Timestamp: time.Now().UnixNano()}}}
+
+	_, err = client.Write(context.Background(), &api.WriteRequest{Series: []*api.Series{series}})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	stream, err := client.WriteStream(context.Background())
+	require.Nil(t, err)
+	stream.Send(series)
+	_, err = stream.CloseAndRecv()
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	_, err = strg.Last(context.Background(), "key", 1)
+	assert.NotNil(t, err)
+}
+
+func TestSubscribe(t *testing.T) {
+	var wg sync.WaitGroup
+	svr, strg, err := createTestServer(nil, nil, wg)
+	require.Nil(t, err)
+	defer func() {
+		strg.Close()
+		svr.GracefulStop()
+		wg.Wait()
+	}()
+	now := time.Now()
+	strg.Write(context.Background(), "key", now, []byte("backfill"))
+
+	conn, err := grpc.Dial(":50001", grpc.WithInsecure())
+	require.Nil(t, err)
+	defer conn.Close()
+	client := api.NewTimeseriesServiceClient(conn)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream, err := client.Subscribe(ctx, &api.SubscribeRequest{Keys: []string{"key"}, Backfill: true})
+	require.Nil(t, err)
+
+	series, err := stream.Recv()
+	require.Nil(t, err)
+	assert.Equal(t, "key", series.Key)
+	require.Len(t, series.Elements, 1)
+	assert.Equal(t, "backfill", string(series.Elements[0].Data))
+
+	strg.Write(context.Background(), "other", now, []byte("ignored"))
+	strg.Write(context.Background(), "key", now.Add(time.Second), []byte("live"))
+	series, err = stream.Recv()
+	require.Nil(t, err)
+	require.Len(t, series.Elements, 1)
+	assert.Equal(t, "live", string(series.Elements[0].Data))
+}
+
+func TestWrite(t *testing.T) {
+	var wg sync.WaitGroup
+	svr, strg, err := createTestServer(nil, nil, wg)
+	require.Nil(t, err)
+	defer func() {
+		strg.Close()
+		svr.GracefulStop()
+		wg.Wait()
+	}()
+
+	conn, err := grpc.Dial(":50001", grpc.WithInsecure())
+	require.Nil(t, err)
+	defer conn.Close()
+	client := api.NewTimeseriesServiceClient(conn)
+	now := time.Now().UnixNano()
+
+	resp, err := client.Write(context.Background(), &api.WriteRequest{
+		Series: []*api.Series{
+			{Key: "key", Elements: []*api.Element{{Timestamp: now, Data: []byte("one")}, {Timestamp: 0}}},
+			{Elements: []*api.Element{{Timestamp: now}}},
+		},
+	})
+	require.Nil(t, err)
+	assert.Equal(t, int64(1), resp.Accepted)
+	assert.Equal(t, int64(2), resp.Rejected)
+
+	stream, err := client.WriteStream(context.Background())
+	require.Nil(t, err)
+	for i := int64(1); i <= 3; i++ {
+		require.Nil(t, stream.Send(&api.Series{Key: "key", Elements: []*api.Element{{Timestamp: now + i, Data: []byte("stream")}}}))
+	}
+	resp, err = stream.CloseAndRecv()
+	require.Nil(t, err)
+	assert.Equal(t, int64(3), resp.Accepted)
+	assert.Equal(t, int64(0), resp.Rejected)
+
+	searchResults, err := client.Search(context.Background(), &api.SearchRequest{Key: "key", Newest: api.NoUpperBound})
+	require.Nil(t, err)
+	assert.Len(t, searchResults.Results.Elements, 4)
+}
+
+func TestClosedStorage(t *testing.T) {
+	var wg sync.WaitGroup
+	svr, strg, err := createTestServer(nil, nil, wg)
+	require.Nil(t, err)
+	defer func() {
+		svr.GracefulStop()
+		wg.Wait()
+	}()
+	strg.Close()
+
+	conn, err := grpc.Dial(":50001", grpc.WithInsecure())
+	require.Nil(t, err)
+	defer conn.Close()
+	client := api.NewTimeseriesServiceClient(conn)
+
+	_, err = client.Search(context.Background(), &api.SearchRequest{Key: "key", Newest: api.NoUpperBound})
+	st, _ := status.FromError(err)
+	assert.Equal(t, codes.Unavailable, st.Code())
+}
+
+func TestCardinality(t *testing.T) {
+	var wg sync.WaitGroup
+	svr, strg, err := createTestServer(nil, nil, wg)
+	require.Nil(t, err)
+	defer func() {
+		strg.Close()
+		svr.GracefulStop()
+		wg.Wait()
+	}()
+	now := time.Now()
+	for _, key := range []string{"trade.a", "trade.b", "book.a"} {
+		strg.Write(context.Background(), key, now, nil)
+	}
+
+	conn, err := grpc.Dial(":50001", grpc.WithInsecure())
+	require.Nil(t, err)
+	defer conn.Close()
+	client := api.NewTimeseriesServiceClient(conn)
+
+	resp, err := client.Cardinality(context.Background(), &api.CardinalityRequest{Limit: 1})
+	require.Nil(t, err)
+	assert.Equal(t, int64(3), resp.Series)
+	require.Len(t, resp.Offenders, 1)
+	assert.Equal(t, "trade.", resp.Offenders[0].Prefix)
+	assert.Equal(t, int64(2), resp.Offenders[0].Series)
+}
+
+func TestLast(t *testing.T) {
+	var wg sync.WaitGroup
+	svr, strg, err := createTestServer(nil, nil, wg)
+	require.Nil(t, err)
+	defer func() {
+		strg.Close()
+		svr.GracefulStop()
+		wg.Wait()
+	}()
+	base := time.Now()
+	for i := 0; i < 5; i++ {
+		strg.Write(context.Background(), "price", base.Add(time.Duration(10*i)), []byte{byte(i)})
+	}
+
+	conn, err := grpc.Dial(":50001", grpc.WithInsecure())
+	require.Nil(t, err)
+	defer conn.Close()
+	client := api.NewTimeseriesServiceClient(conn)
+
+	resp, err := client.Last(context.Background(), &api.LastRequest{Key: "price"})
+	require.Nil(t, err)
+	require.Len(t, resp.Results.Elements, 1)
+	assert.Equal(t, []byte{4}, resp.Results.Elements[0].Data)
+
+	resp, err = client.Last(context.Background(), &api.LastRequest{Key: "price", Count: 2})
+	require.Nil(t, err)
+	require.Len(t, resp.Results.Elements, 2)
+	assert.Equal(t, []byte{3}, resp.Results.Elements[0].Data)
+
+	resp, err = client.Last(context.Background(), &api.LastRequest{Key: "price", AsOf: uint64(base.Add(25).UnixNano())})
+	require.Nil(t, err)
+	require.Len(t, resp.Results.Elements, 1)
+	assert.Equal(t, []byte{2}, resp.Results.Elements[0].Data)
+
+	resp, err = client.Last(context.Background(), &api.LastRequest{Key: "price", AsOf: uint64(base.UnixNano() - 1)})
+	require.Nil(t, err)
+	assert.Equal(t, api.SearchResponse_NOT_FOUND, resp.Status)
+}
+
+func TestMultiSearch(t *testing.T) {
+	var wg sync.WaitGroup
+	svr, strg, err := createTestServer(nil, nil, wg)
+	require.Nil(t, err)
+	defer func() {
+		strg.Close()
+		svr.GracefulStop()
+		wg.Wait()
+	}()
+	now := time.Now()
+	keys := []string{"a", "b", "missing", "c"}
+	for i, key := range []string{"a", "b", "c"} {
+		for j := 0; j <= i; j++ {
+			strg.Write(context.Background(), key, now.Add(time.Duration(j)), []byte(key))
+		}
+	}
+
+	conn, err := grpc.Dial(":50001", grpc.WithInsecure())
+	require.Nil(t, err)
+	defer conn.Close()
+	client := api.NewTimeseriesServiceClient(conn)
+	req := &api.MultiSearchRequest{Keys: keys, Newest: api.NoUpperBound}
+
+	resp, err := client.MultiSearch(context.Background(), req)
+	require.Nil(t, err)
+	require.Len(t, resp.Results, len(keys))
+	for i, r := range resp.Results {
+		assert.Equal(t, keys[i], r.Results.Key)
+	}
+	assert.Len(t, resp.Results[1].Results.Elements, 2)
+	assert.Equal(t, now.Add(1).UnixNano(), resp.Results[1].Results.Elements[1].Timestamp)
+	assert.Equal(t, api.SearchResponse_NOT_FOUND, resp.Results[2].Status)
+	assert.Len(t, resp.Results[3].Results.Elements, 3)
+
+	stream, err := client.MultiSearchStream(context.Background(), req)
+	require.Nil(t, err)
+	found := make(map[string]api.SearchResponse_Status)
+	for {
+		r, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		require.Nil(t, err)
+		found[r.Results.Key] = r.Status
+	}
+	assert.Equal(t, map[string]api.SearchResponse_Status{
+		"a":       api.SearchResponse_OK,
+		"b":       api.SearchResponse_OK,
+		"c":       api.SearchResponse_OK,
+		"missing": api.SearchResponse_NOT_FOUND,
+	}, found)
+}
+
+func TestLabels(t *testing.T) {
+	var wg sync.WaitGroup
+	svr, strg, err := createTestServer(nil, nil, wg)
+	require.Nil(t, err)
+	defer func() {
+		strg.Close()
+		svr.GracefulStop()
+		wg.Wait()
+	}()
+
+	conn, err := grpc.Dial(":50001", grpc.WithInsecure())
+	require.Nil(t, err)
+	defer conn.Close()
+	client := api.NewTimeseriesServiceClient(conn)
+	now := time.Now().UnixNano()
+
+	_, err = client.Write(context.Background(), &api.WriteRequest{
+		Series: []*api.Series{
+			{Key: "ibm|arca", Labels: map[string]string{"symbol": "ibm", "venue": "arca"}, Elements: []*api.Element{{Timestamp: now}}},
+			{Key: "ibm|bats", Labels: map[string]string{"symbol": "ibm", "venue": "bats"}, Elements: []*api.Element{{Timestamp: now}}},
+			{Key: "aapl|arca", Labels: map[string]string{"symbol": "aapl", "venue": "arca"}, Elements: []*api.Element{{Timestamp: now}}},
+		},
+	})
+	require.Nil(t, err)
+
+	resp, err := client.MultiSearch(context.Background(), &api.MultiSearchRequest{
+		Newest: api.NoUpperBound,
+		Labels: []*api.LabelMatcher{
+			{Name: "symbol", Value: "ibm"},
+			{Name: "venue", Value: "a.*", Type: api.LabelMatcher_REGEX},
+		},
+	})
+	require.Nil(t, err)
+	require.Len(t, resp.Results, 1)
+	assert.Equal(t, "ibm|arca", resp.Results[0].Results.Key)
+	assert.Equal(t, map[string]string{"symbol": "ibm", "venue": "arca"}, resp.Results[0].Results.Labels)
+	assert.Len(t, resp.Results[0].Results.Elements, 1)
+
+	keys, err := client.ListKeys(context.Background(), &api.ListKeysRequest{
+		Labels: []*api.LabelMatcher{{Name: "symbol", Value: "ibm", Type: api.LabelMatcher_NOT_EQUAL}},
+	})
+	require.Nil(t, err)
+	require.Len(t, keys.Keys, 1)
+	assert.Equal(t, "aapl|arca", keys.Keys[0].Key)
+
+	_, err = client.MultiSearch(context.Background(), &api.MultiSearchRequest{
+		Keys:   []string{"ibm|arca"},
+		Labels: []*api.LabelMatcher{{Name: "symbol", Value: "ibm"}},
+	})
+	st, _ := status.FromError(err)
+	assert.Equal(t, codes.InvalidArgument, st.Code())
+
+	_, err = client.ListKeys(context.Background(), &api.ListKeysRequest{
+		Labels: []*api.LabelMatcher{{Name: "symbol", Value: "(", Type: api.LabelMatcher_REGEX}},
+	})
+	st, _ = status.FromError(err)
+	assert.Equal(t, codes.InvalidArgument, st.Code())
+}
+
+func TestListKeys(t *testing.T) {
+	var wg sync.WaitGroup
+	svr, strg, err := createTestServer(nil, nil, wg)
+	require.Nil(t, err)
+	defer func() {
+		strg.Close()
+		svr.GracefulStop()
+		wg.Wait()
+	}()
+	now := time.Now()
+	for _, key := range []string{"book.a", "book.b", "book.c", "trade.a"} {
+		strg.Write(context.Background(), key, now, nil)
+	}
+
+	conn, err := grpc.Dial(":50001", grpc.WithInsecure())
+	require.Nil(t, err)
+	defer conn.Close()
+	client := api.NewTimeseriesServiceClient(conn)
+
+	resp, err := client.ListKeys(context.Background(), &api.ListKeysRequest{Prefix: "book.", PageSize: 2})
+	require.Nil(t, err)
+	require.Len(t, resp.Keys, 2)
+	assert.Equal(t, "book.a", resp.Keys[0].Key)
+	assert.Equal(t, int64(1), resp.Keys[0].Count)
+	assert.Equal(t, now.UnixNano(), resp.Keys[0].Newest)
+	require.NotEmpty(t, resp.NextPageToken)
+
+	resp, err = client.ListKeys(context.Background(), &api.ListKeysRequest{
+		Prefix:    "book.",
+		PageSize:  2,
+		PageToken: resp.NextPageToken,
+	})
+	require.Nil(t, err)
+	require.Len(t, resp.Keys, 1)
+	assert.Equal(t, "book.c", resp.Keys[0].Key)
+	assert.Empty(t, resp.NextPageToken)
+}
+
+func TestDelete(t *testing.T) {
+	var wg sync.WaitGroup
+	svr, strg, err := createTestServer(nil, nil, wg)
+	require.Nil(t, err)
+	defer func() {
+		strg.Close()
+		svr.GracefulStop()
+		wg.Wait()
+	}()
+	now := time.Now()
+	for i := 0; i < 5; i++ {
+		strg.Write(context.Background(), "key", now.Add(time.Duration(i)), nil)
+	}
+
+	conn, err := grpc.Dial(":50001", grpc.WithInsecure())
+	require.Nil(t, err)
+	defer conn.Close()
+	client := api.NewTimeseriesServiceClient(conn)
+
+	resp, err := client.DeleteRange(context.Background(), &api.DeleteRangeRequest{
+		Key:    "key",
+		Oldest: uint64(now.Add(1).UnixNano()),
+		Newest: uint64(now.Add(3).UnixNano()),
+	})
+	require.Nil(t, err)
+	assert.Equal(t, int64(2), resp.Deleted)
+
+	resp, err = client.DeleteSeries(context.Background(), &api.DeleteSeriesRequest{Key: "key"})
+	require.Nil(t, err)
+	assert.Equal(t, int64(3), resp.Deleted)
+
+	_, err = client.DeleteSeries(context.Background(), &api.DeleteSeriesRequest{Key: "key"})
+	st, _ := status.FromError(err)
+	assert.Equal(t, codes.NotFound, st.Code())
+}
+
+func TestUnauthenticatedDelete(t *testing.T) {
+	loginHandler := func(u, p string) (string, error) {
+		return "token", nil
+	}
+	authHandler := func(jwt string) error {
+		return nil
+	}
+	var wg sync.WaitGroup
+	svr, strg, err := createTestServer(loginHandler, authHandler, wg)
+	require.Nil(t, err)
+	defer func() {
+		strg.Close()
+		svr.GracefulStop()
+		wg.Wait()
+	}()
+	strg.Write(context.Background(), "key", time.Now(), nil)
+
+	conn, err := grpc.Dial(":50001", grpc.WithInsecure())
+	require.Nil(t, err)
+	defer conn.Close()
+	client := api.NewTimeseriesServiceClient(conn)
+
+	_, err = client.DeleteSeries(context.Background(), &api.DeleteSeriesRequest{Key: "key"})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+	_, err = client.DeleteRange(context.Background(), &api.DeleteRangeRequest{Key: "key", Newest: api.NoUpperBound})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	elts, err := strg.Last(context.Background(), "key", 1)
+	require.Nil(t, err)
+	assert.Len(t, elts, 1)
+}
+
+func TestAggregate(t *testing.T) {
+	var wg sync.WaitGroup
+	svr, strg, err := createTestServer(nil, nil, wg)
+	require.Nil(t, err)
+	defer func() {
+		strg.Close()
+		svr.GracefulStop()
+		wg.Wait()
+	}()
+	base := time.Now().Truncate(time.Minute)
+	for i := 0; i < 4; i++ {
+		data := make([]byte, 8)
+		binary.BigEndian.PutUint64(data, uint64(i))
+		strg.Write(context.Background(), "key", base.Add(time.Duration(i)*30*time.Second), data)
+	}
+
+	conn, err := grpc.Dial(":50001", grpc.WithInsecure())
+	require.Nil(t, err)
+	defer conn.Close()
+	client := api.NewTimeseriesServiceClient(conn)
+
+	resp, err := client.Aggregate(context.Background(), &api.AggregateRequest{
+		Key:         "key",
+		Oldest:      api.NoLowerBound,
+		Newest:      api.NoUpperBound,
+		BucketWidth: int64(time.Minute),
+		Functions:   []api.AggregateRequest_Function{api.AggregateRequest_SUM, api.AggregateRequest_LAST},
+		Encoding:    api.ValueEncoding_INT64,
+	})
+	require.Nil(t, err)
+	require.Len(t, resp.Rows, 2)
+	assert.Equal(t, base.UnixNano(), resp.Rows[0].Start)
+	assert.Equal(t, []float64{1, 1}, resp.Rows[0].Values)
+	assert.Equal(t, []float64{5, 3}, resp.Rows[1].Values)
+}
+
+func TestCandles(t *testing.T) {
+	var wg sync.WaitGroup
+	svr, strg, err := createTestServer(nil, nil, wg)
+	require.Nil(t, err)
+	defer func() {
+		strg.Close()
+		svr.GracefulStop()
+		wg.Wait()
+	}()
+	base := time.Now().Truncate(time.Minute).Add(-3 * time.Minute)
+	for i, price := range []float64{10, 12, 9, 11} {
+		data := make([]byte, 8)
+		binary.BigEndian.PutUint64(data, math.Float64bits(price))
+		strg.Write(context.Background(), "ACME", base.Add(time.Duration(i)*40*time.Second), data)
+	}
+
+	conn, err := grpc.Dial(":50001", grpc.WithInsecure())
+	require.Nil(t, err)
+	defer conn.Close()
+	client := api.NewTimeseriesServiceClient(conn)
+	req := &api.CandleRequest{
+		Key:      "ACME",
+		Oldest:   api.NoLowerBound,
+		Newest:   api.NoUpperBound,
+		Interval: int64(time.Minute),
+	}
+
+	resp, err := client.Candles(context.Background(), req)
+	require.Nil(t, err)
+	require.Len(t, resp.Candles, 2)
+	assert.Equal(t, &api.Candle{Start: base.UnixNano(), Open: 10, High: 12, Low: 10, Close: 12, Volume: 2, Count: 2}, resp.Candles[0])
+	assert.Equal(t, &api.Candle{Start: base.Add(time.Minute).UnixNano(), Open: 9, High: 11, Low: 9, Close: 11, Volume: 2, Count: 2}, resp.Candles[1])
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream, err := client.StreamCandles(ctx, req)
+	require.Nil(t, err)
+	for _, expected := range resp.Candles {
+		c, err := stream.Recv()
+		require.Nil(t, err)
+		assert.Equal(t, expected, c)
+	}
+}
+
+type testSource struct {
+	ready bool
+}
+
+func (s *testSource) Start(wtr storage.Writer, logger log.Logger) error { return nil }
+func (s *testSource) Close() error                                      { return nil }
+func (s *testSource) Ready() bool                                       { return s.ready }
+
+type writeOnlySource struct{}
+
+func (writeOnlySource) Start(wtr storage.Writer, logger log.Logger) error { return nil }
+func (writeOnlySource) Close() error                                      { return nil }
+
+func TestReadiness(t *testing.T) {
+	replaying := &testSource{}
+	s := &svr{sources: []Source{writeOnlySource{}, replaying}}
+	assert.False(t, s.ready())
+	replaying.ready = true
+	assert.True(t, s.ready())
+
+	strg, err := storage.New(storage.Options{
+		MaxAge:            time.Hour,
+		WorkerCount:       1,
+		ChannelBufferSize: 10,
+		MessageCounter:    discard.NewCounter(),
+	})
+	require.Nil(t, err)
+	defer strg.Close()
+	strg.Write(context.Background(), "ACME", time.Now(), nil)
+
+	replaying.ready = false
+	svc := service.New(log.NewNopLogger(), strg, nil, nil, s.ready)
+	req := &api.SearchRequest{Key: "ACME", Oldest: api.NoLowerBound, Newest: api.NoUpperBound}
+	resp, err := svc.Search(context.Background(), req)
+	require.Nil(t, err)
+	assert.Len(t, resp.Results.Elements, 1)
+	assert.True(t, resp.Incomplete)
+
+	replaying.ready = true
+	resp, err = svc.Search(context.Background(), req)
+	require.Nil(t, err)
+	assert.False(t, resp.Incomplete)
+}